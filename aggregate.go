@@ -0,0 +1,710 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 百分位数使用对数分桶近似计算，与 pt-query-digest 的做法一致
+const (
+	bucketBase = 1.05
+	bucketMin  = 0.000001
+)
+
+var bucketLogBase = math.Log(bucketBase)
+
+func bucketIndex(v float64) int32 {
+	if v < bucketMin {
+		return -1
+	}
+	return int32(math.Log(v/bucketMin) / bucketLogBase)
+}
+
+func bucketValue(i int32) float64 {
+	if i < 0 {
+		return 0
+	}
+	return bucketMin * math.Pow(bucketBase, float64(i))
+}
+
+// metricAcc 数值型指标的累加器
+type metricAcc struct {
+	Count   int64
+	Sum     float64
+	SumSq   float64
+	Min     float64
+	Max     float64
+	Buckets map[int32]int64
+}
+
+func (m *metricAcc) add(v float64) {
+	if m.Count == 0 || v < m.Min {
+		m.Min = v
+	}
+	if m.Count == 0 || v > m.Max {
+		m.Max = v
+	}
+	m.Count++
+	m.Sum += v
+	m.SumSq += v * v
+	if m.Buckets == nil {
+		m.Buckets = make(map[int32]int64)
+	}
+	m.Buckets[bucketIndex(v)]++
+}
+
+func (m *metricAcc) merge(o *metricAcc) {
+	if o.Count == 0 {
+		return
+	}
+	if m.Count == 0 || o.Min < m.Min {
+		m.Min = o.Min
+	}
+	if m.Count == 0 || o.Max > m.Max {
+		m.Max = o.Max
+	}
+	m.Count += o.Count
+	m.Sum += o.Sum
+	m.SumSq += o.SumSq
+	if m.Buckets == nil {
+		m.Buckets = make(map[int32]int64, len(o.Buckets))
+	}
+	for k, v := range o.Buckets {
+		m.Buckets[k] += v
+	}
+}
+
+// 计算百分位数，p 取值 0~1
+func (m *metricAcc) percentile(p float64) float64 {
+	if m.Count == 0 {
+		return 0
+	}
+	keys := make([]int32, 0, len(m.Buckets))
+	for k := range m.Buckets {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	target := int64(math.Ceil(p * float64(m.Count)))
+	if target < 1 {
+		target = 1
+	}
+	var seen int64
+	value := m.Max
+	for _, k := range keys {
+		seen += m.Buckets[k]
+		if seen >= target {
+			value = bucketValue(k)
+			break
+		}
+	}
+	return math.Min(math.Max(value, m.Min), m.Max)
+}
+
+func (m *metricAcc) avg() float64 {
+	if m.Count == 0 {
+		return 0
+	}
+	return m.Sum / float64(m.Count)
+}
+
+func (m *metricAcc) stddev() float64 {
+	if m.Count < 2 {
+		return 0
+	}
+	n := float64(m.Count)
+	variance := (m.SumSq - m.Sum*m.Sum/n) / (n - 1)
+	if variance < 0 {
+		return 0
+	}
+	return math.Sqrt(variance)
+}
+
+// 时间类指标保留 6 位小数，计数类指标取整
+func formatSeconds(v float64) string { return fmt.Sprintf("%.6f", v) }
+
+func formatCount(v float64) string { return fmt.Sprintf("%.0f", v) }
+
+func (m *metricAcc) stats(format func(float64) string, pct string) MetricStats {
+	return MetricStats{
+		Pct:    pct,
+		Stddev: format(m.stddev()),
+		Sum:    format(m.Sum),
+		Pct95:  format(m.percentile(0.95)),
+		Max:    format(m.Max),
+		Median: format(m.percentile(0.5)),
+		Avg:    format(m.avg()),
+		Min:    format(m.Min),
+	}
+}
+
+// 统计字符串取值出现的次数，返回出现最多的值
+func topValue(counts map[string]int64) string {
+	var best string
+	var bestCount int64
+	for value, count := range counts {
+		if count > bestCount || count == bestCount && value < best {
+			best, bestCount = value, count
+		}
+	}
+	return best
+}
+
+// Query_time 直方图的分桶：1us, 10us, 100us, 1ms, 10ms, 100ms, 1s, 10s+
+func histogramIndex(queryTime float64) int {
+	i := 0
+	for limit := 0.00001; i < 7 && queryTime >= limit; limit *= 10 {
+		i++
+	}
+	return i
+}
+
+// 头部中不作为统计指标的属性（标识类字段）
+var nonMetricAttrs = map[string]bool{
+	"Log_slow_rate_type":  true,
+	"Log_slow_rate_limit": true,
+	"InnoDB_trx_id":       true,
+	"Errno":               true,
+	"Last_errno":          true,
+	"Killed":              true,
+	"Start":               true,
+	"End":                 true,
+}
+
+// 取记录的错误码和终止状态（MySQL 8.0 log_slow_extra 的 Errno/Killed，Percona Server 的 Last_errno/Killed）
+func entryFailure(attrs map[string]string) (errno string, killed bool) {
+	errno = attrs["Errno"]
+	if errno == "" {
+		errno = attrs["Last_errno"]
+	}
+	if errno == "0" {
+		errno = ""
+	}
+	killedValue := attrs["Killed"]
+	killed = killedValue != "" && killedValue != "0"
+	return errno, killed
+}
+
+// failureAcc 被终止或执行出错的查询的统计
+type failureAcc struct {
+	Killed    int64
+	Errored   int64
+	Errnos    map[string]int64
+	QueryTime metricAcc
+}
+
+func (f *failureAcc) merge(o *failureAcc) {
+	f.Killed += o.Killed
+	f.Errored += o.Errored
+	for errno, count := range o.Errnos {
+		f.Errnos[errno] += count
+	}
+	f.QueryTime.merge(&o.QueryTime)
+}
+
+// sourceAcc 某个日志来源在一个类中的统计
+type sourceAcc struct {
+	Count     int64
+	QueryTime metricAcc
+}
+
+// classAcc 同一指纹的查询的累加器
+type classAcc struct {
+	Checksum     string
+	Fingerprint  string
+	Count        int64
+	QueryTime    metricAcc
+	LockTime     metricAcc
+	RowsSent     metricAcc
+	RowsExamined metricAcc
+	QueryLength  metricAcc
+	Users        map[string]int64
+	Hosts        map[string]int64
+	Dbs          map[string]int64
+	TsMin        time.Time
+	TsMax        time.Time
+	Histogram    [8]int
+	Sources      map[string]*sourceAcc
+	// 扩展数值指标和布尔指标（Yes 的次数）
+	Extra map[string]*metricAcc
+	Flags map[string]int64
+	// 被终止或执行出错的查询单独计数，避免超时的查询混在成功的查询中
+	Failures failureAcc
+	// 数据库待定的记录数，见 slowEntry.dbPending
+	pendingDb int64
+	// 执行时间最长的一条记录作为示例
+	Example *slowEntry
+	// 随机示例，按优先级升序保留优先级最小的 sampleLimit 条
+	Samples     []sampleEntry
+	sampleLimit int
+}
+
+// sampleEntry 随机示例及其优先级。优先级由记录内容的哈希得到，保留优先级最小的若干条相当于随机抽样，
+// 且与分片的划分和合并顺序无关，多次运行的结果一致
+type sampleEntry struct {
+	priority uint64
+	entry    *slowEntry
+}
+
+func samplePriority(e *slowEntry) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00%s\x00%s", e.Source, e.Offset, e.Ts.UnixNano(), e.ThreadId, e.Query)
+	return h.Sum64()
+}
+
+func (c *classAcc) addSample(s sampleEntry) {
+	if c.sampleLimit <= 0 {
+		return
+	}
+	i := sort.Search(len(c.Samples), func(i int) bool { return c.Samples[i].priority > s.priority })
+	if i >= c.sampleLimit {
+		return
+	}
+	c.Samples = append(c.Samples, sampleEntry{})
+	copy(c.Samples[i+1:], c.Samples[i:])
+	c.Samples[i] = s
+	if len(c.Samples) > c.sampleLimit {
+		c.Samples = c.Samples[:c.sampleLimit]
+	}
+}
+
+func newClassAcc(checksum, fp string) *classAcc {
+	return &classAcc{
+		Checksum:    checksum,
+		Fingerprint: fp,
+		Users:       make(map[string]int64),
+		Hosts:       make(map[string]int64),
+		Dbs:         make(map[string]int64),
+		Sources:     make(map[string]*sourceAcc),
+		Extra:       make(map[string]*metricAcc),
+		Flags:       make(map[string]int64),
+		Failures:    failureAcc{Errnos: make(map[string]int64)},
+	}
+}
+
+// 统计头部中的扩展属性：Yes/No 作为布尔指标，数值作为数值指标
+func (c *classAcc) addAttrs(attrs map[string]string) {
+	for name, value := range attrs {
+		if nonMetricAttrs[name] {
+			continue
+		}
+		switch strings.ToLower(value) {
+		case "yes":
+			c.Flags[name]++
+			continue
+		case "no":
+			if _, ok := c.Flags[name]; !ok {
+				c.Flags[name] = 0
+			}
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		m, ok := c.Extra[name]
+		if !ok {
+			m = &metricAcc{}
+			c.Extra[name] = m
+		}
+		m.add(v)
+	}
+}
+
+func (c *classAcc) addMetrics(e *slowEntry) {
+	c.Count++
+	c.QueryTime.add(e.QueryTime)
+	c.LockTime.add(e.LockTime)
+	c.RowsSent.add(e.RowsSent)
+	c.RowsExamined.add(e.RowsExamined)
+	c.QueryLength.add(float64(len(e.Query)))
+	if !e.Ts.IsZero() {
+		if c.TsMin.IsZero() || e.Ts.Before(c.TsMin) {
+			c.TsMin = e.Ts
+		}
+		if e.Ts.After(c.TsMax) {
+			c.TsMax = e.Ts
+		}
+	}
+}
+
+func (c *classAcc) add(e *slowEntry) {
+	c.addMetrics(e)
+	if e.User != "" {
+		c.Users[e.User]++
+	}
+	if e.Host != "" {
+		c.Hosts[e.Host]++
+	}
+	if e.Db != "" {
+		c.Dbs[e.Db]++
+	}
+	if e.dbPending {
+		c.pendingDb++
+	}
+	c.Histogram[histogramIndex(e.QueryTime)]++
+	c.addAttrs(e.Attrs)
+	if errno, killed := entryFailure(e.Attrs); errno != "" || killed {
+		if killed {
+			c.Failures.Killed++
+		}
+		if errno != "" {
+			c.Failures.Errored++
+			c.Failures.Errnos[errno]++
+		}
+		c.Failures.QueryTime.add(e.QueryTime)
+	}
+	if e.Source != "" {
+		src, ok := c.Sources[e.Source]
+		if !ok {
+			src = &sourceAcc{}
+			c.Sources[e.Source] = src
+		}
+		src.Count++
+		src.QueryTime.add(e.QueryTime)
+	}
+	if c.Example == nil || e.QueryTime > c.Example.QueryTime {
+		c.Example = e
+	}
+	c.addSample(sampleEntry{priority: samplePriority(e), entry: e})
+}
+
+func (c *classAcc) mergeMetrics(o *classAcc) {
+	c.Count += o.Count
+	c.QueryTime.merge(&o.QueryTime)
+	c.LockTime.merge(&o.LockTime)
+	c.RowsSent.merge(&o.RowsSent)
+	c.RowsExamined.merge(&o.RowsExamined)
+	c.QueryLength.merge(&o.QueryLength)
+	if !o.TsMin.IsZero() && (c.TsMin.IsZero() || o.TsMin.Before(c.TsMin)) {
+		c.TsMin = o.TsMin
+	}
+	if o.TsMax.After(c.TsMax) {
+		c.TsMax = o.TsMax
+	}
+}
+
+func (c *classAcc) merge(o *classAcc) {
+	c.mergeMetrics(o)
+	for k, v := range o.Users {
+		c.Users[k] += v
+	}
+	for k, v := range o.Hosts {
+		c.Hosts[k] += v
+	}
+	for k, v := range o.Dbs {
+		c.Dbs[k] += v
+	}
+	for i, v := range o.Histogram {
+		c.Histogram[i] += v
+	}
+	for name, other := range o.Sources {
+		src, ok := c.Sources[name]
+		if !ok {
+			c.Sources[name] = other
+			continue
+		}
+		src.Count += other.Count
+		src.QueryTime.merge(&other.QueryTime)
+	}
+	for name, other := range o.Extra {
+		m, ok := c.Extra[name]
+		if !ok {
+			c.Extra[name] = other
+			continue
+		}
+		m.merge(other)
+	}
+	for name, count := range o.Flags {
+		c.Flags[name] += count
+	}
+	c.Failures.merge(&o.Failures)
+	// 执行时间相同时保留先出现的示例，保证合并结果与分片顺序无关的确定性
+	if c.Example == nil || o.Example != nil && o.Example.QueryTime > c.Example.QueryTime {
+		c.Example = o.Example
+	}
+	for _, s := range o.Samples {
+		c.addSample(s)
+	}
+}
+
+// aggregator 按指纹对查询进行分组统计
+type aggregator struct {
+	dialect sqlDialect
+	// 数据来源没有执行耗时，例如通用查询日志和 binlog，报告按执行次数排序
+	noLatency bool
+	global    *classAcc
+	classes   map[string]*classAcc
+	// 格式异常的记录，按文件和偏移量的顺序排列
+	malformed []malformedEntry
+	// 每个类展示的示例数，包括执行时间最长的一条
+	samples int
+	// 分片中最后一条记录的数据库，下一个分片开头没有数据库的记录沿用该值
+	lastDb string
+}
+
+func newAggregator(dialect sqlDialect) *aggregator {
+	return &aggregator{
+		dialect: dialect,
+		global:  newClassAcc("", ""),
+		classes: make(map[string]*classAcc),
+	}
+}
+
+func (a *aggregator) add(e *slowEntry) {
+	fp := a.dialect.fingerprint(e.Query)
+	checksum := fingerprintChecksum(fp)
+	class, ok := a.classes[checksum]
+	if !ok {
+		class = newClassAcc(checksum, fp)
+		class.sampleLimit = a.samples
+		a.classes[checksum] = class
+	}
+	class.add(e)
+	a.global.addMetrics(e)
+}
+
+// 合并另一个分片的统计结果，调用方需按固定顺序合并以保证结果确定
+// 将数据库待定的记录归到 db，与从文件开头连续解析时沿用前一条记录的数据库一致
+func (a *aggregator) resolvePendingDb(db string) {
+	for _, class := range a.classes {
+		if class.pendingDb == 0 {
+			continue
+		}
+		if db != "" {
+			class.Dbs[db] += class.pendingDb
+		}
+		class.pendingDb = 0
+		for _, e := range append([]*slowEntry{class.Example}, sampleEntries(class.Samples)...) {
+			if e != nil && e.dbPending {
+				e.Db = db
+				e.dbPending = false
+			}
+		}
+	}
+}
+
+func sampleEntries(samples []sampleEntry) []*slowEntry {
+	entries := make([]*slowEntry, len(samples))
+	for i, s := range samples {
+		entries[i] = s.entry
+	}
+	return entries
+}
+
+func (a *aggregator) merge(o *aggregator) {
+	a.global.mergeMetrics(o.global)
+	a.malformed = append(a.malformed, o.malformed...)
+	for checksum, oc := range o.classes {
+		class, ok := a.classes[checksum]
+		if !ok {
+			a.classes[checksum] = oc
+			continue
+		}
+		class.merge(oc)
+	}
+}
+
+func formatReportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// 生成与 pt-query-digest JSON 输出结构一致的报告
+func (a *aggregator) report(files []ReportFile) *Report {
+	report := &Report{}
+	g := a.global
+	report.Global.Files = files
+	report.Global.QueryCount = int(g.Count)
+	report.Global.UniqueQueryCount = len(a.classes)
+	report.Global.TsMin = formatReportTime(g.TsMin)
+	report.Global.TsMax = formatReportTime(g.TsMax)
+	report.Global.Engine = a.dialect.engine()
+	report.Global.NoLatency = a.noLatency
+	report.Global.Metrics = GlobalMetrics{
+		QueryLength:  g.QueryLength.stats(formatCount, ""),
+		LockTime:     g.LockTime.stats(formatSeconds, ""),
+		RowsExamined: g.RowsExamined.stats(formatCount, ""),
+		RowsSent:     g.RowsSent.stats(formatCount, ""),
+		QueryTime:    g.QueryTime.stats(formatSeconds, ""),
+	}
+
+	classes := make([]*classAcc, 0, len(a.classes))
+	for _, c := range a.classes {
+		classes = append(classes, c)
+	}
+	// 与 pt-query-digest 一致，默认按总执行时间降序排列
+	sort.Slice(classes, func(i, j int) bool {
+		if a.noLatency && classes[i].Count != classes[j].Count {
+			return classes[i].Count > classes[j].Count
+		}
+		if classes[i].QueryTime.Sum != classes[j].QueryTime.Sum {
+			return classes[i].QueryTime.Sum > classes[j].QueryTime.Sum
+		}
+		return classes[i].Checksum < classes[j].Checksum
+	})
+
+	for _, c := range classes {
+		rc := c.reportClass(g.Count, a.dialect)
+		if a.noLatency {
+			// 没有的指标留空，报告中显示为 "-"，而不是误导性的 0
+			rc.Example.QueryTime = ""
+			for i := range rc.Samples {
+				rc.Samples[i].QueryTime = ""
+			}
+			rc.Metrics.QueryTime = MetricStats{}
+			rc.Metrics.LockTime = MetricStats{}
+			rc.Metrics.RowsSent = MetricStats{}
+			rc.Metrics.RowsExamined = MetricStats{}
+			rc.Sources = noLatencySources(rc.Sources)
+		}
+		report.Classes = append(report.Classes, rc)
+	}
+	if a.noLatency {
+		report.Global.Metrics.QueryTime = MetricStats{}
+		report.Global.Metrics.LockTime = MetricStats{}
+		report.Global.Metrics.RowsSent = MetricStats{}
+		report.Global.Metrics.RowsExamined = MetricStats{}
+	}
+	return report
+}
+
+func noLatencySources(sources []ClassSource) []ClassSource {
+	for i := range sources {
+		sources[i].QueryTime = MetricStats{}
+	}
+	return sources
+}
+
+func classExample(e *slowEntry) ClassExample {
+	return ClassExample{
+		QueryTime: formatSeconds(e.QueryTime),
+		Query:     e.Query,
+		Ts:        formatReportTime(e.Ts),
+		Id:        e.ThreadId,
+		Host:      e.Host,
+		User:      e.User,
+	}
+}
+
+// 除执行时间最长的示例之外的随机示例，按时间排序。示例数包括执行时间最长的一条，随机示例最多 sampleLimit-1 条
+func (c *classAcc) randomSamples() []ClassExample {
+	var entries []*slowEntry
+	for _, s := range c.Samples {
+		if s.entry != c.Example && len(entries) < c.sampleLimit-1 {
+			entries = append(entries, s.entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Ts.Before(entries[j].Ts)
+	})
+	var samples []ClassExample
+	for _, e := range entries {
+		samples = append(samples, classExample(e))
+	}
+	return samples
+}
+
+func (c *classAcc) reportClass(total int64, dialect sqlDialect) ReportClass {
+	pct := ""
+	if total > 0 {
+		pct = fmt.Sprintf("%.6f", float64(c.Count)/float64(total))
+	}
+	example := c.Example
+	query := example.Query
+	if dialect == dialectPostgres {
+		query = unquotePgIdentifiers(query)
+	}
+	rc := ReportClass{
+		Attribute:   "fingerprint",
+		Checksum:    c.Checksum,
+		Fingerprint: c.Fingerprint,
+		Distillate:  distill(query),
+		QueryCount:  int(c.Count),
+		TsMin:       formatReportTime(c.TsMin),
+		TsMax:       formatReportTime(c.TsMax),
+		Example:     classExample(example),
+		Samples:     c.randomSamples(),
+		Histograms:  ClassHistograms{QueryTime: c.Histogram[:]},
+		Metrics: ClassMetrics{
+			LockTime:     c.LockTime.stats(formatSeconds, pct),
+			QueryLength:  c.QueryLength.stats(formatCount, pct),
+			RowsSent:     c.RowsSent.stats(formatCount, pct),
+			RowsExamined: c.RowsExamined.stats(formatCount, pct),
+			QueryTime:    c.QueryTime.stats(formatSeconds, pct),
+			User:         ValueMetric{Value: topValue(c.Users)},
+			Host:         ValueMetric{Value: topValue(c.Hosts)},
+			Db:           ValueMetric{Value: topValue(c.Dbs)},
+		},
+	}
+	for name, m := range c.Extra {
+		if rc.Metrics.Extra == nil {
+			rc.Metrics.Extra = make(map[string]MetricStats)
+		}
+		format := formatCount
+		if isTimeMetric(name) {
+			format = formatSeconds
+		}
+		rc.Metrics.Extra[name] = m.stats(format, pct)
+	}
+	for name, count := range c.Flags {
+		if rc.Metrics.Flags == nil {
+			rc.Metrics.Flags = make(map[string]FlagStats)
+		}
+		rc.Metrics.Flags[name] = FlagStats{Yes: strconv.FormatInt(count, 10)}
+	}
+
+	if c.Failures.QueryTime.Count > 0 {
+		rc.Failures = &ClassFailures{
+			Killed:    int(c.Failures.Killed),
+			Errored:   int(c.Failures.Errored),
+			Errnos:    make(map[string]int),
+			QueryTime: c.Failures.QueryTime.stats(formatSeconds, ""),
+		}
+		for errno, count := range c.Failures.Errnos {
+			rc.Failures.Errnos[errno] = int(count)
+		}
+	}
+
+	names := make([]string, 0, len(c.Sources))
+	for name := range c.Sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		src := c.Sources[name]
+		rc.Sources = append(rc.Sources, ClassSource{
+			Source:     name,
+			QueryCount: int(src.Count),
+			QueryTime:  src.QueryTime.stats(formatSeconds, ""),
+		})
+	}
+
+	seen := make(map[string]bool)
+	if dialect == dialectPostgres {
+		// PostgreSQL 的库名不能用于限定表名，限定名中的前缀是 schema
+		for _, t := range extractTables(query, "") {
+			key := t[0] + "." + t[1]
+			if !seen[key] {
+				seen[key] = true
+				rc.Tables = append(rc.Tables, pgClassTableFor(t[0], t[1]))
+			}
+		}
+		return rc
+	}
+	for _, t := range extractTables(query, example.Db) {
+		key := t[0] + "." + t[1]
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		rc.Tables = append(rc.Tables, classTableFor(t[0], t[1]))
+	}
+	return rc
+}
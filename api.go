@@ -0,0 +1,512 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// 类列表接口每页的默认条数和最大条数
+	classPageSize    = 50
+	classPageSizeMax = 1000
+)
+
+// Query_time 直方图各分桶的下限，与 pt-query-digest 相同
+var histogramBuckets = []string{"1us", "10us", "100us", "1ms", "10ms", "100ms", "1s", "10s+"}
+
+// apiAnalysis 分析列表中的一项
+type apiAnalysis struct {
+	Id string `json:"id"`
+	// 按请求生成的 HTML 报告的访问路径
+	Url string `json:"url"`
+	// 写入报告目录的 HTML 报告和导出文件
+	Report  string    `json:"report,omitempty"`
+	Exports []string  `json:"exports,omitempty"`
+	Created time.Time `json:"created"`
+	// 是否导出了 JSON 文件。没有导出的分析结果只保存在内存中，服务重启后无法再访问
+	Persisted bool `json:"persisted"`
+}
+
+// apiSummary 一份分析结果的全局汇总
+type apiSummary struct {
+	apiAnalysis
+	Generated  string   `json:"generated"`
+	Engine     string   `json:"engine"`
+	Sources    []string `json:"sources"`
+	LogFiles   []string `json:"logFiles"`
+	StartTime  string   `json:"startTime"`
+	EndTime    string   `json:"endTime"`
+	HasLatency bool     `json:"hasLatency"`
+	// 查询类数和全部语句的执行次数
+	Classes int `json:"classes"`
+	Queries int `json:"queries"`
+	// 全部语句的总执行时间（秒），没有执行耗时的数据来源为 null
+	TimeSum *float64 `json:"timeSum"`
+	Killed  int      `json:"killed"`
+	Errors  int      `json:"errors"`
+	// 格式异常的记录，没有时省略
+	ParseWarnings *ParseWarnings `json:"parseWarnings,omitempty"`
+}
+
+// apiClassDetail 单个查询类的完整统计，在 TableRow 的基础上增加详情中展示的指标和示例
+type apiClassDetail struct {
+	TableRow
+	Distillate string   `json:"distillate"`
+	TimeSum    *float64 `json:"timeSum"`
+	TimeMin    *float64 `json:"timeMin"`
+	LockMin    *float64 `json:"lockMin"`
+	Lock95     *float64 `json:"lock95"`
+	RowsSent   *float64 `json:"rowsSentMax"`
+	LengthMax  *float64 `json:"lengthMax"`
+	Killed     int      `json:"killed"`
+	Errors     int      `json:"errors"`
+	ErrorCodes string   `json:"errorCodes,omitempty"`
+	// 各来源（实例）的执行次数和耗时
+	SourceStats []apiSourceStat `json:"sourceStats,omitempty"`
+	Metrics     []apiMetric     `json:"metrics,omitempty"`
+	Flags       []apiFlag       `json:"flags,omitempty"`
+	Histogram   []apiBucket     `json:"histogram,omitempty"`
+	Samples     []apiSample     `json:"samples"`
+}
+
+type apiSourceStat struct {
+	Source  string   `json:"source"`
+	Count   int      `json:"count"`
+	TimeAvg *float64 `json:"timeAvg"`
+	Time95  *float64 `json:"time95"`
+	TimeMax *float64 `json:"timeMax"`
+}
+
+type apiMetric struct {
+	Name  string   `json:"name"`
+	Sum   *float64 `json:"sum"`
+	Avg   *float64 `json:"avg"`
+	Pct95 *float64 `json:"pct95"`
+	Max   *float64 `json:"max"`
+}
+
+type apiFlag struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+type apiBucket struct {
+	Bucket string `json:"bucket"`
+	Count  int    `json:"count"`
+}
+
+type apiSample struct {
+	Query     string   `json:"query"`
+	QueryTime *float64 `json:"queryTime"`
+	Ts        string   `json:"ts,omitempty"`
+	Host      string   `json:"host,omitempty"`
+	User      string   `json:"user,omitempty"`
+	ThreadId  string   `json:"threadId,omitempty"`
+}
+
+// apiTable 按表汇总的统计。有执行耗时的数据来源按涉及该表的查询类汇总，
+// 通用查询日志和 binlog 为各类语句的读写次数
+type apiTable struct {
+	Table   string   `json:"table"`
+	Classes int      `json:"classes,omitempty"`
+	Count   int      `json:"count"`
+	TimeSum *float64 `json:"timeSum,omitempty"`
+	RowsSum *float64 `json:"rowsSum,omitempty"`
+	// 各类语句的执行次数，只有没有执行耗时的数据来源提供
+	Operations *apiTableOperations `json:"operations,omitempty"`
+}
+
+type apiTableOperations struct {
+	Selects      int    `json:"selects"`
+	Inserts      int    `json:"inserts"`
+	Updates      int    `json:"updates"`
+	Deletes      int    `json:"deletes"`
+	Others       int    `json:"others"`
+	Writes       int    `json:"writes"`
+	RowsAffected string `json:"rowsAffected,omitempty"`
+}
+
+// 类列表接口支持的排序字段，与 TableRow 的 JSON 字段名相同
+var classSortKeys = map[string]func(r TableRow) *float64{
+	"count": func(r TableRow) *float64 {
+		f := float64(r.Count)
+		return &f
+	},
+	"countPct":   func(r TableRow) *float64 { return &r.CountPct },
+	"timeMedian": func(r TableRow) *float64 { return r.TimeMedian },
+	"timeMax":    func(r TableRow) *float64 { return r.TimeMax },
+	"time95":     func(r TableRow) *float64 { return r.Time95 },
+	"rowsSum":    func(r TableRow) *float64 { return r.RowsSum },
+	"rowsMax":    func(r TableRow) *float64 { return r.RowsMax },
+	"lockMax":    func(r TableRow) *float64 { return r.LockMax },
+}
+
+// GET /api/openapi.json，接口的 OpenAPI 描述
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	setSecurityHeaders(w)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(openAPISpec)
+}
+
+// GET /api/analyses，列出可以查询的分析结果，按生成时间从新到旧排列
+func (s *reportServer) handleAnalyses(w http.ResponseWriter, r *http.Request) {
+	reports, err := s.listReports()
+	if err != nil {
+		printColoredInfo("red", "读取报告目录失败: %s", err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "读取报告目录失败")
+		return
+	}
+	list := []apiAnalysis{}
+	for _, report := range reports {
+		if !report.Live && !report.hasJSON() {
+			continue
+		}
+		list = append(list, apiAnalysis{
+			Id:        report.Id,
+			Url:       "/analyses/" + report.Id,
+			Report:    report.Name,
+			Exports:   report.Exports,
+			Created:   report.ModTime,
+			Persisted: report.hasJSON(),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"analyses": list})
+}
+
+// 读取路径中的分析结果，不存在时返回 404
+func (s *reportServer) analysis(w http.ResponseWriter, r *http.Request) *storedAnalysis {
+	entry, err := s.analyses.get(r.PathValue("id"))
+	if err != nil {
+		printColoredInfo("red", "%s", err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "读取分析结果失败")
+		return nil
+	}
+	if entry == nil {
+		writeJSONError(w, http.StatusNotFound, "分析结果不存在，只能查询本次启动后生成的报告，或导出了 JSON 文件的报告")
+		return nil
+	}
+	return entry
+}
+
+// GET /api/analyses/{id}，分析结果的全局汇总
+func (s *reportServer) handleSummary(w http.ResponseWriter, r *http.Request) {
+	entry := s.analysis(w, r)
+	if entry == nil {
+		return
+	}
+	data := entry.Data
+	summary := apiSummary{
+		apiAnalysis: apiAnalysis{
+			Id:        entry.Id,
+			Url:       "/analyses/" + entry.Id,
+			Report:    entry.Report,
+			Exports:   entry.Exports,
+			Created:   entry.Created,
+			Persisted: entry.persisted(),
+		},
+		Generated:  data.GenerateTime,
+		Engine:     data.Engine,
+		Sources:    data.Sources,
+		LogFiles:   data.LogFiles,
+		StartTime:  data.StartTime,
+		EndTime:    data.EndTime,
+		HasLatency: data.HasLatency,
+		Classes:    len(data.SlowQueries),
+		Queries:    totalQueryCount(data),
+	}
+	if data.ParseWarnings != nil {
+		summary.ParseWarnings = data.ParseWarnings.ParseWarnings
+	}
+	timeSum := 0.0
+	for _, info := range data.SlowQueries {
+		if t := parseMetric(info.TimeSum); t != nil {
+			timeSum += *t
+		}
+		summary.Killed += info.KilledCount
+		summary.Errors += info.ErrorCount
+	}
+	if data.HasLatency {
+		summary.TimeSum = &timeSum
+	}
+	if reports, err := s.listReports(); err == nil {
+		for _, report := range reports {
+			if report.Id == entry.Id {
+				summary.Created = report.ModTime
+				summary.Exports = report.Exports
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// classFilter 类列表接口的筛选条件
+type classFilter struct {
+	terms                 []string
+	db, user, host        string
+	table, source         string
+	minCount              int
+	minTime95, minTimeMax *float64
+}
+
+func parseClassFilter(q map[string][]string) (classFilter, error) {
+	get := func(name string) string {
+		if v := q[name]; len(v) > 0 {
+			return strings.TrimSpace(v[0])
+		}
+		return ""
+	}
+	f := classFilter{
+		terms:  strings.Fields(strings.ToLower(get("q"))),
+		db:     get("db"),
+		user:   get("user"),
+		host:   get("host"),
+		table:  get("table"),
+		source: get("source"),
+	}
+	if v := get("minCount"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return f, errors.New("参数 minCount 错误: 应为非负整数")
+		}
+		f.minCount = n
+	}
+	for name, target := range map[string]**float64{"minTime95": &f.minTime95, "minTimeMax": &f.minTimeMax} {
+		if v := get(name); v != "" {
+			if *target = parseMetric(v); *target == nil {
+				return f, fmt.Errorf("参数 %s 错误: 应为秒数", name)
+			}
+		}
+	}
+	return f, nil
+}
+
+func (f classFilter) match(row TableRow) bool {
+	if f.db != "" && row.Db != f.db || f.user != "" && row.User != f.user || f.host != "" && row.Host != f.host {
+		return false
+	}
+	if f.table != "" && !hasDuplicate(row.Tables, f.table) || f.source != "" && !hasDuplicate(row.Sources, f.source) {
+		return false
+	}
+	if row.Count < f.minCount {
+		return false
+	}
+	if f.minTime95 != nil && (row.Time95 == nil || *row.Time95 < *f.minTime95) {
+		return false
+	}
+	if f.minTimeMax != nil && (row.TimeMax == nil || *row.TimeMax < *f.minTimeMax) {
+		return false
+	}
+	if len(f.terms) > 0 {
+		text := strings.ToLower(row.Id + "\n" + row.Sql + "\n" + row.Fingerprint)
+		for _, term := range f.terms {
+			if !strings.Contains(text, term) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// GET /api/analyses/{id}/classes，查询类列表，支持筛选、排序和分页，默认按报告中的顺序排列
+func (s *reportServer) handleClasses(w http.ResponseWriter, r *http.Request) {
+	entry := s.analysis(w, r)
+	if entry == nil {
+		return
+	}
+	q := r.URL.Query()
+	filter, err := parseClassFilter(q)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rows := []TableRow{}
+	for _, row := range entry.Data.TableRows {
+		if filter.match(row) {
+			rows = append(rows, row)
+		}
+	}
+	if key := q.Get("sort"); key != "" {
+		value, ok := classSortKeys[key]
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "不支持的排序字段: "+key+"（可选 count、countPct、timeMedian、timeMax、time95、rowsSum、rowsMax、lockMax）")
+			return
+		}
+		asc := false
+		switch q.Get("order") {
+		case "", "desc":
+		case "asc":
+			asc = true
+		default:
+			writeJSONError(w, http.StatusBadRequest, "参数 order 错误: 应为 asc 或 desc")
+			return
+		}
+		// 没有该指标的类始终排在最后
+		sort.SliceStable(rows, func(i, j int) bool {
+			a, b := value(rows[i]), value(rows[j])
+			if a == nil || b == nil {
+				return a != nil
+			}
+			if asc {
+				return *a < *b
+			}
+			return *a > *b
+		})
+	}
+	limit, offset := classPageSize, 0
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > classPageSizeMax {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("参数 limit 错误: 应为 1 到 %d", classPageSizeMax))
+			return
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			writeJSONError(w, http.StatusBadRequest, "参数 offset 错误: 应为非负整数")
+			return
+		}
+	}
+	total := len(rows)
+	page := rows[min(offset, total):min(offset+limit, total)]
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total":   total,
+		"offset":  offset,
+		"limit":   limit,
+		"classes": page,
+	})
+}
+
+// GET /api/analyses/{id}/classes/{checksum}，单个查询类的详细统计、示例和执行时间直方图
+func (s *reportServer) handleClass(w http.ResponseWriter, r *http.Request) {
+	entry := s.analysis(w, r)
+	if entry == nil {
+		return
+	}
+	checksum := r.PathValue("checksum")
+	for i, info := range entry.Data.SlowQueries {
+		if strings.EqualFold(info.Id, checksum) {
+			writeJSON(w, http.StatusOK, buildClassDetail(info, entry.Data.TableRows[i]))
+			return
+		}
+	}
+	writeJSONError(w, http.StatusNotFound, "查询类不存在: "+checksum)
+}
+
+func buildClassDetail(info SlowSqlInfo, row TableRow) apiClassDetail {
+	detail := apiClassDetail{
+		TableRow:   row,
+		Distillate: info.Distillate,
+		TimeSum:    parseMetric(info.TimeSum),
+		TimeMin:    parseMetric(info.TimeMin),
+		LockMin:    parseMetric(info.LockTimeMin),
+		Lock95:     parseMetric(info.LockTime95),
+		RowsSent:   parseMetric(info.RowSendMax),
+		LengthMax:  parseMetric(info.LengthMax),
+		Killed:     info.KilledCount,
+		Errors:     info.ErrorCount,
+		ErrorCodes: info.ErrorCodes,
+		Samples:    []apiSample{},
+	}
+	// 列表中指纹与 SQL 相同时省略，详情中始终返回
+	detail.Fingerprint = info.Fingerprint
+	for _, src := range info.Sources {
+		detail.SourceStats = append(detail.SourceStats, apiSourceStat{
+			Source:  src.Source,
+			Count:   src.QueryCount,
+			TimeAvg: parseMetric(src.TimeAvg),
+			Time95:  parseMetric(src.Time95),
+			TimeMax: parseMetric(src.TimeMax),
+		})
+	}
+	for _, m := range info.Metrics {
+		detail.Metrics = append(detail.Metrics, apiMetric{
+			Name:  m.Name,
+			Sum:   parseMetric(m.Sum),
+			Avg:   parseMetric(m.Avg),
+			Pct95: parseMetric(m.Pct95),
+			Max:   parseMetric(m.Max),
+		})
+	}
+	for _, flag := range info.Flags {
+		detail.Flags = append(detail.Flags, apiFlag{Name: flag.Name, Count: flag.Count})
+	}
+	if len(info.Histogram) == len(histogramBuckets) {
+		for i, count := range info.Histogram {
+			detail.Histogram = append(detail.Histogram, apiBucket{Bucket: histogramBuckets[i], Count: count})
+		}
+	}
+	for _, sample := range info.Samples {
+		detail.Samples = append(detail.Samples, apiSample{
+			Query:     sample.Query,
+			QueryTime: parseMetric(sample.QueryTime),
+			Ts:        sample.Ts,
+			Host:      sample.Host,
+			User:      sample.User,
+			ThreadId:  sample.ThreadId,
+		})
+	}
+	return detail
+}
+
+// GET /api/analyses/{id}/tables，按表汇总的统计
+func (s *reportServer) handleTables(w http.ResponseWriter, r *http.Request) {
+	entry := s.analysis(w, r)
+	if entry == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tables": buildAPITables(entry.Data)})
+}
+
+func buildAPITables(data ReportData) []apiTable {
+	tables := []apiTable{}
+	if !data.HasLatency {
+		for _, stat := range data.TableStats {
+			tables = append(tables, apiTable{
+				Table: stat.Table,
+				Count: stat.Selects + stat.Inserts + stat.Updates + stat.Deletes + stat.Others,
+				Operations: &apiTableOperations{
+					Selects:      stat.Selects,
+					Inserts:      stat.Inserts,
+					Updates:      stat.Updates,
+					Deletes:      stat.Deletes,
+					Others:       stat.Others,
+					Writes:       stat.Writes,
+					RowsAffected: stat.RowsAffected,
+				},
+			})
+		}
+		return tables
+	}
+	index := make(map[string]int)
+	for _, info := range data.SlowQueries {
+		for _, name := range info.QueryTables {
+			i, ok := index[name]
+			if !ok {
+				i = len(tables)
+				index[name] = i
+				tables = append(tables, apiTable{Table: name, TimeSum: new(float64), RowsSum: new(float64)})
+			}
+			t := &tables[i]
+			t.Classes++
+			t.Count += info.QueryCount
+			if v := parseMetric(info.TimeSum); v != nil {
+				*t.TimeSum += *v
+			}
+			if v := parseMetric(info.RowsSum); v != nil {
+				*t.RowsSum += *v
+			}
+		}
+	}
+	sort.SliceStable(tables, func(i, j int) bool {
+		if *tables[i].TimeSum != *tables[j].TimeSum {
+			return *tables[i].TimeSum > *tables[j].TimeSum
+		}
+		return tables[i].Count > tables[j].Count
+	})
+	return tables
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// 未指定 -authFile 时从该环境变量读取认证信息
+const authEnvVar = "SLOWSQL_AUTH"
+
+// Web服务的认证方式
+const (
+	authNone  = "none"
+	authBasic = "basic"
+	authToken = "token"
+)
+
+// serverAuth Web服务的认证配置。basic 方式使用用户名和密码，
+// token 方式使用 Authorization: Bearer 令牌，浏览器访问时也可以在登录框中以令牌作为密码
+type serverAuth struct {
+	Mode string
+	User string
+	// 密码或令牌的 SHA-256，比较时长度固定，不泄露密码长度
+	secret [sha256.Size]byte
+}
+
+// 读取认证信息，basic 方式为 "用户名:密码"，token 方式为令牌本身。
+// 认证信息从 file 读取，file 为空时从环境变量 SLOWSQL_AUTH 读取
+func loadServerAuth(mode, file string) (*serverAuth, error) {
+	switch mode {
+	case "", authNone:
+		return nil, nil
+	case authBasic, authToken:
+	default:
+		return nil, fmt.Errorf("不支持的认证方式: %s（可选 none、basic、token）", mode)
+	}
+	var credential string
+	if file != "" {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			printColoredInfo("yellow", "认证文件 %s 可被其他用户读取，建议执行 chmod 600 %s", file, file)
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		credential = strings.TrimSpace(string(content))
+	} else {
+		credential = strings.TrimSpace(os.Getenv(authEnvVar))
+	}
+	if credential == "" {
+		return nil, fmt.Errorf("没有认证信息，请使用 -authFile 指定文件或设置环境变量 %s", authEnvVar)
+	}
+	a := &serverAuth{Mode: mode}
+	if mode == authBasic {
+		user, password, ok := strings.Cut(credential, ":")
+		if !ok || user == "" || password == "" {
+			return nil, fmt.Errorf("basic 认证信息的格式应为 用户名:密码")
+		}
+		a.User = user
+		credential = password
+	}
+	a.secret = sha256.Sum256([]byte(credential))
+	return a, nil
+}
+
+func (a *serverAuth) match(secret string) bool {
+	sum := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(sum[:], a.secret[:]) == 1
+}
+
+// 校验请求的认证信息
+func (a *serverAuth) authorized(r *http.Request) bool {
+	if a.Mode == authToken {
+		if header := r.Header.Get("Authorization"); len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+			return a.match(strings.TrimSpace(header[7:]))
+		}
+		// 浏览器无法附带 Bearer 令牌，允许在 basic 登录框中以令牌作为密码，用户名任意
+		_, password, ok := r.BasicAuth()
+		return ok && a.match(password)
+	}
+	user, password, ok := r.BasicAuth()
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.User)) == 1
+	// 用户名不匹配时同样比较密码，响应时间不因用户名是否正确而不同
+	return ok && a.match(password) && userOK
+}
+
+// 为 handler 加上认证，a 为 nil 时不认证
+func (a *serverAuth) wrap(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			setSecurityHeaders(w)
+			if a.Mode == authToken {
+				w.Header().Add("WWW-Authenticate", `Bearer realm="slowsql-analysis"`)
+			}
+			w.Header().Add("WWW-Authenticate", `Basic realm="slowsql-analysis", charset="UTF-8"`)
+			http.Error(w, "未授权", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
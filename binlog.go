@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// 事件头，例如 "#240416 10:00:01 server id 1  end_log_pos 311 CRC32 0x1b2c3d4e 	Query	thread_id=12	exec_time=0	error_code=0"
+	binlogEventRegexp    = regexp.MustCompile(`^#(\d{6}\s+\d{1,2}:\d\d:\d\d)\s+server id\s+\d+\s+end_log_pos\s+\d+(?:\s+CRC32\s+0x[0-9a-fA-F]+)?\s+(\w+)(.*)$`)
+	binlogThreadRegexp   = regexp.MustCompile(`thread_id=(\d+)`)
+	binlogTableMapRegexp = regexp.MustCompile("^:\\s+(`[^`]*`\\.`[^`]*`)\\s+mapped to number\\s+(\\d+)")
+	binlogRowsRegexp     = regexp.MustCompile(`^:\s+table id\s+(\d+)(.*)$`)
+	// mysqlbinlog -v 输出的行变更伪 SQL，例如 "### UPDATE `shop`.`orders`"
+	binlogRowLineRegexp = regexp.MustCompile("^### (INSERT INTO|UPDATE|DELETE FROM) (`[^`]*`\\.`[^`]*`)")
+	binlogUseRegexp     = regexp.MustCompile("(?i)^use\\s+`?([^`;\\s]+)`?\\s*$")
+)
+
+// 行事件类型与对应的语句前缀
+var binlogRowEvents = map[string]string{
+	"Write_rows":  "INSERT INTO",
+	"Update_rows": "UPDATE",
+	"Delete_rows": "DELETE FROM",
+}
+
+// binlog 中不作为业务语句统计的会话设置和事务控制语句
+var binlogSkipPrefixes = []string{"SET ", "SET\t", "SET@", "BEGIN", "COMMIT", "ROLLBACK", "XA ", "SAVEPOINT", "BINLOG ", "DELIMITER", "/*!"}
+
+// binlogRowChange 一个语句对一张表产生的行变更
+type binlogRowChange struct {
+	verb  string
+	table string
+	rows  int64
+}
+
+// binlogParser 解析 mysqlbinlog 输出的文本。binlog 只记录写入，没有执行耗时
+type binlogParser struct {
+	emit func(*slowEntry)
+
+	ts       time.Time
+	threadId string
+	db       string
+	// 当前事件的类型，只有 Query 事件中的语句需要统计
+	event string
+	// 以 /*!*/; 结尾之前的语句内容
+	stmt []string
+	// Table_map 事件中表编号与库表名的对应关系
+	tables map[string]string
+	// 当前语句产生的行变更，带 STMT_END_F 标志的行事件之后统一输出
+	changes  []*binlogRowChange
+	stmtEnd  bool
+	verbose  bool
+	curEvent *binlogRowChange
+}
+
+func isBinlogSkipped(stmt string) bool {
+	upper := strings.ToUpper(stmt)
+	for _, prefix := range binlogSkipPrefixes {
+		if strings.HasPrefix(upper, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// 处理一条以 /*!*/; 结尾的语句
+func (p *binlogParser) statement(stmt string) {
+	stmt = strings.TrimSpace(stmt)
+	if stmt == "" || p.event != "Query" {
+		return
+	}
+	if m := binlogUseRegexp.FindStringSubmatch(stmt); m != nil {
+		p.db = m[1]
+		return
+	}
+	if isBinlogSkipped(stmt) {
+		return
+	}
+	p.emit(&slowEntry{Ts: p.ts, Db: p.db, ThreadId: p.threadId, Query: stmt})
+}
+
+// 输出一个语句的所有行变更，每张表每种操作作为一条记录
+func (p *binlogParser) flushRows() {
+	for _, c := range p.changes {
+		db, _, _ := strings.Cut(c.table, ".")
+		e := &slowEntry{
+			Ts:       p.ts,
+			Db:       strings.Trim(db, "`"),
+			ThreadId: p.threadId,
+			Query:    c.verb + " " + c.table,
+		}
+		if p.verbose {
+			e.Attrs = map[string]string{"Rows_affected": strconv.FormatInt(c.rows, 10)}
+		}
+		p.emit(e)
+	}
+	p.changes = nil
+	p.stmtEnd = false
+	p.curEvent = nil
+}
+
+func (p *binlogParser) rowChange(verb, table string) *binlogRowChange {
+	for _, c := range p.changes {
+		if c.verb == verb && c.table == table {
+			return c
+		}
+	}
+	c := &binlogRowChange{verb: verb, table: table}
+	p.changes = append(p.changes, c)
+	return c
+}
+
+func (p *binlogParser) header(m []string) {
+	if p.stmtEnd {
+		p.flushRows()
+	}
+	p.curEvent = nil
+	if ts, ok := parseSlowLogTime(m[1]); ok {
+		p.ts = ts
+	}
+	p.event = m[2]
+	rest := m[3]
+	switch {
+	case p.event == "Query":
+		if tm := binlogThreadRegexp.FindStringSubmatch(rest); tm != nil {
+			p.threadId = tm[1]
+		}
+	case p.event == "Table_map":
+		if tm := binlogTableMapRegexp.FindStringSubmatch(rest); tm != nil {
+			p.tables[tm[2]] = tm[1]
+		}
+	default:
+		// MySQL 5.5 输出 Write_rows_v1，8.0 的 JSON 部分更新输出 Update_rows_partial
+		name := strings.TrimSuffix(strings.TrimSuffix(p.event, "_v1"), "_partial")
+		verb, ok := binlogRowEvents[name]
+		if !ok {
+			return
+		}
+		rm := binlogRowsRegexp.FindStringSubmatch(rest)
+		if rm == nil {
+			return
+		}
+		table, ok := p.tables[rm[1]]
+		if !ok {
+			return
+		}
+		p.curEvent = p.rowChange(verb, table)
+		p.stmtEnd = strings.Contains(rm[2], "STMT_END_F")
+	}
+}
+
+func (p *binlogParser) line(line string) {
+	if len(p.stmt) > 0 {
+		p.appendStatement(line)
+		return
+	}
+	switch {
+	case strings.HasPrefix(line, "###"):
+		if m := binlogRowLineRegexp.FindStringSubmatch(line); m != nil && p.curEvent != nil {
+			p.verbose = true
+			p.curEvent.rows++
+		}
+	case strings.HasPrefix(line, "#"):
+		if m := binlogEventRegexp.FindStringSubmatch(line); m != nil {
+			p.header(m)
+		}
+	case strings.TrimSpace(line) == "":
+	case strings.HasPrefix(line, "DELIMITER "):
+	case strings.HasPrefix(line, "/*!") && strings.HasSuffix(line, "*/;"):
+		// mysqlbinlog 在文件头尾输出的版本注释
+	default:
+		p.appendStatement(line)
+	}
+}
+
+func (p *binlogParser) appendStatement(line string) {
+	if stmt, ok := strings.CutSuffix(line, "/*!*/;"); ok {
+		p.statement(strings.Join(append(p.stmt, stmt), "\n"))
+		p.stmt = p.stmt[:0]
+		return
+	}
+	p.stmt = append(p.stmt, line)
+}
+
+// 解析 mysqlbinlog 输出的文本。基于语句的事件统计原始 SQL，基于行的事件按表和操作统计，
+// 使用 mysqlbinlog -v 输出时还会统计变更的行数
+func parseBinlog(r io.Reader, emit func(*slowEntry), progress func(int64)) error {
+	reader := bufio.NewReaderSize(&countingReader{r: r, progress: progress}, 1<<16)
+	p := &binlogParser{emit: emit, tables: make(map[string]string)}
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			p.line(strings.TrimRight(line, "\r\n"))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	p.flushRows()
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseBinlog(t *testing.T) {
+	f, err := os.Open("testdata/binlog.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []*slowEntry
+	if err := parseBinlog(f, func(e *slowEntry) { entries = append(entries, e) }, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(sec int) time.Time {
+		return time.Date(2024, 4, 16, 10, 0, sec, 0, time.Local)
+	}
+	// 行事件按表和操作汇总，-v 输出的伪 SQL 用于统计变更的行数；会话设置和事务控制语句不统计
+	want := []struct {
+		query    string
+		threadId string
+		rows     string
+		ts       time.Time
+	}{
+		{"INSERT INTO `shop`.`orders`", "12", "2", at(1)},
+		{"UPDATE `shop`.`orders`", "13", "1", at(2)},
+		{"DELETE FROM `shop`.`order_items`", "13", "3", at(2)},
+		{"UPDATE customers SET level = 2\nWHERE id = 5", "14", "", at(3)},
+		{"UPDATE customers SET level = 3\nWHERE id = 6", "14", "", at(4)},
+		{"ALTER TABLE customers ADD INDEX idx_level (level)", "14", "", at(5)},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("entries = %d, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Query != w.query {
+			t.Errorf("#%d Query = %q, want %q", i, e.Query, w.query)
+		}
+		// use `shop` 之后的语句和行事件所在的库都是 shop
+		if e.Db != "shop" || e.ThreadId != w.threadId {
+			t.Errorf("#%d Db/ThreadId = %q/%q, want shop/%q", i, e.Db, e.ThreadId, w.threadId)
+		}
+		if e.Attrs["Rows_affected"] != w.rows {
+			t.Errorf("#%d Rows_affected = %q, want %q", i, e.Attrs["Rows_affected"], w.rows)
+		}
+		if !e.Ts.Equal(w.ts) {
+			t.Errorf("#%d Ts = %v, want %v", i, e.Ts, w.ts)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cloudColumns 云厂商导出文件中各字段可能使用的列名，按顺序匹配，不区分大小写。
+// 控制台下载的 CSV 使用中文表头，OpenAPI 返回的 JSON 使用英文字段名
+type cloudColumns struct {
+	Ts           []string
+	User         []string
+	Host         []string
+	UserHost     []string
+	Db           []string
+	QueryTime    []string
+	QueryTimeMs  []string
+	LockTime     []string
+	RowsSent     []string
+	RowsExamined []string
+	Sql          []string
+}
+
+// cloudFormat 一种云厂商的慢查询导出格式
+type cloudFormat struct {
+	Name string
+	// 整条记录就是一段原始慢查询日志文本的列，例如 CloudWatch Logs 的 message
+	Message []string
+	Columns cloudColumns
+}
+
+var cloudFormats = map[string]cloudFormat{
+	// 阿里云 RDS MySQL：控制台下载的慢日志明细 CSV，或 DescribeSlowLogRecords 返回的 JSON
+	"aliyun": {
+		Name: "阿里云 RDS",
+		Columns: cloudColumns{
+			Ts:           []string{"ExecutionStartTime", "执行开始时间", "开始时间", "执行时间点"},
+			User:         []string{"AccountName", "账号", "用户名"},
+			UserHost:     []string{"HostAddress", "客户端地址", "客户端", "主机地址"},
+			Db:           []string{"DBName", "数据库名", "数据库"},
+			QueryTime:    []string{"QueryTimes", "执行时长(秒)", "执行耗时(秒)", "执行时长"},
+			QueryTimeMs:  []string{"QueryTimeMS", "执行时长(毫秒)", "执行耗时(毫秒)"},
+			LockTime:     []string{"LockTimes", "锁等待时长(秒)", "锁定时长(秒)", "锁等待时长"},
+			RowsSent:     []string{"ReturnRowCounts", "返回行数"},
+			RowsExamined: []string{"ParseRowCounts", "扫描行数", "解析行数"},
+			Sql:          []string{"SQLText", "SQL语句", "SQL文本", "SQL"},
+		},
+	},
+	// AWS RDS：慢查询日志发布到 CloudWatch Logs 后，通过 aws logs filter-log-events 导出的 JSON，
+	// 或 Logs Insights 导出的 CSV。每条记录的 message 就是原始慢查询日志
+	"aws": {
+		Name:    "AWS RDS",
+		Message: []string{"message", "@message"},
+	},
+	// 腾讯云 CDB：控制台下载的慢日志 CSV，或 DescribeSlowLogData 返回的 JSON
+	"tencent": {
+		Name: "腾讯云 CDB",
+		Columns: cloudColumns{
+			Ts:           []string{"Timestamp", "执行时间点", "开始时间", "时间"},
+			User:         []string{"UserName", "用户名", "账号"},
+			Host:         []string{"UserHost", "客户端地址", "客户端IP", "客户端"},
+			Db:           []string{"Database", "数据库", "数据库名"},
+			QueryTime:    []string{"QueryTime", "执行时间(秒)", "执行耗时(秒)", "耗时(秒)"},
+			LockTime:     []string{"LockTime", "锁等待时间(秒)", "锁等待时间"},
+			RowsSent:     []string{"RowsSent", "返回行数"},
+			RowsExamined: []string{"RowsExamined", "扫描行数"},
+			Sql:          []string{"SqlText", "SQL语句", "SQL"},
+		},
+	},
+}
+
+// 云厂商导出文件中的时间格式，不带时区的时间按本地时区解析
+var cloudTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05.999999",
+	"2006/01/02 15:04:05",
+	"2006-01-02T15:04:05",
+}
+
+// 阿里云 HostAddress 的格式为 "user[user] @ host [ip]"，也可能只有 "ip:port"
+var cloudUserHostRegexp = regexp.MustCompile(`^\s*(\S*?)\[[^\]]*\]\s*@\s*(\S*)\s*\[([^\]]*)\]`)
+
+func parseCloudTime(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	// 腾讯云 API 返回 Unix 时间戳，CloudWatch 使用毫秒时间戳
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if n > 1e12 {
+			return time.UnixMilli(n), true
+		}
+		return time.Unix(n, 0), true
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t.In(time.Local), true
+	}
+	for _, layout := range cloudTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func parseCloudNumber(value string) float64 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// 按候选列名查找实际使用的列名，找不到时返回空字符串
+func matchColumn(header map[string]string, candidates []string) string {
+	for _, name := range candidates {
+		if column, ok := header[strings.ToLower(name)]; ok {
+			return column
+		}
+	}
+	return ""
+}
+
+// 记录的所有列名，用于提示缺少的列
+func recordColumns(records []map[string]string) string {
+	var names []string
+	for name := range records[0] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// 读取云厂商导出的慢查询文件，将每条记录转换为 slowEntry
+func readCloudExport(path string, format cloudFormat, emit func(*slowEntry)) error {
+	records, err := readRecordFile(path)
+	if err != nil {
+		return fmt.Errorf("读取%s 导出文件 %s 失败: %w", format.Name, path, err)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	header := make(map[string]string)
+	for name := range records[0] {
+		header[strings.ToLower(name)] = name
+	}
+
+	if len(format.Message) > 0 {
+		column := matchColumn(header, format.Message)
+		if column == "" {
+			return fmt.Errorf("%s 中没有找到 %s 列（现有列: %s）", path, strings.Join(format.Message, "/"), recordColumns(records))
+		}
+		// CloudWatch 导出的记录不保证按时间排序，逐条解析避免前后记录互相继承库名和时间
+		for _, record := range records {
+			message := record[column]
+			if !strings.HasSuffix(message, "\n") {
+				message += "\n"
+			}
+			if err := parseSlowLog(strings.NewReader(message), 0, int64(len(message)), emit, nil, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	cols := format.Columns
+	sqlColumn := matchColumn(header, cols.Sql)
+	timeColumn := matchColumn(header, cols.QueryTime)
+	timeMsColumn := matchColumn(header, cols.QueryTimeMs)
+	if sqlColumn == "" || timeColumn == "" && timeMsColumn == "" {
+		return fmt.Errorf("%s 不是%s 慢查询导出文件，需要包含 SQL 语句和执行时长列（现有列: %s）", path, format.Name, recordColumns(records))
+	}
+	tsColumn := matchColumn(header, cols.Ts)
+	userColumn := matchColumn(header, cols.User)
+	hostColumn := matchColumn(header, cols.Host)
+	userHostColumn := matchColumn(header, cols.UserHost)
+	dbColumn := matchColumn(header, cols.Db)
+	lockColumn := matchColumn(header, cols.LockTime)
+	sentColumn := matchColumn(header, cols.RowsSent)
+	examinedColumn := matchColumn(header, cols.RowsExamined)
+
+	get := func(record map[string]string, column string) string {
+		if column == "" || record[column] == "NULL" {
+			return ""
+		}
+		return strings.TrimSpace(record[column])
+	}
+	for i, record := range records {
+		entry := &slowEntry{
+			User:         get(record, userColumn),
+			Host:         get(record, hostColumn),
+			Db:           get(record, dbColumn),
+			LockTime:     parseCloudNumber(get(record, lockColumn)),
+			RowsSent:     parseCloudNumber(get(record, sentColumn)),
+			RowsExamined: parseCloudNumber(get(record, examinedColumn)),
+			Query:        strings.TrimSpace(record[sqlColumn]),
+			Offset:       int64(i),
+		}
+		if entry.Query == "" {
+			continue
+		}
+		// 阿里云 QueryTimes 只精确到秒，有毫秒列时优先使用
+		if timeMsColumn != "" {
+			entry.QueryTime = parseCloudNumber(get(record, timeMsColumn)) / 1000
+		} else {
+			entry.QueryTime = parseCloudNumber(get(record, timeColumn))
+		}
+		if ts, ok := parseCloudTime(get(record, tsColumn)); ok {
+			entry.Ts = ts
+		}
+		if userHost := get(record, userHostColumn); userHost != "" {
+			if m := cloudUserHostRegexp.FindStringSubmatch(userHost); m != nil {
+				if entry.User == "" {
+					entry.User = m[1]
+				}
+				entry.Host = m[3]
+				if entry.Host == "" {
+					entry.Host = m[2]
+				}
+			} else {
+				entry.Host = userHost
+			}
+		}
+		// 去掉 ip:port 中的端口，与慢查询日志中的主机保持一致
+		if host, _, ok := strings.Cut(entry.Host, ":"); ok && strings.Count(entry.Host, ":") == 1 {
+			entry.Host = host
+		}
+		emit(entry)
+	}
+	return nil
+}
+
+// 分析云厂商导出的慢查询文件。导出文件通常不大，按顺序逐个解析
+func analyzeCloudExports(inputs []logInput, formatName string, opts analysisOptions) (*Report, error) {
+	format, ok := cloudFormats[formatName]
+	if !ok {
+		return nil, fmt.Errorf("不支持的云厂商导出格式: %s", formatName)
+	}
+	var files []ReportFile
+	merged := newAggregator(dialectMySQL)
+	merged.samples = opts.Samples
+	for _, input := range inputs {
+		info, err := os.Stat(input.Path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, ReportFile{Name: input.Path, Size: info.Size(), Source: input.Source})
+		err = readCloudExport(input.Path, format, func(e *slowEntry) {
+			e.Source = input.Source
+			if opts.inRange(e.Ts) {
+				merged.add(e)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return merged.report(files), nil
+}
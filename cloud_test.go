@@ -0,0 +1,188 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCloudExport(t *testing.T) {
+	// 不在仓库中保存的边界情况: 带端口的客户端地址和毫秒时间戳
+	dir := t.TempDir()
+	tencentPort := filepath.Join(dir, "tencent-port.csv")
+	writeTestFile(t, tencentPort, "执行时间点,SQL语句,用户名,客户端地址,数据库,执行时间(秒)\n"+
+		"2024-04-16 08:01:12,SELECT 1,app,10.0.1.15:53021,shop,0.5\n")
+	tencentMillis := filepath.Join(dir, "tencent-millis.json")
+	writeTestFile(t, tencentMillis, `{"Response": {"Items": [{"Timestamp": 1713225672123, "QueryTime": 0.5, "SqlText": "SELECT 1", "UserHost": "10.0.1.15"}]}}`)
+
+	tests := []struct {
+		name   string
+		path   string
+		format string
+		count  int
+		// 第一条记录
+		queryTime float64
+		user      string
+		host      string
+		db        string
+		ts        time.Time
+	}{
+		{
+			name:      "阿里云 CSV",
+			path:      "testdata/aliyun-rds.csv",
+			format:    "aliyun",
+			count:     4,
+			queryTime: 3.21,
+			user:      "app",
+			host:      "10.0.1.15",
+			db:        "shop",
+			ts:        time.Date(2024, 4, 16, 8, 1, 12, 0, time.Local),
+		},
+		{
+			// QueryTimes 只精确到秒，优先使用 QueryTimeMS
+			name:      "阿里云 JSON",
+			path:      "testdata/aliyun-rds.json",
+			format:    "aliyun",
+			count:     3,
+			queryTime: 3.21,
+			user:      "app",
+			host:      "10.0.1.15",
+			db:        "shop",
+			ts:        time.Date(2024, 4, 16, 0, 1, 12, 0, time.UTC),
+		},
+		{
+			name:      "CloudWatch Logs JSON",
+			path:      "testdata/aws-cloudwatch.json",
+			format:    "aws",
+			count:     3,
+			queryTime: 3.210012,
+			user:      "app",
+			host:      "10.0.1.15",
+			db:        "shop",
+			ts:        time.Date(2024, 4, 16, 0, 1, 12, 345678000, time.UTC),
+		},
+		{
+			name:      "Logs Insights CSV",
+			path:      "testdata/aws-insights.csv",
+			format:    "aws",
+			count:     2,
+			queryTime: 3.210012,
+			user:      "app",
+			host:      "10.0.1.15",
+			db:        "shop",
+			ts:        time.Date(2024, 4, 16, 0, 1, 12, 345678000, time.UTC),
+		},
+		{
+			name:      "腾讯云 CSV",
+			path:      "testdata/tencent-cdb.csv",
+			format:    "tencent",
+			count:     3,
+			queryTime: 3.21,
+			user:      "app",
+			host:      "10.0.1.15",
+			db:        "shop",
+			ts:        time.Date(2024, 4, 16, 8, 1, 12, 0, time.Local),
+		},
+		{
+			// Timestamp 为 Unix 秒
+			name:      "腾讯云 JSON",
+			path:      "testdata/tencent-cdb.json",
+			format:    "tencent",
+			count:     2,
+			queryTime: 3.21,
+			user:      "app",
+			host:      "10.0.1.15",
+			db:        "shop",
+			ts:        time.Unix(1713225672, 0),
+		},
+		{
+			name:      "客户端地址带端口",
+			path:      tencentPort,
+			format:    "tencent",
+			count:     1,
+			queryTime: 0.5,
+			user:      "app",
+			host:      "10.0.1.15",
+			db:        "shop",
+			ts:        time.Date(2024, 4, 16, 8, 1, 12, 0, time.Local),
+		},
+		{
+			// 超过 1e12 的时间戳按毫秒解析
+			name:      "毫秒时间戳",
+			path:      tencentMillis,
+			format:    "tencent",
+			count:     1,
+			queryTime: 0.5,
+			host:      "10.0.1.15",
+			ts:        time.UnixMilli(1713225672123),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var entries []*slowEntry
+			err := readCloudExport(tt.path, cloudFormats[tt.format], func(e *slowEntry) {
+				entries = append(entries, e)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tt.count {
+				t.Fatalf("entries = %d, want %d", len(entries), tt.count)
+			}
+			e := entries[0]
+			if math.Abs(e.QueryTime-tt.queryTime) > 1e-9 {
+				t.Errorf("QueryTime = %v, want %v", e.QueryTime, tt.queryTime)
+			}
+			if e.User != tt.user || e.Host != tt.host || e.Db != tt.db {
+				t.Errorf("User/Host/Db = %q/%q/%q, want %q/%q/%q", e.User, e.Host, e.Db, tt.user, tt.host, tt.db)
+			}
+			if !e.Ts.Equal(tt.ts) {
+				t.Errorf("Ts = %v, want %v", e.Ts, tt.ts)
+			}
+			if e.Query == "" {
+				t.Error("Query is empty")
+			}
+		})
+	}
+}
+
+func TestReadCloudExportMissingColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.csv")
+	writeTestFile(t, path, "id,amount\n1,100\n")
+	err := readCloudExport(path, cloudFormats["aliyun"], func(*slowEntry) {})
+	if err == nil {
+		t.Fatal("expected an error for a CSV without SQL and query time columns")
+	}
+	want := "不是阿里云 RDS 慢查询导出文件，需要包含 SQL 语句和执行时长列（现有列: amount, id）"
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("error = %q, want it to contain %q", err.Error(), want)
+	}
+}
+
+func TestParseCloudTime(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"1713225672", time.Unix(1713225672, 0)},
+		{"999999999999", time.Unix(999999999999, 0)},
+		{"1000000000001", time.UnixMilli(1000000000001)},
+		{"1713225672123", time.UnixMilli(1713225672123)},
+	}
+	for _, tt := range tests {
+		got, ok := parseCloudTime(tt.value)
+		if !ok || !got.Equal(tt.want) {
+			t.Errorf("parseCloudTime(%q) = %v, %v, want %v", tt.value, got, ok, tt.want)
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 多实例汇总：各数据库主机在本机分析日志后通过 -push 推送分析结果（每类查询的统计和示例，不包含原始日志），
+// 中心服务（-collect）按实例保存最新一次的结果，提供跨实例的汇总视图
+
+const (
+	// 实例的分析结果保存为报告目录中的 JSON 导出文件，按实例查看时与其他报告使用相同的页面和接口
+	instanceIdPrefix = "instance-"
+	// 推送的分析结果的大小上限
+	collectBodyLimit = 256 << 20
+	// 推送分析结果的超时，中心服务接收推送时同样以此替代Web服务默认的读取超时
+	pushTimeout = 2 * time.Minute
+	// 超过该时间没有收到推送的实例在汇总页面中标出
+	instanceStaleAfter = 24 * time.Hour
+	// 未指定 -pushAuthFile 时从该环境变量读取推送使用的认证信息
+	pushAuthEnvVar = "SLOWSQL_PUSH_AUTH"
+)
+
+// 实例名只能包含字母、数字、下划线和 -，同时作为文件名的一部分
+var instanceNamePattern = regexp.MustCompile(`^[0-9A-Za-z_\-]{1,64}$`)
+
+// 汇总接口的排序方式
+var fleetSortKeys = map[string]bool{"timeSum": true, "count": true, "timeMax": true, "instances": true}
+
+// 默认的实例名为主机名，不允许的字符（例如域名中的点号）替换为 -
+func defaultInstanceName() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	name = regexp.MustCompile(`[^0-9A-Za-z_\-]+`).ReplaceAllString(name, "-")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// fleetClassStat 一个实例中一类查询的统计，用于跨实例汇总
+type fleetClassStat struct {
+	Id          string
+	Fingerprint string
+	Count       int
+	TimeSum     *float64
+	TimeMax     *float64
+}
+
+// fleetInstance 一个实例最近一次推送的分析结果的汇总
+type fleetInstance struct {
+	Name string `json:"name"`
+	// 该实例的报告的访问路径
+	Url        string    `json:"url"`
+	Received   time.Time `json:"received"`
+	Generated  string    `json:"generated"`
+	Engine     string    `json:"engine"`
+	StartTime  string    `json:"startTime"`
+	EndTime    string    `json:"endTime"`
+	HasLatency bool      `json:"hasLatency"`
+	Classes    int       `json:"classes"`
+	Queries    int       `json:"queries"`
+	// 全部语句的总执行时间（秒），没有执行耗时的数据来源为 null
+	TimeSum *float64 `json:"timeSum"`
+	// 超过一天没有收到推送
+	Stale bool `json:"stale"`
+
+	classes []fleetClassStat
+}
+
+// fleetClassInstance 一类查询在某个实例中的统计
+type fleetClassInstance struct {
+	Name    string   `json:"name"`
+	Url     string   `json:"url"`
+	Count   int      `json:"count"`
+	TimeSum *float64 `json:"timeSum"`
+	TimeMax *float64 `json:"timeMax"`
+}
+
+// fleetClass 按指纹汇总所有实例后的一类查询
+type fleetClass struct {
+	Checksum      string               `json:"checksum"`
+	Fingerprint   string               `json:"fingerprint"`
+	InstanceCount int                  `json:"instanceCount"`
+	Count         int                  `json:"count"`
+	TimeSum       *float64             `json:"timeSum"`
+	TimeMax       *float64             `json:"timeMax"`
+	Instances     []fleetClassInstance `json:"instances"`
+}
+
+// fleetStore 保存各实例推送的分析结果，重启后从报告目录中的文件恢复
+type fleetStore struct {
+	mu        sync.Mutex
+	dir       string
+	instances map[string]*fleetInstance
+}
+
+func newFleetStore(dir string) (*fleetStore, error) {
+	f := &fleetStore{dir: dir, instances: make(map[string]*fleetInstance)}
+	paths, err := filepath.Glob(filepath.Join(dir, reportFilePrefix+instanceIdPrefix+"*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		id := analysisId(path)
+		name := strings.TrimPrefix(id, instanceIdPrefix)
+		if !instanceNamePattern.MatchString(name) {
+			continue
+		}
+		data, modTime, err := readInstanceFile(path)
+		if err != nil {
+			printColoredInfo("yellow", "警告: 读取实例 %s 的分析结果失败: %s", name, err.Error())
+			continue
+		}
+		f.instances[name] = summarizeInstance(name, data, modTime)
+	}
+	return f, nil
+}
+
+func readInstanceFile(path string) (ReportData, time.Time, error) {
+	var data ReportData
+	file, err := os.Open(path)
+	if err != nil {
+		return data, time.Time{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return data, time.Time{}, err
+	}
+	err = json.NewDecoder(file).Decode(&data)
+	return data, info.ModTime(), err
+}
+
+func instancePath(dir, name string) string {
+	return filepath.Join(dir, reportFilePrefix+instanceIdPrefix+name+".json")
+}
+
+func summarizeInstance(name string, data ReportData, received time.Time) *fleetInstance {
+	instance := &fleetInstance{
+		Name:       name,
+		Url:        "analyses/" + instanceIdPrefix + name,
+		Received:   received,
+		Generated:  data.GenerateTime,
+		Engine:     data.Engine,
+		StartTime:  data.StartTime,
+		EndTime:    data.EndTime,
+		HasLatency: data.HasLatency,
+		Classes:    len(data.SlowQueries),
+	}
+	for _, info := range data.SlowQueries {
+		stat := fleetClassStat{Id: info.Id, Fingerprint: info.Fingerprint, Count: info.QueryCount}
+		// 被截断的 SQL 可能无法生成指纹，不使用带字面量的原始 SQL
+		if stat.Fingerprint == "" {
+			stat.Fingerprint = info.Distillate
+		}
+		if stat.Fingerprint == "" {
+			stat.Fingerprint = info.Id
+		}
+		if data.HasLatency {
+			stat.TimeSum = parseMetric(info.TimeSum)
+			stat.TimeMax = parseMetric(info.TimeMax)
+			instance.TimeSum = addMetric(instance.TimeSum, stat.TimeSum)
+		}
+		instance.Queries += info.QueryCount
+		instance.classes = append(instance.classes, stat)
+	}
+	return instance
+}
+
+// 累加可能为空的指标，两者都为空时结果为空
+func addMetric(sum, v *float64) *float64 {
+	if v == nil {
+		return sum
+	}
+	total := *v
+	if sum != nil {
+		total += *sum
+	}
+	return &total
+}
+
+func maxMetric(cur, v *float64) *float64 {
+	if cur == nil || v != nil && *v > *cur {
+		return v
+	}
+	return cur
+}
+
+// 保存实例推送的分析结果，先写入临时文件再重命名，读取时不会看到写了一半的文件
+func (f *fleetStore) save(name string, data ReportData) (*fleetInstance, error) {
+	tmp, err := os.CreateTemp(f.dir, ".slowsql-instance-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeJSONReport(tmp, data); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	path := instancePath(f.dir, name)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	received := time.Now()
+	if info, err := os.Stat(path); err == nil {
+		received = info.ModTime()
+	}
+	instance := summarizeInstance(name, data, received)
+	f.mu.Lock()
+	f.instances[name] = instance
+	f.mu.Unlock()
+	return instance, nil
+}
+
+func (f *fleetStore) remove(name string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.instances[name]; !ok {
+		return false, nil
+	}
+	if err := os.Remove(instancePath(f.dir, name)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	delete(f.instances, name)
+	return true, nil
+}
+
+// 按实例名排列的所有实例
+func (f *fleetStore) list() []fleetInstance {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := make([]fleetInstance, 0, len(f.instances))
+	for _, instance := range f.instances {
+		item := *instance
+		item.Stale = time.Since(item.Received) > instanceStaleAfter
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// 按指纹汇总所有实例中的查询类，sortKey 为 fleetSortKeys 之一
+func (f *fleetStore) classes(sortKey string) []fleetClass {
+	merged := make(map[string]*fleetClass)
+	f.mu.Lock()
+	names := make([]string, 0, len(f.instances))
+	for name := range f.instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		instance := f.instances[name]
+		for _, stat := range instance.classes {
+			class, ok := merged[stat.Id]
+			if !ok {
+				class = &fleetClass{Checksum: stat.Id, Fingerprint: stat.Fingerprint}
+				merged[stat.Id] = class
+			}
+			class.Count += stat.Count
+			class.TimeSum = addMetric(class.TimeSum, stat.TimeSum)
+			class.TimeMax = maxMetric(class.TimeMax, stat.TimeMax)
+			class.Instances = append(class.Instances, fleetClassInstance{
+				Name:    instance.Name,
+				Url:     instance.Url,
+				Count:   stat.Count,
+				TimeSum: stat.TimeSum,
+				TimeMax: stat.TimeMax,
+			})
+		}
+	}
+	f.mu.Unlock()
+
+	classes := make([]fleetClass, 0, len(merged))
+	for _, class := range merged {
+		class.InstanceCount = len(class.Instances)
+		// 每类查询中按执行次数从多到少列出实例
+		sort.SliceStable(class.Instances, func(i, j int) bool {
+			return class.Instances[i].Count > class.Instances[j].Count
+		})
+		classes = append(classes, *class)
+	}
+	value := func(c fleetClass) *float64 {
+		var v float64
+		switch sortKey {
+		case "count":
+			v = float64(c.Count)
+		case "instances":
+			v = float64(c.InstanceCount)
+		case "timeMax":
+			return c.TimeMax
+		default:
+			return c.TimeSum
+		}
+		return &v
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		a, b := value(classes[i]), value(classes[j])
+		// 没有执行耗时的查询类排在最后
+		if (a == nil) != (b == nil) {
+			return a != nil
+		}
+		if a != nil && *a != *b {
+			return *a > *b
+		}
+		if classes[i].Count != classes[j].Count {
+			return classes[i].Count > classes[j].Count
+		}
+		return classes[i].Checksum < classes[j].Checksum
+	})
+	return classes
+}
+
+// POST /api/instances/{name}，接收实例推送的分析结果（-export json 的格式），替换该实例之前的结果
+func (f *fleetStore) handlePush(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !instanceNamePattern.MatchString(name) {
+		writeJSONError(w, http.StatusBadRequest, "实例名只能包含字母、数字、下划线和 -，最长 64 个字符")
+		return
+	}
+	http.NewResponseController(w).SetReadDeadline(time.Now().Add(pushTimeout))
+	r.Body = http.MaxBytesReader(w, r.Body, collectBodyLimit)
+	var data ReportData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("分析结果超过大小上限 %s", formatBytes(collectBodyLimit)))
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "分析结果不是有效的 JSON: "+err.Error())
+		return
+	}
+	if data.GenerateTime == "" {
+		writeJSONError(w, http.StatusBadRequest, "请求内容不是 slowsql-analysis 导出的分析结果")
+		return
+	}
+	instance, err := f.save(name, data)
+	if err != nil {
+		printColoredInfo("red", "保存实例 %s 的分析结果失败: %s", name, err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "保存分析结果失败")
+		return
+	}
+	printColoredInfo("blue", "收到实例 %s 的分析结果: %d 类查询", name, instance.Classes)
+	writeJSON(w, http.StatusOK, instance)
+}
+
+// DELETE /api/instances/{name}，删除下线实例的分析结果
+func (f *fleetStore) handleDelete(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	ok, err := f.remove(name)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "删除分析结果失败")
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "实例不存在: "+name)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/instances，所有实例最近一次推送的汇总
+func (f *fleetStore) handleInstances(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"instances": f.list()})
+}
+
+// GET /api/fleet/classes，按指纹汇总所有实例后的查询类，支持排序和分页
+func (f *fleetStore) handleClasses(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sortKey := q.Get("sort")
+	if sortKey == "" {
+		sortKey = "timeSum"
+	}
+	if !fleetSortKeys[sortKey] {
+		writeJSONError(w, http.StatusBadRequest, "参数 sort 错误: 可选 timeSum、count、timeMax、instances")
+		return
+	}
+	limit, offset := classPageSize, 0
+	var err error
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > classPageSizeMax {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("参数 limit 错误: 应为 1 到 %d", classPageSizeMax))
+			return
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			writeJSONError(w, http.StatusBadRequest, "参数 offset 错误: 应为非负整数")
+			return
+		}
+	}
+	classes := f.classes(sortKey)
+	total := len(classes)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total":   total,
+		"offset":  offset,
+		"limit":   limit,
+		"classes": classes[min(offset, total):min(offset+limit, total)],
+	})
+}
+
+// pushTarget 推送分析结果的中心服务
+type pushTarget struct {
+	Url      *url.URL
+	Instance string
+	// "用户名:密码" 使用 basic 认证，其他作为 Bearer 令牌，为空时不认证
+	Credential string
+	Client     *http.Client
+}
+
+// 检查推送参数，在分析之前发现地址、认证信息或证书的错误。
+// 认证信息从 authFile 读取，未指定时读取环境变量 SLOWSQL_PUSH_AUTH；caFile 为中心服务的 CA 证书或自签名证书
+func newPushTarget(server, instance, authFile, caFile string) (*pushTarget, error) {
+	u, err := url.Parse(server)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("中心服务的地址应为 http(s)://主机:端口: %s", server)
+	}
+	if !instanceNamePattern.MatchString(instance) {
+		return nil, fmt.Errorf("实例名只能包含字母、数字、下划线和 -，最长 64 个字符: %q", instance)
+	}
+	t := &pushTarget{
+		Url:      u.JoinPath("api/instances", instance),
+		Instance: instance,
+		Client:   &http.Client{Timeout: pushTimeout},
+	}
+	if authFile != "" {
+		content, err := os.ReadFile(authFile)
+		if err != nil {
+			return nil, err
+		}
+		t.Credential = strings.TrimSpace(string(content))
+	} else {
+		t.Credential = strings.TrimSpace(os.Getenv(pushAuthEnvVar))
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s 中没有 PEM 格式的证书", caFile)
+		}
+		t.Client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	return t, nil
+}
+
+// 将分析结果推送给中心服务
+func (t *pushTarget) push(data ReportData) error {
+	var body bytes.Buffer
+	if err := writeJSONReport(&body, data); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.Url.String(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if user, password, ok := strings.Cut(t.Credential, ":"); ok {
+		req.SetBasicAuth(user, password)
+	} else if t.Credential != "" {
+		req.Header.Set("Authorization", "Bearer "+t.Credential)
+	}
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	content, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if json.Unmarshal(content, &apiErr) != nil || apiErr.Error == "" {
+		apiErr.Error = strings.TrimSpace(string(content))
+	}
+	return fmt.Errorf("中心服务返回 %s: %s", resp.Status, apiErr.Error)
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// 自动识别时最多读取的行数和字节数
+const (
+	sniffMaxLines = 2000
+	sniffMaxBytes = 4 << 20
+)
+
+// 压缩文件的魔数，不支持的格式给出解压提示
+var compressionMagics = []struct {
+	name      string
+	magic     []byte
+	supported bool
+}{
+	{"gzip", []byte{0x1f, 0x8b}, true},
+	{"bzip2", []byte("BZh"), true},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, false},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}, false},
+}
+
+// 不支持直接分析的二进制文件
+var binaryMagics = []struct {
+	magic []byte
+	hint  string
+}{
+	{[]byte{0xfe, 'b', 'i', 'n'}, "这是二进制 binlog，请先使用 mysqlbinlog -v --base64-output=DECODE-ROWS 转换为文本后使用 -format binlog 分析"},
+	{[]byte("PK\x03\x04"), "这是 zip 压缩包，请先解压"},
+	{[]byte("\x1f\x9d"), "这是 compress (.Z) 压缩文件，请先解压"},
+}
+
+var (
+	// mysqld 启动时写入慢查询日志和通用查询日志的第一行，例如 "/usr/sbin/mysqld, Version: 8.0.36 (MySQL Community Server - GPL). started with:"
+	serverBannerRegexp = regexp.MustCompile(`, Version: (\S+?)(?:-log)? \(([^)]*)\)`)
+	binlogServerRegexp = regexp.MustCompile(`Start: binlog v \d+, server v (\S+?)(?:-log)? created`)
+	pgVersionRegexp    = regexp.MustCompile(`starting PostgreSQL (\d+(?:\.\d+)?)`)
+	// 未指定 log_line_prefix 时按消息级别识别 PostgreSQL 的 stderr 日志
+	pgLevelRegexp = regexp.MustCompile(`\b(?:LOG|ERROR|STATEMENT|WARNING|FATAL|DETAIL|HINT|PANIC|CONTEXT):  `)
+)
+
+// 识别出压缩格式时返回格式名称
+func sniffCompression(head []byte) (name string, supported bool) {
+	for _, c := range compressionMagics {
+		if bytes.HasPrefix(head, c.magic) {
+			return c.name, c.supported
+		}
+	}
+	return "", false
+}
+
+// compressedFile 解压后的文件内容，Close 时同时关闭原始文件
+type compressedFile struct {
+	io.Reader
+	file *os.File
+}
+
+func (c *compressedFile) Close() error {
+	return c.file.Close()
+}
+
+// 打开输入文件，gzip、bzip2 压缩的文件自动解压；progress 按压缩前的文件字节数统计，
+// 返回的 compression 为空表示文件未压缩
+func openInput(path string, progress func(int64)) (rc io.ReadCloser, compression string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	reader := bufio.NewReader(&countingReader{r: f, progress: progress})
+	head, _ := reader.Peek(8)
+	compression, supported := sniffCompression(head)
+	if compression != "" && !supported {
+		f.Close()
+		return nil, compression, fmt.Errorf("%s 是 %s 压缩文件，暂不支持直接分析，请先解压", path, compression)
+	}
+	switch compression {
+	case "gzip":
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			f.Close()
+			return nil, compression, fmt.Errorf("解压 %s 失败: %w", path, err)
+		}
+		return &compressedFile{Reader: gz, file: f}, compression, nil
+	case "bzip2":
+		return &compressedFile{Reader: bzip2.NewReader(reader), file: f}, compression, nil
+	}
+	return &compressedFile{Reader: reader, file: f}, "", nil
+}
+
+// 判断文件是否为压缩文件
+func fileCompression(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 8)
+	n, _ := io.ReadFull(f, head)
+	name, _ := sniffCompression(head[:n])
+	return name, nil
+}
+
+// detectedInput 自动识别出的输入文件格式
+type detectedInput struct {
+	// 与 -format 参数的取值一致，空文件为空字符串
+	Format string
+	// 数据库产品及版本，例如 MariaDB 10.6.16，无法确定时为空
+	Product string
+	Version string
+	// gzip、bzip2 等压缩格式
+	Compression string
+	// 作为识别依据的行号及内容
+	Line    int
+	Content string
+}
+
+// 各输入格式的中文名称
+var inputFormatNames = map[string]string{
+	"slowlog":  "慢查询日志",
+	"postgres": "PostgreSQL 日志",
+	"general":  "通用查询日志",
+	"binlog":   "mysqlbinlog 输出的 binlog",
+	"tcpdump":  "pcap/pcapng 抓包文件",
+	"digest":   "performance_schema 语句摘要快照",
+}
+
+func inputFormatName(format string) string {
+	if name, ok := inputFormatNames[format]; ok {
+		return name
+	}
+	if cloud, ok := cloudFormats[format]; ok {
+		return cloud.Name + " 慢查询导出文件"
+	}
+	return format
+}
+
+// 数据库产品及版本，例如 "MySQL 8.0.36"
+func (d detectedInput) engine() string {
+	return strings.TrimSpace(d.Product + " " + d.Version)
+}
+
+// 识别结果的描述，例如 "慢查询日志（MariaDB 10.6.16，gzip 压缩）"
+func (d detectedInput) describe() string {
+	if d.Format == "" {
+		return "空文件"
+	}
+	var details []string
+	if engine := d.engine(); engine != "" {
+		details = append(details, engine)
+	}
+	if d.Compression != "" {
+		details = append(details, d.Compression+" 压缩")
+	}
+	if len(details) == 0 {
+		return inputFormatName(d.Format)
+	}
+	return inputFormatName(d.Format) + "（" + strings.Join(details, "，") + "）"
+}
+
+// 截取一行内容用于错误提示
+func linePreview(line string) string {
+	line = strings.TrimSpace(line)
+	if r := []rune(line); len(r) > 80 {
+		return string(r[:80]) + "..."
+	}
+	return line
+}
+
+// 读取文件开头的内容识别输入格式。无法识别时返回的错误中包含第一行无法识别的内容及其行号
+func detectInput(path string, pgPrefix *pgLinePrefix) (detectedInput, error) {
+	rc, compression, err := openInput(path, nil)
+	if err != nil {
+		return detectedInput{Compression: compression}, err
+	}
+	defer rc.Close()
+	reader := bufio.NewReaderSize(rc, 1<<16)
+	d := detectedInput{Compression: compression}
+
+	head, _ := reader.Peek(8)
+	for _, b := range binaryMagics {
+		if bytes.HasPrefix(head, b.magic) {
+			return d, fmt.Errorf("%s: %s", path, b.hint)
+		}
+	}
+	if len(head) >= 4 {
+		switch magic := string(head[:4]); {
+		case magic == "\xd4\xc3\xb2\xa1" || magic == "\xa1\xb2\xc3\xd4" || magic == "\x4d\x3c\xb2\xa1" || magic == "\xa1\xb2\x3c\x4d" || magic == "\x0a\x0d\x0d\x0a":
+			d.Format = "tcpdump"
+			return d, nil
+		}
+	}
+
+	// 第一行无法识别的内容，文件开头被截断时允许之后的行识别出格式
+	var unknownLine string
+	unknownNo := 0
+	sawContent := false
+	var read int
+	for lineNo := 1; lineNo <= sniffMaxLines && read < sniffMaxBytes; lineNo++ {
+		line, err := reader.ReadString('\n')
+		read += len(line)
+		if lineNo == 1 {
+			line = strings.TrimPrefix(line, "\xEF\xBB\xBF")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.TrimSpace(line) != "" {
+			if !sawContent {
+				sawContent = true
+				// 表格和 JSON 格式只需要看第一行
+				if done, err := d.sniffRecords(path, line); done || err != nil {
+					if err == nil {
+						d.Line, d.Content = lineNo, line
+					}
+					return d, err
+				}
+			}
+			if d.sniffLine(line, pgPrefix) {
+				d.Line, d.Content = lineNo, line
+				d.sniffFlavor(reader, read)
+				return d, nil
+			}
+			if unknownNo == 0 && !isSlowLogBanner(line) {
+				unknownLine, unknownNo = line, lineNo
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return d, fmt.Errorf("读取 %s 失败: %w", path, err)
+		}
+	}
+	if unknownNo > 0 && (!utf8.ValidString(unknownLine) || strings.ContainsRune(unknownLine, 0)) {
+		return d, fmt.Errorf("无法识别 %s 的格式，第 %d 行包含二进制内容，不是文本日志，也不是 pcap/pcapng 抓包文件", path, unknownNo)
+	}
+	if unknownNo > 0 {
+		return d, fmt.Errorf("无法识别 %s 的格式，第 %d 行不是任何支持的日志格式: %s", path, unknownNo, linePreview(unknownLine))
+	}
+	if sawContent {
+		// 只有 mysqld 启动信息，还没有任何记录。慢查询日志和通用查询日志的开头相同，按慢查询日志处理
+		d.Format = "slowlog"
+	}
+	// 空文件或只有空行时 Format 为空，没有可分析的内容
+	return d, nil
+}
+
+// 根据一行文本日志识别格式，识别成功时设置 Format
+func (d *detectedInput) sniffLine(line string, pgPrefix *pgLinePrefix) bool {
+	switch {
+	case isSlowLogBanner(line):
+		if m := serverBannerRegexp.FindStringSubmatch(line); m != nil {
+			d.Product, d.Version = serverProduct(m[1], m[2]), strings.TrimSuffix(m[1], "-MariaDB")
+		}
+		return false
+	case strings.HasPrefix(line, "# Time: ") || strings.HasPrefix(line, "# User@Host: ") || strings.HasPrefix(line, "# Query_time: "):
+		d.Format = "slowlog"
+	case generalLineRegexp.MatchString(line):
+		d.Format = "general"
+	case binlogEventRegexp.MatchString(line) || line == "DELIMITER /*!*/;":
+		d.Format = "binlog"
+	case pgPrefix != nil && isPgLine(pgPrefix, line):
+		d.Format = "postgres"
+	case pgLevelRegexp.MatchString(line):
+		d.Format = "postgres"
+	default:
+		return false
+	}
+	if d.Product == "" {
+		d.Product = "MySQL"
+		if d.Format == "postgres" {
+			d.Product = "PostgreSQL"
+		}
+	}
+	return true
+}
+
+// 按配置的 log_line_prefix 匹配 PostgreSQL 日志行
+func isPgLine(prefix *pgLinePrefix, line string) bool {
+	_, ok := prefix.match(line)
+	return ok
+}
+
+// 根据启动信息中的版本号和版本注释判断数据库产品
+func serverProduct(version, comment string) string {
+	switch {
+	case strings.Contains(version, "MariaDB") || strings.Contains(comment, "MariaDB"):
+		return "MariaDB"
+	case strings.Contains(comment, "Percona"):
+		return "Percona Server"
+	}
+	return "MySQL"
+}
+
+// 识别格式后继续读取开头的内容，从启动信息和记录中的属性判断产品和版本
+func (d *detectedInput) sniffFlavor(reader *bufio.Reader, read int) {
+	fromBanner := d.Version != ""
+	for lines := 0; lines < sniffMaxLines && read < sniffMaxBytes; lines++ {
+		line, err := reader.ReadString('\n')
+		read += len(line)
+		switch d.Format {
+		case "slowlog":
+			if fromBanner {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "# Thread_id: ") && strings.Contains(line, "QC_hit: "):
+				d.Product = "MariaDB"
+				return
+			case strings.HasPrefix(line, "# Query_time: ") && strings.Contains(line, " Errno: "):
+				// MySQL 8.0.14 起的 log_slow_extra，同样带有 Bytes_sent，需要先于 Percona Server 判断
+				d.Version = "8.0+"
+				return
+			case strings.HasPrefix(line, "# Query_time: ") && strings.Contains(line, " Bytes_sent: "),
+				strings.HasPrefix(line, "# Log_slow_rate_type: "), strings.HasPrefix(line, "# InnoDB_trx_id: "):
+				d.Product = "Percona Server"
+				return
+			}
+		case "binlog":
+			if m := binlogServerRegexp.FindStringSubmatch(line); m != nil && !fromBanner {
+				d.Product, d.Version = serverProduct(m[1], ""), strings.TrimSuffix(m[1], "-MariaDB")
+				return
+			}
+		case "postgres":
+			if m := pgVersionRegexp.FindStringSubmatch(line); m != nil {
+				d.Version = m[1]
+				return
+			}
+		default:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 识别 JSON、CSV、TSV 格式的文件，done 为 true 表示已确定格式（或确定无法识别）
+func (d *detectedInput) sniffRecords(path, line string) (done bool, err error) {
+	trimmed := strings.TrimSpace(line)
+	switch {
+	case strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "["):
+		var fields map[string]interface{}
+		if json.Unmarshal([]byte(trimmed), &fields) == nil {
+			if _, ok := fields["error_severity"]; ok {
+				d.Format, d.Product = "postgres", "PostgreSQL"
+				return true, nil
+			}
+		}
+		records, err := readRecordFile(path)
+		if err != nil {
+			return true, fmt.Errorf("无法识别 %s 的格式，第 1 行看起来是 JSON，但解析失败: %w", path, err)
+		}
+		var columns []string
+		if len(records) > 0 {
+			for name := range records[0] {
+				columns = append(columns, name)
+			}
+		}
+		return d.sniffColumns(path, columns, line)
+	case pgCsvlogRegexp.MatchString(line):
+		d.Format, d.Product = "postgres", "PostgreSQL"
+		return true, nil
+	case strings.Contains(line, "\t") && !generalLineRegexp.MatchString(line) && !binlogEventRegexp.MatchString(line):
+		return d.sniffColumns(path, strings.Split(line, "\t"), line)
+	case strings.Contains(line, ",") && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "/"):
+		columns, err := csv.NewReader(strings.NewReader(line)).Read()
+		if err != nil {
+			return false, nil
+		}
+		return d.sniffColumns(path, columns, line)
+	}
+	return false, nil
+}
+
+// 根据表头识别摘要快照和云厂商导出文件
+func (d *detectedInput) sniffColumns(path string, columns []string, line string) (bool, error) {
+	header := make(map[string]string, len(columns))
+	for _, column := range columns {
+		column = strings.TrimSpace(strings.Trim(strings.TrimSpace(column), `"`))
+		header[strings.ToLower(column)] = column
+	}
+	if _, ok := header["digest_text"]; ok {
+		d.Format, d.Product = "digest", "MySQL"
+		return true, nil
+	}
+	best, bestScore := "", 0
+	for _, name := range sortedKeys(cloudFormats) {
+		if score := cloudFormatScore(cloudFormats[name], header); score > bestScore {
+			best, bestScore = name, score
+		}
+	}
+	if best != "" {
+		d.Format, d.Product = best, "MySQL"
+		return true, nil
+	}
+	if strings.HasPrefix(strings.TrimSpace(line), "{") || strings.HasPrefix(strings.TrimSpace(line), "[") {
+		return true, fmt.Errorf("无法识别 %s 的格式，第 1 行开始的 JSON 中没有慢查询记录所需的字段", path)
+	}
+	// 也可能是第一行恰好带有逗号或制表符的文本日志，交给逐行识别
+	return false, nil
+}
+
+// 表头与云厂商导出格式的匹配程度，0 表示不匹配
+func cloudFormatScore(format cloudFormat, header map[string]string) int {
+	if len(format.Message) > 0 {
+		if matchColumn(header, format.Message) != "" {
+			return 1
+		}
+		return 0
+	}
+	cols := format.Columns
+	if matchColumn(header, cols.Sql) == "" || matchColumn(header, cols.QueryTime) == "" && matchColumn(header, cols.QueryTimeMs) == "" {
+		return 0
+	}
+	score := 0
+	for _, candidates := range [][]string{cols.Ts, cols.User, cols.Host, cols.UserHost, cols.Db, cols.QueryTime, cols.QueryTimeMs, cols.LockTime, cols.RowsSent, cols.RowsExamined, cols.Sql} {
+		if len(candidates) > 0 && matchColumn(header, candidates) != "" {
+			score++
+		}
+	}
+	return score
+}
+
+// 识别所有输入文件的格式并与 -format 参数核对，format 为 auto 时使用识别出的格式。
+// 返回实际使用的格式以及每个文件的识别结果
+func resolveInputFormat(inputs []logInput, format string, pgPrefix *pgLinePrefix) (string, []detectedInput, error) {
+	if _, ok := cloudFormats[format]; !ok && format != "auto" && inputFormatNames[format] == "" {
+		return "", nil, fmt.Errorf("不支持的输入格式: %s（可选 auto、slowlog、postgres、tcpdump、general、binlog、digest、aliyun、aws、tencent）", format)
+	}
+	resolved := ""
+	var resolvedPath string
+	detected := make([]detectedInput, 0, len(inputs))
+	for _, input := range inputs {
+		d, err := detectInput(input.Path, pgPrefix)
+		if err != nil {
+			return "", nil, err
+		}
+		detected = append(detected, d)
+		printColoredInfo("blue", "- [%s] %s: %s", input.Source, input.Path, d.describe())
+		if d.Format == "" {
+			continue
+		}
+		if format != "auto" && d.Format != format {
+			return "", nil, fmt.Errorf("%s 第 %d 行看起来是%s，与 -format %s 不符（可使用 -format %s，或使用 -format auto 自动识别）: %s",
+				input.Path, d.Line, inputFormatName(d.Format), format, d.Format, linePreview(d.Content))
+		}
+		if resolved != "" && d.Format != resolved {
+			return "", nil, fmt.Errorf("输入文件的格式不一致: %s 是%s，%s 是%s", resolvedPath, inputFormatName(resolved), input.Path, inputFormatName(d.Format))
+		}
+		resolved, resolvedPath = d.Format, input.Path
+	}
+	if format != "auto" {
+		return format, detected, nil
+	}
+	if resolved == "" {
+		// 所有文件都是空文件
+		resolved = "slowlog"
+	}
+	return resolved, detected, nil
+}
+
+// 所有文件识别出的数据库产品和版本一致时返回该版本，例如 "MariaDB 10.6.16"
+func detectedEngine(detected []detectedInput) string {
+	engine := ""
+	for _, d := range detected {
+		if d.Format == "" {
+			continue
+		}
+		if engine != "" && d.engine() != engine {
+			return ""
+		}
+		engine = d.engine()
+	}
+	return engine
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func gzipText(t *testing.T, text string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestDetectInputFixtures(t *testing.T) {
+	tests := []struct {
+		path     string
+		format   string
+		describe string
+		line     int
+	}{
+		// mysqld 启动信息不作为识别依据，但从中取得产品和版本
+		{"testdata/slow-malformed.log", "slowlog", "慢查询日志（MySQL 8.0.36）", 4},
+		{"testdata/general.log", "general", "通用查询日志（MySQL 8.0.36）", 4},
+		{"testdata/general-mariadb.log", "general", "通用查询日志（MariaDB 10.6.16）", 4},
+		// mysqlbinlog 输出开头的注释无法识别，之后的 DELIMITER 行确定格式
+		{"testdata/binlog.txt", "binlog", "mysqlbinlog 输出的 binlog（MySQL 8.0.36）", 5},
+		{"testdata/postgresql-stderr.log", "postgres", "PostgreSQL 日志（PostgreSQL）", 1},
+		{"testdata/postgresql.csv", "postgres", "PostgreSQL 日志（PostgreSQL）", 1},
+		{"testdata/postgresql.json", "postgres", "PostgreSQL 日志（PostgreSQL）", 1},
+		{"testdata/mysql-traffic.pcap", "tcpdump", "pcap/pcapng 抓包文件", 0},
+		{"testdata/mysql-traffic.pcapng", "tcpdump", "pcap/pcapng 抓包文件", 0},
+		{"testdata/digest-0900.tsv", "digest", "performance_schema 语句摘要快照（MySQL）", 1},
+		{"testdata/aliyun-rds.csv", "aliyun", "阿里云 RDS 慢查询导出文件（MySQL）", 1},
+		{"testdata/aws-insights.csv", "aws", "AWS RDS 慢查询导出文件（MySQL）", 1},
+		{"testdata/tencent-cdb.json", "tencent", "腾讯云 CDB 慢查询导出文件（MySQL）", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			d, err := detectInput(tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Format != tt.format || d.describe() != tt.describe || d.Line != tt.line {
+				t.Errorf("Format/describe/Line = %q/%q/%d, want %q/%q/%d", d.Format, d.describe(), d.Line, tt.format, tt.describe, tt.line)
+			}
+		})
+	}
+}
+
+func TestDetectInput(t *testing.T) {
+	const slowEntry = "# Time: 2024-04-16T10:00:01.123456Z\n" +
+		"# User@Host: app[app] @  [10.0.0.5]  Id:    12\n" +
+		"# Query_time: 1.000000  Lock_time: 0.000000 Rows_sent: 1  Rows_examined: 1\n" +
+		"SELECT 1;\n"
+	tests := []struct {
+		name     string
+		content  func(t *testing.T) string
+		describe string
+		line     int
+		// 文件路径用 %s 表示
+		err string
+	}{
+		{
+			name:     "gzip 压缩",
+			content:  func(t *testing.T) string { return gzipText(t, slowEntry) },
+			describe: "慢查询日志（MySQL，gzip 压缩）",
+			line:     1,
+		},
+		{
+			name:    "xz 压缩",
+			content: func(*testing.T) string { return "\xfd7zXZ\x00\x00\x04" },
+			err:     "%s 是 xz 压缩文件，暂不支持直接分析，请先解压",
+		},
+		{
+			name:    "zstd 压缩",
+			content: func(*testing.T) string { return "\x28\xb5\x2f\xfd\x00\x58" },
+			err:     "%s 是 zstd 压缩文件，暂不支持直接分析，请先解压",
+		},
+		{
+			name:    "二进制 binlog",
+			content: func(*testing.T) string { return "\xfebin\x00\x00\x00\x00" },
+			err:     "%s: 这是二进制 binlog，请先使用 mysqlbinlog -v --base64-output=DECODE-ROWS 转换为文本后使用 -format binlog 分析",
+		},
+		{
+			name:    "zip 压缩包",
+			content: func(*testing.T) string { return "PK\x03\x04slow.log" },
+			err:     "%s: 这是 zip 压缩包，请先解压",
+		},
+		{
+			name:    "gzip 压缩的二进制 binlog",
+			content: func(t *testing.T) string { return gzipText(t, "\xfebin\x00\x00\x00\x00") },
+			err:     "%s: 这是二进制 binlog，请先使用 mysqlbinlog -v --base64-output=DECODE-ROWS 转换为文本后使用 -format binlog 分析",
+		},
+		{
+			// 文件开头被截断时，之后的行仍可识别出格式
+			name:     "开头被截断",
+			content:  func(*testing.T) string { return "FROM orders WHERE id = 1;\n" + slowEntry },
+			describe: "慢查询日志（MySQL）",
+			line:     2,
+		},
+		{
+			// 空行和 mysqld 启动信息不计为无法识别的行
+			name: "第一行无法识别的行号",
+			content: func(*testing.T) string {
+				return "\n/usr/sbin/mysqld, Version: 8.0.36 (MySQL Community Server - GPL). started with:\n\n" +
+					"  hello world  \n" + "second unknown line\n"
+			},
+			err: "无法识别 %s 的格式，第 4 行不是任何支持的日志格式: hello world",
+		},
+		{
+			name:    "过长的行截断显示",
+			content: func(*testing.T) string { return string(bytes.Repeat([]byte("慢"), 100)) + "\n" },
+			err:     "无法识别 %s 的格式，第 1 行不是任何支持的日志格式: " + string(bytes.Repeat([]byte("慢"), 80)) + "...",
+		},
+		{
+			name:    "二进制内容",
+			content: func(*testing.T) string { return "\n\n\x00\x01\x02\x03\xff\n" },
+			err:     "无法识别 %s 的格式，第 3 行包含二进制内容，不是文本日志，也不是 pcap/pcapng 抓包文件",
+		},
+		{
+			name:    "JSON 中没有所需字段",
+			content: func(*testing.T) string { return `[{"name": "a", "value": 1}]` + "\n" },
+			err:     "无法识别 %s 的格式，第 1 行开始的 JSON 中没有慢查询记录所需的字段",
+		},
+		{
+			// 只有启动信息时按慢查询日志处理
+			name: "只有启动信息",
+			content: func(*testing.T) string {
+				return "/usr/sbin/mariadbd, Version: 10.6.16-MariaDB-log (MariaDB Server). started with:\n"
+			},
+			describe: "慢查询日志（MariaDB 10.6.16）",
+		},
+		{
+			name:     "只有空行",
+			content:  func(*testing.T) string { return "\n\r\n  \n" },
+			describe: "空文件",
+		},
+		{
+			name:     "带 BOM 的 CSV",
+			content:  func(*testing.T) string { return "\xEF\xBB\xBFDIGEST_TEXT,COUNT_STAR,SUM_TIMER_WAIT\n" },
+			describe: "performance_schema 语句摘要快照（MySQL）",
+			line:     1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "input.log")
+			writeTestFile(t, path, tt.content(t))
+			d, err := detectInput(path, nil)
+			if tt.err != "" {
+				want := fmt.Sprintf(tt.err, path)
+				if err == nil || err.Error() != want {
+					t.Fatalf("error = %v, want %q", err, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.describe() != tt.describe || d.Line != tt.line {
+				t.Errorf("describe/Line = %q/%d, want %q/%d", d.describe(), d.Line, tt.describe, tt.line)
+			}
+		})
+	}
+}
+
+func TestDetectInputPgLinePrefix(t *testing.T) {
+	// 按 log_line_prefix 识别格式后，从之后的启动信息中取得版本
+	path := filepath.Join(t.TempDir(), "postgresql.log")
+	writeTestFile(t, path, "2024-04-16 08:01:11 UTC [1]: user=,db= LOG:  redirecting log output to logging collector process\n"+
+		"2024-04-16 08:01:12 UTC [1]: user=,db= LOG:  starting PostgreSQL 16.2 on x86_64-pc-linux-gnu\n")
+	prefix, err := compilePgLinePrefix("%t [%p]: user=%u,db=%d ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := detectInput(path, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.describe() != "PostgreSQL 日志（PostgreSQL 16.2）" || d.Line != 1 {
+		t.Errorf("describe/Line = %q/%d", d.describe(), d.Line)
+	}
+}
+
+func TestResolveInputFormat(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.log")
+	writeTestFile(t, empty, "")
+	tests := []struct {
+		name   string
+		paths  []string
+		format string
+		want   string
+		err    string
+	}{
+		{
+			name:   "自动识别",
+			paths:  []string{"testdata/general.log", empty, "testdata/general-mariadb.log"},
+			format: "auto",
+			want:   "general",
+		},
+		{
+			name:   "只有空文件",
+			paths:  []string{empty},
+			format: "auto",
+			want:   "slowlog",
+		},
+		{
+			name:   "指定的格式与识别结果一致",
+			paths:  []string{"testdata/aliyun-rds.csv", empty},
+			format: "aliyun",
+			want:   "aliyun",
+		},
+		{
+			name:   "不支持的格式",
+			paths:  []string{"testdata/general.log"},
+			format: "mysql",
+			err:    "不支持的输入格式: mysql（可选 auto、slowlog、postgres、tcpdump、general、binlog、digest、aliyun、aws、tencent）",
+		},
+		{
+			name:   "与 -format 不符",
+			paths:  []string{"testdata/slow-malformed.log", "testdata/general.log"},
+			format: "slowlog",
+			err: "testdata/general.log 第 4 行看起来是通用查询日志，与 -format slowlog 不符（可使用 -format general，或使用 -format auto 自动识别）: " +
+				"2024-04-16T02:00:00.101234Z\t   12 Connect\tapp@10.0.0.5 on shop using TCP/IP",
+		},
+		{
+			name:   "格式不一致",
+			paths:  []string{"testdata/postgresql-stderr.log", empty, "testdata/binlog.txt"},
+			format: "auto",
+			err:    "输入文件的格式不一致: testdata/postgresql-stderr.log 是PostgreSQL 日志，testdata/binlog.txt 是mysqlbinlog 输出的 binlog",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inputs []logInput
+			for _, path := range tt.paths {
+				inputs = append(inputs, logInput{Source: "db1", Path: path})
+			}
+			got, detected, err := resolveInputFormat(inputs, tt.format, nil)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || len(detected) != len(inputs) {
+				t.Errorf("format/detected = %q/%d, want %q/%d", got, len(detected), tt.want, len(inputs))
+			}
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// performance_schema 中的计时单位为皮秒
+const picosecondsPerSecond = 1e12
+
+// digestRow events_statements_summary_by_digest 表中的一行
+type digestRow struct {
+	Schema     string
+	Digest     string
+	Text       string
+	Sample     string
+	SampleSeen string
+	SampleTime float64
+	FirstSeen  string
+	LastSeen   string
+
+	Count        float64
+	SumTime      float64
+	MinTime      float64
+	MaxTime      float64
+	Quantile95   float64
+	SumLockTime  float64
+	Errors       float64
+	RowsSent     float64
+	RowsExamined float64
+	// 其余 SUM_ 开头的计数列，例如 SUM_CREATED_TMP_DISK_TABLES
+	Sums map[string]float64
+}
+
+func (r *digestRow) key() string {
+	return r.Schema + "\x00" + r.Digest
+}
+
+// SUM_ 计数列与报告中扩展指标名称的对应关系
+var digestSumColumns = map[string]string{
+	"SUM_ROWS_AFFECTED":           "Rows_affected",
+	"SUM_WARNINGS":                "Warnings",
+	"SUM_CREATED_TMP_TABLES":      "Created_tmp_tables",
+	"SUM_CREATED_TMP_DISK_TABLES": "Created_tmp_disk_tables",
+	"SUM_SELECT_FULL_JOIN":        "Select_full_join",
+	"SUM_SELECT_SCAN":             "Select_scan",
+	"SUM_SORT_ROWS":               "Sort_rows",
+	"SUM_SORT_MERGE_PASSES":       "Sort_merge_passes",
+	"SUM_NO_INDEX_USED":           "No_index_used",
+	"SUM_NO_GOOD_INDEX_USED":      "No_good_index_used",
+}
+
+func parseDigestNumber(value string) float64 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// 将列名到取值的映射转换为 digestRow，列名均为大写
+func newDigestRow(fields map[string]string) (*digestRow, error) {
+	get := func(name string) string {
+		value := fields[name]
+		if value == "NULL" {
+			return ""
+		}
+		return value
+	}
+	if _, ok := fields["DIGEST_TEXT"]; !ok {
+		return nil, fmt.Errorf("缺少 DIGEST_TEXT 列，请确认导出的是 events_statements_summary_by_digest 表")
+	}
+	if _, ok := fields["COUNT_STAR"]; !ok {
+		return nil, fmt.Errorf("缺少 COUNT_STAR 列，请确认导出的是 events_statements_summary_by_digest 表")
+	}
+	row := &digestRow{
+		Schema:       get("SCHEMA_NAME"),
+		Digest:       strings.ToUpper(get("DIGEST")),
+		Text:         get("DIGEST_TEXT"),
+		Sample:       get("QUERY_SAMPLE_TEXT"),
+		SampleSeen:   get("QUERY_SAMPLE_SEEN"),
+		SampleTime:   parseDigestNumber(get("QUERY_SAMPLE_TIMER_WAIT")) / picosecondsPerSecond,
+		FirstSeen:    get("FIRST_SEEN"),
+		LastSeen:     get("LAST_SEEN"),
+		Count:        parseDigestNumber(get("COUNT_STAR")),
+		SumTime:      parseDigestNumber(get("SUM_TIMER_WAIT")) / picosecondsPerSecond,
+		MinTime:      parseDigestNumber(get("MIN_TIMER_WAIT")) / picosecondsPerSecond,
+		MaxTime:      parseDigestNumber(get("MAX_TIMER_WAIT")) / picosecondsPerSecond,
+		Quantile95:   parseDigestNumber(get("QUANTILE_95")) / picosecondsPerSecond,
+		SumLockTime:  parseDigestNumber(get("SUM_LOCK_TIME")) / picosecondsPerSecond,
+		Errors:       parseDigestNumber(get("SUM_ERRORS")),
+		RowsSent:     parseDigestNumber(get("SUM_ROWS_SENT")),
+		RowsExamined: parseDigestNumber(get("SUM_ROWS_EXAMINED")),
+		Sums:         make(map[string]float64),
+	}
+	if row.Text == "" {
+		// DIGEST_TEXT 为 NULL 的行是 performance_schema_digests_size 已满时的汇总行
+		row.Text = "(其他未统计摘要的语句)"
+	}
+	for column, name := range digestSumColumns {
+		if value, ok := fields[column]; ok {
+			row.Sums[name] = parseDigestNumber(value)
+		}
+	}
+	return row, nil
+}
+
+// 读取摘要快照文件，支持 mysql -B 输出的 TSV、CSV 以及 JSON
+func readDigestSnapshot(path string) ([]*digestRow, error) {
+	records, err := readRecordFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取摘要快照 %s 失败: %w", path, err)
+	}
+	rows := make([]*digestRow, 0, len(records))
+	for i, record := range records {
+		// 列名不区分大小写
+		fields := make(map[string]string, len(record))
+		for name, value := range record {
+			fields[strings.ToUpper(name)] = value
+		}
+		row, err := newDigestRow(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s 第 %d 行: %w", path, i+1, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// 计算两次快照之间的增量。计数器变小说明期间执行过 TRUNCATE 或摘要被淘汰，此时以当前值为准。
+// MIN/MAX/QUANTILE 无法做差，使用当前快照的值
+func diffDigestRow(cur, base *digestRow) *digestRow {
+	if base == nil || cur.Count < base.Count || cur.SumTime < base.SumTime {
+		return cur
+	}
+	diff := *cur
+	diff.Count = cur.Count - base.Count
+	diff.SumTime = cur.SumTime - base.SumTime
+	diff.SumLockTime = math.Max(cur.SumLockTime-base.SumLockTime, 0)
+	diff.Errors = math.Max(cur.Errors-base.Errors, 0)
+	diff.RowsSent = math.Max(cur.RowsSent-base.RowsSent, 0)
+	diff.RowsExamined = math.Max(cur.RowsExamined-base.RowsExamined, 0)
+	diff.Sums = make(map[string]float64, len(cur.Sums))
+	for name, value := range cur.Sums {
+		diff.Sums[name] = math.Max(value-base.Sums[name], 0)
+	}
+	if base.LastSeen != "" {
+		diff.FirstSeen = base.LastSeen
+	}
+	return &diff
+}
+
+// 将 FIRST_SEEN 等时间统一为 yyyy-mm-dd HH:MM:SS
+func trimDigestTime(value string) string {
+	value = strings.Replace(value, "T", " ", 1)
+	if len(value) > 19 {
+		value = value[:19]
+	}
+	return value
+}
+
+// digestClass 按 (库名, DIGEST) 合并多个来源后的统计
+type digestClass struct {
+	rows    []*digestRow
+	sources []string
+}
+
+// 分析 performance_schema 摘要快照，baselines 中与 inputs 来源标签相同的快照作为起始快照做差
+func analyzeDigestSnapshots(inputs, baselines []logInput, opts analysisOptions) (*Report, error) {
+	baselineRows := make(map[string]map[string]*digestRow)
+	for _, baseline := range baselines {
+		source := baseline.Source
+		if len(inputs) == 1 && len(baselines) == 1 {
+			// 只有一组快照时不要求来源标签一致
+			source = inputs[0].Source
+		}
+		rows, err := readDigestSnapshot(baseline.Path)
+		if err != nil {
+			return nil, err
+		}
+		if baselineRows[source] == nil {
+			baselineRows[source] = make(map[string]*digestRow)
+		}
+		for _, row := range rows {
+			baselineRows[source][row.key()] = row
+		}
+	}
+
+	var files []ReportFile
+	classes := make(map[string]*digestClass)
+	var order []string
+	for _, input := range inputs {
+		info, err := os.Stat(input.Path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, ReportFile{Name: input.Path, Size: info.Size(), Source: input.Source})
+		rows, err := readDigestSnapshot(input.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			row = diffDigestRow(row, baselineRows[input.Source][row.key()])
+			if row.Count <= 0 {
+				continue
+			}
+			if !digestInRange(row, opts) {
+				continue
+			}
+			class, ok := classes[row.key()]
+			if !ok {
+				class = &digestClass{}
+				classes[row.key()] = class
+				order = append(order, row.key())
+			}
+			class.rows = append(class.rows, row)
+			class.sources = append(class.sources, input.Source)
+		}
+	}
+
+	report := &Report{}
+	report.Global.Files = files
+	report.Global.Engine = dialectMySQL.engine()
+	var global metricAcc
+	var globalRowsExamined, globalRowsSent, globalLockTime float64
+	for _, key := range order {
+		rc := classes[key].reportClass()
+		report.Classes = append(report.Classes, rc)
+		for _, row := range classes[key].rows {
+			global.Count += int64(row.Count)
+			global.Sum += row.SumTime
+			globalRowsExamined += row.RowsExamined
+			globalRowsSent += row.RowsSent
+			globalLockTime += row.SumLockTime
+		}
+		if report.Global.TsMin == "" || rc.TsMin != "" && rc.TsMin < report.Global.TsMin {
+			report.Global.TsMin = rc.TsMin
+		}
+		if rc.TsMax > report.Global.TsMax {
+			report.Global.TsMax = rc.TsMax
+		}
+	}
+	report.Global.QueryCount = int(global.Count)
+	report.Global.UniqueQueryCount = len(report.Classes)
+	report.Global.Metrics.QueryTime.Sum = formatSeconds(global.Sum)
+	report.Global.Metrics.LockTime.Sum = formatSeconds(globalLockTime)
+	report.Global.Metrics.RowsExamined.Sum = formatCount(globalRowsExamined)
+	report.Global.Metrics.RowsSent.Sum = formatCount(globalRowsSent)
+
+	// 与慢查询日志一致，按总执行时间降序排列
+	sort.SliceStable(report.Classes, func(i, j int) bool {
+		si, _ := strconv.ParseFloat(report.Classes[i].Metrics.QueryTime.Sum, 64)
+		sj, _ := strconv.ParseFloat(report.Classes[j].Metrics.QueryTime.Sum, 64)
+		return si > sj
+	})
+	return report, nil
+}
+
+// 摘要是累计值，只能按 FIRST_SEEN/LAST_SEEN 判断是否与分析时间范围有交集
+func digestInRange(row *digestRow, opts analysisOptions) bool {
+	if !opts.Until.IsZero() && row.FirstSeen != "" {
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05", trimDigestTime(row.FirstSeen), time.Local); err == nil && t.After(opts.Until) {
+			return false
+		}
+	}
+	if !opts.Since.IsZero() && row.LastSeen != "" {
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05", trimDigestTime(row.LastSeen), time.Local); err == nil && t.Before(opts.Since) {
+			return false
+		}
+	}
+	return true
+}
+
+// 只有总和可用的指标，平均值由总和除以次数得到
+func sumOnlyStats(sum, count float64, format func(float64) string) MetricStats {
+	stats := MetricStats{Sum: format(sum)}
+	if count > 0 {
+		stats.Avg = format(sum / count)
+	}
+	return stats
+}
+
+func (c *digestClass) reportClass() ReportClass {
+	first := c.rows[0]
+	var count, sumTime, sumLock, rowsSent, rowsExamined, errors, q95 float64
+	minTime, maxTime := first.MinTime, first.MaxTime
+	sums := make(map[string]float64)
+	example := first
+	var firstSeen, lastSeen string
+	for _, row := range c.rows {
+		count += row.Count
+		sumTime += row.SumTime
+		sumLock += row.SumLockTime
+		rowsSent += row.RowsSent
+		rowsExamined += row.RowsExamined
+		errors += row.Errors
+		minTime = math.Min(minTime, row.MinTime)
+		maxTime = math.Max(maxTime, row.MaxTime)
+		q95 = math.Max(q95, row.Quantile95)
+		for name, value := range row.Sums {
+			sums[name] += value
+		}
+		if row.SampleTime > example.SampleTime {
+			example = row
+		}
+		if fs := trimDigestTime(row.FirstSeen); fs != "" && (firstSeen == "" || fs < firstSeen) {
+			firstSeen = fs
+		}
+		if ls := trimDigestTime(row.LastSeen); ls > lastSeen {
+			lastSeen = ls
+		}
+	}
+	avgTime := 0.0
+	if count > 0 {
+		avgTime = sumTime / count
+	}
+	if q95 == 0 {
+		// MySQL 5.7 没有 QUANTILE_95 列，使用平均值近似
+		q95 = avgTime
+	}
+
+	checksum := first.Digest
+	if checksum == "" {
+		checksum = fingerprintChecksum(first.Schema + first.Text)
+	}
+	query := example.Sample
+	if query == "" {
+		query = example.Text
+	}
+	exampleTime := example.SampleTime
+	if exampleTime == 0 {
+		exampleTime = example.MaxTime
+	}
+	exampleTs := trimDigestTime(example.SampleSeen)
+	if exampleTs == "" {
+		exampleTs = trimDigestTime(example.LastSeen)
+	}
+
+	rc := ReportClass{
+		Attribute:   "digest",
+		Checksum:    checksum,
+		Fingerprint: first.Text,
+		Distillate:  distill(first.Text),
+		QueryCount:  int(count),
+		TsMin:       firstSeen,
+		TsMax:       lastSeen,
+		Example: ClassExample{
+			QueryTime: formatSeconds(exampleTime),
+			Query:     query,
+			Ts:        exampleTs,
+		},
+		Metrics: ClassMetrics{
+			QueryTime: MetricStats{
+				Sum:    formatSeconds(sumTime),
+				Min:    formatSeconds(minTime),
+				Max:    formatSeconds(maxTime),
+				Avg:    formatSeconds(avgTime),
+				Median: formatSeconds(avgTime),
+				Pct95:  formatSeconds(q95),
+			},
+			LockTime:     sumOnlyStats(sumLock, count, formatSeconds),
+			RowsSent:     sumOnlyStats(rowsSent, count, formatCount),
+			RowsExamined: sumOnlyStats(rowsExamined, count, formatCount),
+			Db:           ValueMetric{Value: first.Schema},
+			Extra:        make(map[string]MetricStats),
+		},
+	}
+	for name, sum := range sums {
+		rc.Metrics.Extra[name] = sumOnlyStats(sum, count, formatCount)
+	}
+	if errors > 0 {
+		rc.Failures = &ClassFailures{Errored: int(errors)}
+	}
+	for i, row := range c.rows {
+		stats := MetricStats{
+			Sum:   formatSeconds(row.SumTime),
+			Max:   formatSeconds(row.MaxTime),
+			Pct95: formatSeconds(row.Quantile95),
+		}
+		if row.Count > 0 {
+			stats.Avg = formatSeconds(row.SumTime / row.Count)
+		}
+		rc.Sources = append(rc.Sources, ClassSource{Source: c.sources[i], QueryCount: int(row.Count), QueryTime: stats})
+	}
+	seen := make(map[string]bool)
+	for _, t := range extractTables(first.Text, first.Schema) {
+		key := t[0] + "." + t[1]
+		if !seen[key] {
+			seen[key] = true
+			rc.Tables = append(rc.Tables, classTableFor(t[0], t[1]))
+		}
+	}
+	return rc
+}
@@ -0,0 +1,133 @@
+package main
+
+import "testing"
+
+func TestDiffDigestRow(t *testing.T) {
+	base := &digestRow{Count: 100, SumTime: 5, Errors: 1, RowsExamined: 1000, LastSeen: "2024-04-16 09:00:00", Sums: map[string]float64{"Select_scan": 2}}
+	tests := []struct {
+		name       string
+		cur, base  *digestRow
+		count, sum float64
+		errors     float64
+		firstSeen  string
+	}{
+		{
+			name:      "增量",
+			cur:       &digestRow{Count: 300, SumTime: 20, Errors: 3, RowsExamined: 5000, FirstSeen: "2024-04-16 08:00:00", Sums: map[string]float64{"Select_scan": 5}},
+			base:      base,
+			count:     200,
+			sum:       15,
+			errors:    2,
+			firstSeen: "2024-04-16 09:00:00",
+		},
+		{
+			name:      "没有起始快照",
+			cur:       &digestRow{Count: 300, SumTime: 20, Errors: 3, FirstSeen: "2024-04-16 08:00:00"},
+			count:     300,
+			sum:       20,
+			errors:    3,
+			firstSeen: "2024-04-16 08:00:00",
+		},
+		{
+			name:      "计数器被重置",
+			cur:       &digestRow{Count: 40, SumTime: 2, Errors: 0, FirstSeen: "2024-04-16 09:30:00"},
+			base:      base,
+			count:     40,
+			sum:       2,
+			errors:    0,
+			firstSeen: "2024-04-16 09:30:00",
+		},
+		{
+			name:      "执行时间被重置",
+			cur:       &digestRow{Count: 150, SumTime: 1, Errors: 2, FirstSeen: "2024-04-16 09:30:00"},
+			base:      base,
+			count:     150,
+			sum:       1,
+			errors:    2,
+			firstSeen: "2024-04-16 09:30:00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffDigestRow(tt.cur, tt.base)
+			if got.Count != tt.count || got.SumTime != tt.sum || got.Errors != tt.errors {
+				t.Errorf("Count/SumTime/Errors = %v/%v/%v, want %v/%v/%v", got.Count, got.SumTime, got.Errors, tt.count, tt.sum, tt.errors)
+			}
+			if got.FirstSeen != tt.firstSeen {
+				t.Errorf("FirstSeen = %q, want %q", got.FirstSeen, tt.firstSeen)
+			}
+		})
+	}
+	if got := diffDigestRow(tests[0].cur, base); got.Sums["Select_scan"] != 3 || got.RowsExamined != 4000 {
+		t.Errorf("Select_scan/RowsExamined = %v/%v, want 3/4000", got.Sums["Select_scan"], got.RowsExamined)
+	}
+}
+
+func TestAnalyzeDigestSnapshots(t *testing.T) {
+	type class struct {
+		count   int
+		timeSum string
+		errors  int
+	}
+	tests := []struct {
+		name     string
+		baseline string
+		current  string
+		classes  map[string]class
+	}{
+		{
+			name:     "两次快照做差",
+			baseline: "testdata/digest-0900.tsv",
+			current:  "testdata/digest-1000.tsv",
+			classes: map[string]class{
+				"SELECT * FROM `orders` WHERE `id` = ?": {count: 200, timeSum: "15.000000", errors: 2},
+				// DIGEST 为 NULL 的汇总行在起始快照中不存在，使用当前值
+				"(其他未统计摘要的语句)": {count: 5, timeSum: "0.001000"},
+			},
+		},
+		{
+			// 当前快照的计数小于起始快照，说明期间执行过 TRUNCATE，以当前值为准
+			name:     "计数器被重置",
+			baseline: "testdata/digest-1000.tsv",
+			current:  "testdata/digest-0900.tsv",
+			classes: map[string]class{
+				"SELECT * FROM `orders` WHERE `id` = ?": {count: 100, timeSum: "5.000000", errors: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := analyzeDigestSnapshots(
+				[]logInput{{Source: "db1", Path: tt.current}},
+				[]logInput{{Source: "db1", Path: tt.baseline}},
+				analysisOptions{},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Classes) != len(tt.classes) {
+				t.Fatalf("classes = %d, want %d", len(report.Classes), len(tt.classes))
+			}
+			for _, rc := range report.Classes {
+				want, ok := tt.classes[rc.Fingerprint]
+				if !ok {
+					t.Errorf("unexpected class %q", rc.Fingerprint)
+					continue
+				}
+				if rc.QueryCount != want.count {
+					t.Errorf("%s: QueryCount = %d, want %d", rc.Fingerprint, rc.QueryCount, want.count)
+				}
+				if rc.Metrics.QueryTime.Sum != want.timeSum {
+					t.Errorf("%s: TimeSum = %s, want %s", rc.Fingerprint, rc.Metrics.QueryTime.Sum, want.timeSum)
+				}
+				errors := 0
+				if rc.Failures != nil {
+					errors = rc.Failures.Errored
+				}
+				if errors != want.errors {
+					t.Errorf("%s: ErrorCount = %d, want %d", rc.Fingerprint, errors, want.errors)
+				}
+			}
+		})
+	}
+}
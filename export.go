@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 按 -export 参数导出其他格式的报告，返回生成的文件列表
+func exportReport(data ReportData, baseName, formats string) ([]string, error) {
+	var files []string
+	for _, format := range strings.Split(formats, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "" {
+			continue
+		}
+		fileName := baseName + "." + format
+		var err error
+		switch format {
+		case "json":
+			err = exportJSON(data, fileName)
+		case "csv":
+			err = exportCSV(data, fileName)
+		default:
+			return files, fmt.Errorf("不支持的导出格式: %s（可选 json、csv）", format)
+		}
+		if err != nil {
+			return files, err
+		}
+		files = append(files, fileName)
+	}
+	return files, nil
+}
+
+func exportJSON(data ReportData, fileName string) error {
+	return exportFile(fileName, data, writeJSONReport)
+}
+
+func exportCSV(data ReportData, fileName string) error {
+	return exportFile(fileName, data, writeCSVReport)
+}
+
+func exportFile(fileName string, data ReportData, write func(io.Writer, ReportData) error) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if err := write(file, data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func writeJSONReport(w io.Writer, data ReportData) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
+
+// 将单个来源的统计格式化为 "标签:次数"，多个来源用分号分隔
+func formatSourceCounts(sources []SourceStat) string {
+	parts := make([]string, 0, len(sources))
+	for _, src := range sources {
+		parts = append(parts, src.Source+":"+strconv.Itoa(src.QueryCount))
+	}
+	return strings.Join(parts, ";")
+}
+
+func writeCSVReport(w io.Writer, data ReportData) error {
+	// 写入 UTF-8 BOM，避免 Excel 打开时中文乱码
+	io.WriteString(w, "\xEF\xBB\xBF")
+	writer := csv.NewWriter(w)
+	writer.Write([]string{
+		"ID", "数据库", "用户账号", "主机", "来源", "查询次数", "中位执行时间", "最大执行时间",
+		"95%执行时间", "总扫描行数", "最大扫描行数", "最大锁等待", "被终止次数", "出错次数", "涉及表", "SQL",
+	})
+	for _, q := range data.SlowQueries {
+		writer.Write([]string{
+			q.Id, q.QueryDb, q.User, q.Host, formatSourceCounts(q.Sources), strconv.Itoa(q.QueryCount),
+			q.TimeMedian, q.TimeMax, q.Time95, q.RowsSum, q.RowsMax, q.LockTimeMax,
+			strconv.Itoa(q.KilledCount), strconv.Itoa(q.ErrorCount), strings.Join(q.QueryTables, ","), q.Sql,
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
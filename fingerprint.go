@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// SQL 指纹化规则，移植自 pt-query-digest 的 QueryRewriter::fingerprint。
+// 注释、字面量和空白字符的处理在 normalizeQuery 中一次扫描完成，其余结构性规则使用正则
+var (
+	mysqldumpRegexp      = regexp.MustCompile("(?i)^SELECT /\\*!40001 SQL_NO_CACHE \\*/ \\* FROM `")
+	useDbRegexp          = regexp.MustCompile(`(?i)^use \S+$`)
+	blockCommentRegexp   = regexp.MustCompile(`(?s)/\*[^!].*?\*/`)
+	doubleQuotedRegexp   = regexp.MustCompile(`(?s)".*?"`)
+	singleQuotedRegexp   = regexp.MustCompile(`(?s)'.*?'`)
+	valueListRegexp      = regexp.MustCompile(`\b(in|values?)(?:[\s,]*\([\s?,]*\))+`)
+	limitRegexp          = regexp.MustCompile(`\blimit \?(?:, ?\?| offset \?)?`)
+	orderByAscRegexp     = regexp.MustCompile(`\b(order by .+?)\s+asc\b`)
+	callRegexp           = regexp.MustCompile(`(?i)^\s*call\s+(\S+)\(`)
+	insertValuesRegexp   = regexp.MustCompile(`(?is)^((?:insert|replace)(?:\s+ignore)?\s+.+?\s+values?)\s*\(.*$`)
+	distillVerbRegexp    = regexp.MustCompile(`(?i)\b(select|insert|update|delete|replace|call|alter|create|drop|truncate|show|set|commit|rollback|begin|load|grant|revoke|rename|lock|unlock|optimize|analyze|handler|do|prepare|execute|deallocate|explain)\b`)
+	distillTableRegexp   = regexp.MustCompile("(?i)\\b(?:from|join|into|update|table|straight_join)\\s+((?:`[^`]+`|[\\w$]+)(?:\\s*\\.\\s*(?:`[^`]+`|[\\w$]+))?(?:\\s*,\\s*(?:`[^`]+`|[\\w$]+)(?:\\s*\\.\\s*(?:`[^`]+`|[\\w$]+))?(?:\\s+(?:as\\s+)?\\w+)?)*)")
+	tableAliasListRegexp = regexp.MustCompile("(?i)\\s+(?:as\\s+)?\\w+$")
+	onDuplicateKeyRegexp = regexp.MustCompile(`(?i)\bon\s+duplicate\s+key\s+update\b`)
+	pgQuotedIdentRegexp  = regexp.MustCompile(`"([^"]+)"`)
+)
+
+// sqlDialect 查询所属的 SQL 方言，影响引号、注释、参数占位符等的处理
+type sqlDialect int
+
+const (
+	dialectMySQL sqlDialect = iota
+	dialectPostgres
+)
+
+// 报告中展示的数据库引擎名称
+func (d sqlDialect) engine() string {
+	if d == dialectPostgres {
+		return "PostgreSQL"
+	}
+	return "MySQL"
+}
+
+// PostgreSQL 中可以跟在类型名后面的单词，例如 ::timestamp with time zone、::character varying
+var pgTypeSuffixWords = map[string]bool{
+	"varying": true, "precision": true, "with": true, "without": true, "time": true, "zone": true,
+}
+
+// 不应被视为表名的关键字（例如 DELETE FROM t 中 FROM 之后可能紧跟子查询）
+var distillSkipWords = map[string]bool{
+	"select": true, "dual": true, "where": true, "set": true, "values": true, "value": true,
+	"ignore": true, "lateral": true, "as": true, "on": true, "using": true, "if": true,
+	"exists": true, "not": true, "status": true, "low_priority": true, "quick": true,
+	"outfile": true, "dumpfile": true,
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isSpaceByte(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\t' || c == '\r' || c == '\f'
+}
+
+func isHexString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// 跳过 PostgreSQL 的类型转换 ::type，返回类型名之后的位置
+func skipPgCast(q string, i int) int {
+	j := i + 2
+	for j < len(q) && isSpaceByte(q[j]) {
+		j++
+	}
+	if j < len(q) && q[j] == '"' {
+		if end := strings.IndexByte(q[j+1:], '"'); end >= 0 {
+			j += end + 2
+		}
+	}
+	for j < len(q) && (isWordByte(q[j]) || q[j] == '.') {
+		j++
+	}
+	for {
+		k := j
+		for k < len(q) && isSpaceByte(q[k]) {
+			k++
+		}
+		switch {
+		case k < len(q) && (q[k] == '(' || q[k] == '['):
+			closing := byte(')')
+			if q[k] == '[' {
+				closing = ']'
+			}
+			end := strings.IndexByte(q[k:], closing)
+			if end < 0 {
+				return len(q)
+			}
+			j = k + end + 1
+			continue
+		case k < len(q) && isWordByte(q[k]):
+			e := k
+			for e < len(q) && isWordByte(q[e]) {
+				e++
+			}
+			if pgTypeSuffixWords[strings.ToLower(q[k:e])] {
+				j = e
+				continue
+			}
+		}
+		return j
+	}
+}
+
+// 识别 PostgreSQL 的 $1 参数占位符和 $tag$...$tag$ 字符串，返回结束位置，不是时返回 -1
+func skipPgDollar(q string, i int) int {
+	j := i + 1
+	if j < len(q) && q[j] >= '0' && q[j] <= '9' {
+		for j < len(q) && q[j] >= '0' && q[j] <= '9' {
+			j++
+		}
+		return j
+	}
+	for j < len(q) && q[j] != '$' && isWordByte(q[j]) {
+		j++
+	}
+	if j >= len(q) || q[j] != '$' {
+		return -1
+	}
+	tag := q[i : j+1]
+	end := strings.Index(q[j+1:], tag)
+	if end < 0 {
+		return len(q)
+	}
+	return j + 1 + end + len(tag)
+}
+
+// 一次扫描完成：去除注释、字符串和数字替换为 ?、合并空白字符、转为小写。
+// PostgreSQL 中双引号表示标识符、# 不是注释、只有 E'...' 字符串使用反斜杠转义，
+// 此外 $1 参数占位符和 $$...$$ 字符串替换为 ?，::type 类型转换被去掉
+func normalizeQuery(q string, dialect sqlDialect) string {
+	pg := dialect == dialectPostgres
+	// PostgreSQL 中紧跟在 E 前缀后面的字符串
+	escapeString := false
+	var b strings.Builder
+	b.Grow(len(q))
+	space := false
+	emit := func(s string) {
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteString(s)
+	}
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case isSpaceByte(c):
+			space = true
+			i++
+		case c == '/' && i+2 < len(q) && q[i+1] == '*' && q[i+2] != '!':
+			end := strings.Index(q[i+2:], "*/")
+			if end < 0 {
+				i = len(q)
+			} else {
+				i += end + 4
+			}
+			space = true
+		case c == '#' && !pg || c == '-' && i+1 < len(q) && q[i+1] == '-' && (i+2 == len(q) || isSpaceByte(q[i+2])):
+			end := strings.IndexByte(q[i:], '\n')
+			if end < 0 {
+				i = len(q)
+			} else {
+				i += end
+			}
+			space = true
+		case pg && c == ':' && i+1 < len(q) && q[i+1] == ':':
+			i = skipPgCast(q, i)
+		case pg && c == '$' && skipPgDollar(q, i) > 0:
+			emit("?")
+			i = skipPgDollar(q, i)
+		case pg && c == '"':
+			end := strings.IndexByte(q[i+1:], '"')
+			if end < 0 {
+				end = len(q) - i - 1
+			} else {
+				end++
+			}
+			emit(strings.ToLower(q[i : i+end+1]))
+			i += end + 1
+		case c == '\'' || c == '"':
+			backslash := !pg || escapeString
+			escapeString = false
+			j := i + 1
+			for j < len(q) {
+				if q[j] == '\\' && backslash {
+					j += 2
+					continue
+				}
+				if q[j] == c {
+					if j+1 < len(q) && q[j+1] == c {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			emit("?")
+			i = j + 1
+		case c == '`':
+			end := strings.IndexByte(q[i+1:], '`')
+			if end < 0 {
+				end = len(q) - i - 1
+			} else {
+				end++
+			}
+			emit(strings.ToLower(q[i : i+end+1]))
+			i += end + 1
+		case isWordByte(c) || c == '.' && i+1 < len(q) && q[i+1] >= '0' && q[i+1] <= '9' && (i == 0 || !isWordByte(q[i-1])):
+			j := i + 1
+			number := c >= '0' && c <= '9' || c == '.'
+			for j < len(q) && (isWordByte(q[j]) || number && q[j] == '.' ||
+				number && (q[j] == '+' || q[j] == '-') && (q[j-1] == 'e' || q[j-1] == 'E')) {
+				j++
+			}
+			word := strings.ToLower(q[i:j])
+			i = j
+			if pg && i < len(q) && q[i] == '\'' && (word == "e" || word == "x" || word == "b" || word == "n") {
+				// E'...'、X'...' 等带前缀的字符串整体替换为 ?
+				escapeString = word == "e"
+				continue
+			}
+			switch {
+			case number, word == "null", word == "true", word == "false":
+				emit("?")
+			case len(word) > 33 && isHexString(word[len(word)-32:]) && strings.ContainsRune("._-", rune(word[len(word)-33])):
+				// 以 md5 结尾的临时表名
+				emit(word[:len(word)-32] + "?")
+			default:
+				emit(word)
+			}
+		default:
+			emit(string(c))
+			i++
+		}
+	}
+	return b.String()
+}
+
+// 计算 SQL 指纹：去除注释和字面量，统一大小写和空白字符
+func fingerprint(query string) string {
+	if mysqldumpRegexp.MatchString(query) {
+		return "mysqldump"
+	}
+	if strings.HasPrefix(query, "/*") && strings.Contains(query, "percona-toolkit") {
+		return "percona-toolkit"
+	}
+	q := strings.TrimSpace(query)
+	if useDbRegexp.MatchString(q) {
+		return "use ?"
+	}
+	if m := callRegexp.FindStringSubmatch(q); m != nil {
+		return "call " + strings.ToLower(m[1])
+	}
+	if m := insertValuesRegexp.FindStringSubmatch(q); m != nil {
+		// 批量插入只保留到 VALUES，避免不同行数的插入被拆分成不同的类
+		q = m[1] + "(?+)"
+	}
+
+	return collapseFingerprint(normalizeQuery(q, dialectMySQL))
+}
+
+// 计算 PostgreSQL 查询的指纹
+func fingerprintPostgres(query string) string {
+	q := strings.TrimSpace(query)
+	if m := insertValuesRegexp.FindStringSubmatch(q); m != nil {
+		q = m[1] + "(?+)"
+	}
+	return collapseFingerprint(normalizeQuery(q, dialectPostgres))
+}
+
+// 按方言计算查询指纹
+func (d sqlDialect) fingerprint(query string) string {
+	if d == dialectPostgres {
+		return fingerprintPostgres(query)
+	}
+	return fingerprint(query)
+}
+
+// 合并 IN 列表、LIMIT 等不影响查询结构的部分
+func collapseFingerprint(q string) string {
+	if strings.Contains(q, "(?") || strings.Contains(q, "()") {
+		q = valueListRegexp.ReplaceAllString(q, "$1(?+)")
+	}
+	if strings.Contains(q, "limit ?") {
+		q = limitRegexp.ReplaceAllString(q, "limit ?")
+	}
+	if strings.Contains(q, " asc") {
+		q = orderByAscRegexp.ReplaceAllString(q, "$1")
+	}
+	return strings.TrimSuffix(q, ";")
+}
+
+// 指纹的校验和，与 pt-query-digest 的 checksum 字段格式一致
+func fingerprintChecksum(fp string) string {
+	sum := md5.Sum([]byte(fp))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// 从查询中提取涉及的表，返回 [db, table] 对；未指定库名的表使用默认库
+func extractTables(query, defaultDb string) [][2]string {
+	var tables [][2]string
+	q := blockCommentRegexp.ReplaceAllString(query, " ")
+	q = onDuplicateKeyRegexp.ReplaceAllString(q, " ")
+	for _, m := range distillTableRegexp.FindAllStringSubmatch(q, -1) {
+		for _, item := range strings.Split(m[1], ",") {
+			item = strings.TrimSpace(tableAliasListRegexp.ReplaceAllString(strings.TrimSpace(item), ""))
+			if item == "" || distillSkipWords[strings.ToLower(item)] {
+				continue
+			}
+			db, table := defaultDb, item
+			if parts := strings.SplitN(item, ".", 2); len(parts) == 2 {
+				db, table = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+			}
+			db = strings.Trim(db, "`")
+			table = strings.Trim(table, "`")
+			if table == "" {
+				continue
+			}
+			tables = append(tables, [2]string{db, table})
+		}
+	}
+	return tables
+}
+
+// 去掉 PostgreSQL 标识符两侧的双引号，以便提取表名
+func unquotePgIdentifiers(query string) string {
+	if !strings.Contains(query, "\"") {
+		return query
+	}
+	return pgQuotedIdentRegexp.ReplaceAllString(query, "$1")
+}
+
+// 生成查询的提炼形式，例如 "SELECT ehr.drs_external_api_log"
+func distill(query string) string {
+	q := strings.TrimSpace(blockCommentRegexp.ReplaceAllString(query, " "))
+	q = singleQuotedRegexp.ReplaceAllString(q, "?")
+	q = doubleQuotedRegexp.ReplaceAllString(q, "?")
+
+	var parts []string
+	for _, v := range distillVerbRegexp.FindAllString(q, -1) {
+		v = strings.ToUpper(v)
+		if len(parts) == 0 {
+			parts = append(parts, v)
+			if v != "INSERT" && v != "REPLACE" && v != "CREATE" {
+				break
+			}
+		} else if v == "SELECT" {
+			// INSERT ... SELECT / CREATE ... SELECT
+			parts = append(parts, v)
+			break
+		}
+	}
+	for _, t := range extractTables(q, "") {
+		if t[0] != "" {
+			parts = append(parts, t[0]+"."+t[1])
+		} else {
+			parts = append(parts, t[1])
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// 通用查询日志（general log）的记录行：
+//
+//	MySQL 5.7+:        2024-04-16T10:00:00.123456Z	   12 Query	SELECT 1
+//	MySQL 5.6/MariaDB: 240416 10:00:00	   12 Query	SELECT 1
+//	同一秒内的后续记录省略时间:		   12 Query	SELECT 1
+var generalLineRegexp = regexp.MustCompile(`^(?:(\d{4}-\d\d-\d\dT\S+|\d{6}\s+\d{1,2}:\d\d:\d\d)\s+|\t\t)\s*(\d+)\s(Connect Out|Connect|Query|Init DB|Prepare|Execute|Close stmt|Reset stmt|Quit|Field List|Change user|Statistics|Ping|Processlist|Kill|Refresh|Shutdown|Debug|Time|Sleep|Fetch|Long Data|Set option|Reset connection|Binlog Dump(?: GTID)?|Register Slave|Table Dump|Delayed insert|Daemon|Error)\t?(.*)$`)
+
+// Connect 记录的参数，例如 "app@10.0.0.5 on shop using TCP/IP"，MariaDB 为 "app@localhost as anonymous on shop"
+var generalConnectRegexp = regexp.MustCompile(`^(\S*?)@(\S*)(?:\s+as\s+\S+)?\s+on\s*(\S*)`)
+
+// generalConn 通用查询日志中一个连接的用户、主机和当前库
+type generalConn struct {
+	user string
+	host string
+	db   string
+}
+
+// generalLogParser 逐行解析通用查询日志。通用查询日志不记录执行耗时，只统计语句的执行次数
+type generalLogParser struct {
+	emit  func(*slowEntry)
+	conns map[string]*generalConn
+	// 正在读取的多行语句
+	cur *slowEntry
+	// 省略时间的记录沿用上一条记录的时间
+	last string
+}
+
+func (p *generalLogParser) conn(id string) *generalConn {
+	c, ok := p.conns[id]
+	if !ok {
+		c = &generalConn{}
+		p.conns[id] = c
+	}
+	return c
+}
+
+func (p *generalLogParser) flush() {
+	if p.cur == nil {
+		return
+	}
+	e := p.cur
+	p.cur = nil
+	e.Query = strings.TrimSpace(e.Query)
+	if e.Query == "" {
+		return
+	}
+	// use db 只改变连接的当前库，与慢查询日志一样不作为语句统计
+	if m := useLineRegexp.FindStringSubmatch(e.Query + ";"); m != nil && !strings.Contains(e.Query, "\n") {
+		p.conn(e.ThreadId).db = m[1]
+		return
+	}
+	p.emit(e)
+}
+
+func (p *generalLogParser) line(line string) {
+	m := generalLineRegexp.FindStringSubmatch(line)
+	if m == nil {
+		if p.cur != nil {
+			p.cur.Query += "\n" + line
+		}
+		return
+	}
+	p.flush()
+	if m[1] != "" {
+		p.last = m[1]
+	}
+	id, command, argument := m[2], m[3], m[4]
+	c := p.conn(id)
+	switch command {
+	case "Connect", "Change user":
+		if cm := generalConnectRegexp.FindStringSubmatch(argument); cm != nil {
+			c.user, c.host, c.db = cm[1], cm[2], cm[3]
+		}
+	case "Init DB":
+		c.db = strings.TrimSpace(argument)
+	case "Quit":
+		delete(p.conns, id)
+	case "Query", "Execute":
+		// Prepare 只是准备语句，Execute 记录的是替换参数后的实际语句
+		p.cur = &slowEntry{
+			User:     c.user,
+			Host:     c.host,
+			Db:       c.db,
+			ThreadId: id,
+			Query:    argument,
+		}
+		if ts, ok := parseSlowLogTime(p.last); ok {
+			p.cur.Ts = ts
+		}
+	}
+}
+
+// 解析通用查询日志。连接的用户和库名来自 Connect/Init DB 记录，日志开始前已建立的连接无法获取
+func parseGeneralLog(r io.Reader, emit func(*slowEntry), progress func(int64)) error {
+	reader := bufio.NewReaderSize(&countingReader{r: r, progress: progress}, 1<<16)
+	p := &generalLogParser{emit: emit, conns: make(map[string]*generalConn)}
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			line = strings.TrimRight(line, "\r\n")
+			if !isSlowLogBanner(line) {
+				p.line(line)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	p.flush()
+	return nil
+}
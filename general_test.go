@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseGeneralLog(t *testing.T) {
+	type entry struct {
+		query    string
+		user     string
+		host     string
+		db       string
+		threadId string
+		ts       time.Time
+	}
+	ms := func(msec int) time.Time {
+		return time.Date(2024, 4, 16, 2, 0, 0, msec*1000, time.UTC)
+	}
+	tests := []struct {
+		name    string
+		path    string
+		entries []entry
+	}{
+		{
+			// Connect 之前已建立的连接 13 没有用户和库名；Prepare、Close stmt、Quit 和 use 不作为语句统计，
+			// Init DB 和 use 改变连接的当前库
+			name: "MySQL 8.0",
+			path: "testdata/general.log",
+			entries: []entry{
+				{query: "SET NAMES utf8mb4", user: "app", host: "10.0.0.5", db: "shop", threadId: "12", ts: ms(102345)},
+				{query: "SELECT id, total FROM orders WHERE user_id = 1024", user: "app", host: "10.0.0.5", db: "shop", threadId: "12", ts: ms(110000)},
+				{query: "SELECT id, total FROM orders WHERE user_id = 2048", user: "app", host: "10.0.0.5", db: "shop", threadId: "12", ts: ms(120000)},
+				{query: "SELECT id, total FROM orders WHERE user_id = 4096", threadId: "13", ts: ms(130000)},
+				{query: "UPDATE orders\nSET status = 2\nWHERE id = 7", user: "app", host: "10.0.0.5", db: "shop", threadId: "12", ts: ms(140000)},
+				{query: "SELECT name FROM customers WHERE id = 5", user: "app", host: "10.0.0.5", db: "crm", threadId: "12", ts: ms(161000)},
+				{query: "SELECT name FROM customers WHERE id = 6", user: "app", host: "10.0.0.5", db: "crm", threadId: "12", ts: ms(162000)},
+				{query: "INSERT INTO customers (name) VALUES ('alice')", user: "app", host: "10.0.0.5", db: "crm", threadId: "12", ts: ms(170000)},
+				{query: "DELETE FROM orders WHERE id = 8", user: "app", host: "10.0.0.5", db: "shop", threadId: "12", ts: ms(190000)},
+			},
+		},
+		{
+			// 同一秒内的后续记录省略时间，沿用上一条记录的时间
+			name: "MariaDB",
+			path: "testdata/general-mariadb.log",
+			entries: []entry{
+				{query: "SELECT COUNT(*) FROM orders WHERE status = 1", user: "report", host: "10.0.0.9", db: "shop", threadId: "21", ts: time.Date(2024, 4, 16, 10, 0, 0, 0, time.Local)},
+				{query: "SELECT COUNT(*) FROM orders WHERE status = 2", user: "report", host: "10.0.0.9", db: "shop", threadId: "21", ts: time.Date(2024, 4, 16, 10, 0, 0, 0, time.Local)},
+				{query: "INSERT INTO audit_log (msg) VALUES ('report')", user: "report", host: "10.0.0.9", db: "shop", threadId: "21", ts: time.Date(2024, 4, 16, 10, 0, 1, 0, time.Local)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Open(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var entries []*slowEntry
+			if err := parseGeneralLog(f, func(e *slowEntry) { entries = append(entries, e) }, nil); err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(tt.entries) {
+				t.Fatalf("entries = %d, want %d", len(entries), len(tt.entries))
+			}
+			for i, want := range tt.entries {
+				e := entries[i]
+				if e.Query != want.query {
+					t.Errorf("#%d Query = %q, want %q", i, e.Query, want.query)
+				}
+				if e.User != want.user || e.Host != want.host || e.Db != want.db || e.ThreadId != want.threadId {
+					t.Errorf("#%d User/Host/Db/ThreadId = %q/%q/%q/%q, want %q/%q/%q/%q", i,
+						e.User, e.Host, e.Db, e.ThreadId, want.user, want.host, want.db, want.threadId)
+				}
+				if !e.Ts.Equal(want.ts) {
+					t.Errorf("#%d Ts = %v, want %v", i, e.Ts, want.ts)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportRequest 生成一份报告所需的输入和参数，命令行和Web服务上传的日志共用
+type reportRequest struct {
+	Inputs []logInput
+	// 输入格式，auto 时根据文件内容识别
+	Format string
+	// 日志解析器: go 或 pt
+	Parser string
+	// performance_schema 摘要的起始快照
+	Baselines []logInput
+	// 分析时间范围，格式为 yyyy-mm-dd HH:mm:ss
+	StartTime string
+	EndTime   string
+	// 抓包文件中 MySQL 服务端的端口，多个用逗号分隔
+	ServerPort string
+	// 报告排序指标，SortExplicit 为 false 时没有执行耗时的数据来源按执行次数排序
+	Sort         string
+	SortExplicit bool
+	// 同时导出的其他格式，多个用逗号分隔
+	Export string
+	// 报告中记录的日志文件，为空时使用 Inputs 中的路径；上传的日志为上传时的文件名
+	LogFiles []string
+	// HTML 报告的路径，不写入文件时用于生成分析结果的 ID 和导出文件名
+	FileName string
+	// 是否将 HTML 报告写入 FileName，Web服务默认只在内存中保留分析结果，按请求生成报告
+	SaveHTML bool
+	Options  analysisOptions
+}
+
+// reportResult 生成的报告
+type reportResult struct {
+	Id   string
+	Data ReportData
+	// 写入的 HTML 报告，没有写入文件时为空
+	FileName    string
+	ExportFiles []string
+	KilledCount int
+	ErrorCount  int
+	// 分析结果和生成报告时的参数，Web服务按请求脱敏时重新生成报告数据
+	report   *Report
+	req      reportRequest
+	detected []detectedInput
+}
+
+// 识别输入格式、分析日志并生成 HTML 报告和导出文件
+func generateReport(req reportRequest) (*reportResult, error) {
+	opts := req.Options
+	format, detected, err := resolveInputFormat(req.Inputs, req.Format, opts.PgPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("识别日志格式失败: %w", err)
+	}
+	if opts.Quarantine == "" {
+		opts.Quarantine = strings.TrimSuffix(req.FileName, ".html") + "-quarantine.log"
+	}
+	if opts.Lenient && format != "slowlog" {
+		printColoredInfo("yellow", "-lenient 只对 MySQL 慢查询日志生效，%s 格式的输入按原方式解析", format)
+	}
+	if opts.Since, err = parseTimeFlag("startTime", req.StartTime); err != nil {
+		return nil, err
+	}
+	if opts.Until, err = parseTimeFlag("endTime", req.EndTime); err != nil {
+		return nil, err
+	}
+
+	printColoredInfo("yellow", "正在执行日志分析...")
+	report, err := runAnalysis(req, format, detected, opts)
+	if err != nil {
+		return nil, fmt.Errorf("分析日志失败: %w", err)
+	}
+	if opts.Redactor != nil {
+		printColoredInfo("yellow", "正在对报告中的 SQL 脱敏，脱敏级别: %s", opts.Redactor.Level)
+		opts.Redactor.redactReport(report)
+	}
+
+	if req.SaveHTML {
+		printColoredInfo("yellow", "正在生成分析报告: %s", req.FileName)
+	}
+	printColoredInfo("yellow", "正在处理查询信息...")
+	result := &reportResult{Id: analysisId(req.FileName), report: report, req: req, detected: detected}
+	if result.Data, err = buildReportData(report, req, detected); err != nil {
+		return nil, err
+	}
+	for _, info := range result.Data.SlowQueries {
+		result.KilledCount += info.KilledCount
+		result.ErrorCount += info.ErrorCount
+	}
+
+	if req.SaveHTML {
+		printColoredInfo("yellow", "正在生成HTML报告...")
+		file, err := os.Create(req.FileName)
+		if err != nil {
+			return nil, fmt.Errorf("创建报告文件失败: %w", err)
+		}
+		if err := renderHTMLReport(file, result.Data); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("生成HTML报告失败: %w", err)
+		}
+		if err := file.Close(); err != nil {
+			return nil, fmt.Errorf("生成HTML报告失败: %w", err)
+		}
+		result.FileName = req.FileName
+	}
+
+	// 导出其他格式的报告
+	if result.ExportFiles, err = exportReport(result.Data, strings.TrimSuffix(req.FileName, ".html"), req.Export); err != nil {
+		return nil, fmt.Errorf("导出报告失败: %w", err)
+	}
+	return result, nil
+}
+
+// 新报告的文件名，同一分钟内已有同名的报告或导出文件时加上序号，避免覆盖
+func newReportFileName(dir string, t time.Time) string {
+	base := filepath.Join(dir, reportFilePrefix+t.Format("2006-01-02-15-04"))
+	name := base
+	for i := 2; reportFileExists(name); i++ {
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+	return name + ".html"
+}
+
+func reportFileExists(base string) bool {
+	for ext := range reportContentTypes {
+		if _, err := os.Lstat(base + ext); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// 按输入格式和解析器分析日志
+func runAnalysis(req reportRequest, format string, detected []detectedInput, opts analysisOptions) (*Report, error) {
+	var logPaths []string
+	for _, input := range req.Inputs {
+		logPaths = append(logPaths, input.Path)
+	}
+	_, isCloud := cloudFormats[format]
+	switch {
+	case format == "digest":
+		printColoredInfo("blue", "起始快照:")
+		if _, _, err := resolveInputFormat(req.Baselines, "digest", nil); err != nil {
+			return nil, err
+		}
+		return analyzeDigestSnapshots(req.Inputs, req.Baselines, opts)
+	case format == "postgres":
+		opts.Format = format
+		opts.Dialect = dialectPostgres
+		printColoredInfo("blue", "使用内置解析器分析 PostgreSQL 日志，并行度: %d", opts.Workers)
+		return analyzeSlowLogs(req.Inputs, opts)
+	case format == "tcpdump":
+		opts.Format = format
+		var err error
+		if opts.ServerPorts, err = parseServerPorts(req.ServerPort); err != nil {
+			return nil, err
+		}
+		printColoredInfo("blue", "从抓包文件中解析 MySQL 流量，服务端端口: %s", req.ServerPort)
+		return analyzeSlowLogs(req.Inputs, opts)
+	case format == "general" || format == "binlog":
+		opts.Format = format
+		printColoredInfo("blue", "使用内置解析器统计语句的执行次数（%s 中没有执行耗时），并行度: %d", format, opts.Workers)
+		return analyzeSlowLogs(req.Inputs, opts)
+	case isCloud:
+		printColoredInfo("blue", "导入%s 慢查询导出文件", cloudFormats[format].Name)
+		return analyzeCloudExports(req.Inputs, format, opts)
+	case format != "slowlog":
+		return nil, fmt.Errorf("不支持的输入格式: %s（可选 auto、slowlog、postgres、tcpdump、general、binlog、digest、aliyun、aws、tencent）", format)
+	case req.Parser == "pt":
+		for i, d := range detected {
+			if d.Compression != "" {
+				return nil, fmt.Errorf("pt-query-digest 不支持 %s 压缩的文件 %s，请使用内置解析器 -parser go", d.Compression, req.Inputs[i].Path)
+			}
+		}
+		if opts.Lenient {
+			return runPtQueryDigestLenient(req.Inputs, logPaths, req.StartTime, req.EndTime, opts)
+		}
+		return runPtQueryDigest(logPaths, req.StartTime, req.EndTime)
+	case req.Parser == "go" || req.Parser == "":
+		printColoredInfo("blue", "使用内置解析器，并行度: %d", opts.Workers)
+		return analyzeSlowLogs(req.Inputs, opts)
+	default:
+		return nil, fmt.Errorf("不支持的解析器: %s（可选 go、pt）", req.Parser)
+	}
+}
+
+// 将分析结果整理为报告模板和导出文件使用的数据
+func buildReportData(report *Report, req reportRequest, detected []detectedInput) (ReportData, error) {
+	slowSqlInfos := buildSlowSqlInfos(report)
+	key := req.Sort
+	if report.Global.NoLatency && !req.SortExplicit {
+		// 没有执行耗时的数据来源默认按执行次数排序
+		key = "count"
+	}
+	if err := sortSlowSqlInfos(slowSqlInfos, key); err != nil {
+		return ReportData{}, fmt.Errorf("排序失败: %w", err)
+	}
+
+	data := ReportData{
+		GenerateTime:  time.Now().Format("2006-01-02 15:04:05"),
+		SlowQueries:   slowSqlInfos,
+		Engine:        report.Global.Engine,
+		HasLatency:    !report.Global.NoLatency,
+		ParseWarnings: buildParseWarningSummary(report),
+		TableRows:     buildTableRows(slowSqlInfos, report.Global.QueryCount),
+	}
+	data.LogFiles = req.LogFiles
+	for _, input := range req.Inputs {
+		if len(req.LogFiles) == 0 {
+			data.LogFiles = append(data.LogFiles, input.Path)
+		}
+		if !hasDuplicate(data.Sources, input.Source) {
+			data.Sources = append(data.Sources, input.Source)
+		}
+	}
+	if report.Global.NoLatency {
+		data.TableStats = buildTableStats(report)
+	}
+	if engine := detectedEngine(detected); engine != "" {
+		// 识别出的数据库产品和版本比解析器给出的引擎更具体，例如 MariaDB 10.6.16
+		data.Engine = engine
+	} else if data.Engine == "" {
+		data.Engine = dialectMySQL.engine()
+	}
+	for _, info := range slowSqlInfos {
+		if len(info.Badges) > 0 {
+			data.HasBadges = true
+		}
+	}
+	data.StartTime, data.EndTime = reportTimeRange(report)
+	return data, nil
+}
+
+// 报告模板中使用的自定义函数
+var reportFuncMap = template.FuncMap{
+	"float64": func(s string) float64 {
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	},
+	"mul": func(a, b float64) float64 {
+		return a * b
+	},
+	"int64": func(i int64) int64 {
+		return i
+	},
+	"formatTime": func(s string) string {
+		if s == "" {
+			// 数据来源没有提供该指标，例如 performance_schema 摘要中的最大锁等待
+			return "-"
+		}
+		t, _ := strconv.ParseFloat(s, 64)
+		switch {
+		case t >= 1:
+			return fmt.Sprintf("%.2fs", t)
+		case t >= 0.001:
+			return fmt.Sprintf("%.0fms", t*1000)
+		default:
+			return fmt.Sprintf("%.0fμs", t*1000000)
+		}
+	},
+	"join": func(arr []string, sep string) string {
+		return strings.Join(arr, sep)
+	},
+	"add": func(a, b int) int {
+		return a + b
+	},
+}
+
+// 使用嵌入的模板生成 HTML 报告
+func renderHTMLReport(w io.Writer, data ReportData) error {
+	tmplContent, err := templateFS.ReadFile("template/template.html")
+	if err != nil {
+		return fmt.Errorf("读取模板文件失败: %w", err)
+	}
+	tmpl, err := template.New("template.html").Funcs(reportFuncMap).Parse(string(tmplContent))
+	if err != nil {
+		return fmt.Errorf("创建HTML模板失败: %w", err)
+	}
+	return tmpl.Execute(w, data)
+}
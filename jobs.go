@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 分析任务的状态
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+const (
+	// 排队中的任务数上限，超过时拒绝新的上传
+	jobQueueSize = 16
+	// 内存中保留的已结束任务数，超过时删除最早的任务记录（报告文件保留）
+	jobHistorySize = 100
+	// 上传日志的读写超时，替代Web服务默认的超时，允许通过较慢的网络上传大文件
+	uploadTimeout = time.Hour
+)
+
+// 上传文件名中可以保留的字符，其余替换为 _
+var uploadNameReplacer = regexp.MustCompile(`[^0-9A-Za-z._\-]+`)
+
+// analysisJob 通过Web服务上传日志后创建的分析任务
+type analysisJob struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+	// 上传的文件名和大小
+	Upload string `json:"upload"`
+	Size   int64  `json:"size"`
+	// 写入报告目录的 HTML 报告和导出文件，可通过Web服务访问
+	Report  string   `json:"report,omitempty"`
+	Exports []string `json:"exports,omitempty"`
+	// 分析结果的 ID，报告可通过 /analyses/{id} 访问，接口为 /api/analyses/{id}
+	Analysis string `json:"analysis,omitempty"`
+	// 报告中的查询类数
+	Queries  int        `json:"queries,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	req reportRequest
+}
+
+// jobManager 管理上传日志的分析任务，任务按提交顺序逐个执行，每个任务内部仍并行解析
+type jobManager struct {
+	mu    sync.Mutex
+	jobs  map[string]*analysisJob
+	order []string
+	queue chan *analysisJob
+	// 报告输出目录和上传文件的临时目录
+	reportDir string
+	uploadDir string
+	// 上传的任务使用的默认参数，来自命令行
+	defaults reportRequest
+	// 上传文件的大小上限（字节）
+	maxUpload int64
+	// 分析完成后保存结果，供 JSON 接口查询
+	analyses *analysisStore
+	// 停止时关闭 stop，worker 执行完当前任务后关闭 done
+	stop   chan struct{}
+	done   chan struct{}
+	closed bool
+}
+
+func newJobManager(reportDir string, defaults reportRequest, maxUpload int64, analyses *analysisStore) (*jobManager, error) {
+	uploadDir, err := os.MkdirTemp("", "slowsql-analysis-upload")
+	if err != nil {
+		return nil, err
+	}
+	m := &jobManager{
+		jobs:      make(map[string]*analysisJob),
+		queue:     make(chan *analysisJob, jobQueueSize),
+		reportDir: reportDir,
+		uploadDir: uploadDir,
+		defaults:  defaults,
+		maxUpload: maxUpload,
+		analyses:  analyses,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go m.run()
+	return m, nil
+}
+
+// 停止接收新任务，等待执行中的任务结束后删除上传文件的临时目录，排队中的任务不再执行
+func (m *jobManager) shutdown(ctx context.Context) {
+	m.mu.Lock()
+	running := false
+	for _, job := range m.jobs {
+		running = running || job.Status == jobRunning
+	}
+	if !m.closed {
+		m.closed = true
+		close(m.stop)
+		close(m.queue)
+	}
+	m.mu.Unlock()
+	if running {
+		printColoredInfo("yellow", "等待执行中的分析任务结束...")
+	}
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+		printColoredInfo("yellow", "等待分析任务结束超时，未完成的任务已放弃")
+	}
+	os.RemoveAll(m.uploadDir)
+}
+
+func (m *jobManager) run() {
+	defer close(m.done)
+	for job := range m.queue {
+		select {
+		case <-m.stop:
+			m.discard(job)
+			continue
+		default:
+		}
+		m.execute(job)
+	}
+}
+
+// 放弃排队中的任务
+func (m *jobManager) discard(job *analysisJob) {
+	for _, input := range job.req.Inputs {
+		os.Remove(input.Path)
+	}
+	now := time.Now()
+	m.update(job, func() {
+		job.Status = jobFailed
+		job.Error = "Web服务已停止，任务未执行"
+		job.Finished = &now
+	})
+}
+
+func (m *jobManager) execute(job *analysisJob) {
+	now := time.Now()
+	m.update(job, func() {
+		job.Status = jobRunning
+		job.Started = &now
+	})
+	printColoredInfo("blue", "开始分析上传的日志: [%s] %s", job.Id, job.Upload)
+	var result *reportResult
+	err := func() (err error) {
+		// 分析出错不能影响Web服务
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("分析时发生内部错误: %v", r)
+			}
+		}()
+		result, err = generateReport(job.req)
+		return err
+	}()
+	for _, input := range job.req.Inputs {
+		os.Remove(input.Path)
+	}
+	finished := time.Now()
+	m.update(job, func() {
+		job.Finished = &finished
+		if err != nil {
+			job.Status = jobFailed
+			job.Error = err.Error()
+			return
+		}
+		job.Status = jobDone
+		if result.FileName != "" {
+			job.Report = filepath.Base(result.FileName)
+		}
+		job.Analysis = result.Id
+		for _, file := range result.ExportFiles {
+			job.Exports = append(job.Exports, filepath.Base(file))
+		}
+		job.Queries = len(result.Data.SlowQueries)
+	})
+	if err != nil {
+		printColoredInfo("red", "上传的日志 [%s] %s 分析失败: %s", job.Id, job.Upload, err.Error())
+	} else {
+		m.analyses.add(result)
+		printColoredInfo("green", "上传的日志 [%s] %s 分析完成: analyses/%s", job.Id, job.Upload, result.Id)
+	}
+}
+
+func (m *jobManager) update(job *analysisJob, fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn()
+}
+
+// 返回任务状态的副本，避免与执行中的任务并发读写
+func (m *jobManager) get(id string) (analysisJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return analysisJob{}, false
+	}
+	return *job, true
+}
+
+// 加入任务队列，队列已满时返回错误
+func (m *jobManager) submit(job *analysisJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errors.New("Web服务正在停止，不再接收新的任务")
+	}
+	select {
+	case m.queue <- job:
+	default:
+		return errors.New("排队中的任务过多，请稍后再试")
+	}
+	m.jobs[job.Id] = job
+	m.order = append(m.order, job.Id)
+	// 删除最早的已结束任务
+	for len(m.order) > jobHistorySize {
+		oldest := m.jobs[m.order[0]]
+		if oldest.Status != jobDone && oldest.Status != jobFailed {
+			break
+		}
+		delete(m.jobs, oldest.Id)
+		m.order = m.order[1:]
+	}
+	return nil
+}
+
+func newJobId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// jobError 带 HTTP 状态码的错误
+type jobError struct {
+	status int
+	msg    string
+}
+
+func (e *jobError) Error() string { return e.msg }
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	setSecurityHeaders(w)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// POST /api/analyze，上传日志文件并创建分析任务。请求为 multipart/form-data，
+// file 为日志文件（可以是 gzip、bzip2 压缩的文件），其余字段与同名的命令行参数相同
+func (m *jobManager) handleAnalyze(w http.ResponseWriter, r *http.Request) {
+	// 写入超时从读取完请求头开始计算，同样放宽，否则上传较慢时读取完文件后无法返回任务状态
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(uploadTimeout))
+	rc.SetWriteDeadline(time.Now().Add(uploadTimeout))
+	job, err := m.receive(w, r)
+	if err != nil {
+		status := http.StatusBadRequest
+		var je *jobError
+		if errors.As(err, &je) {
+			status = je.status
+		}
+		writeJSONError(w, status, err.Error())
+		return
+	}
+	if err := m.submit(job); err != nil {
+		for _, input := range job.req.Inputs {
+			os.Remove(input.Path)
+		}
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	printColoredInfo("blue", "收到上传的日志: [%s] %s (%s)", job.Id, job.Upload, formatBytes(float64(job.Size)))
+	snapshot, _ := m.get(job.Id)
+	w.Header().Set("Location", "/api/jobs/"+job.Id)
+	writeJSON(w, http.StatusAccepted, snapshot)
+}
+
+// GET /api/jobs/{id}，查询分析任务的状态
+func (m *jobManager) handleJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.get(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "任务不存在")
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// 读取上传的文件和参数，文件直接写入临时目录，不占用内存
+func (m *jobManager) receive(w http.ResponseWriter, r *http.Request) (*analysisJob, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, m.maxUpload)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, errors.New("请求应为 multipart/form-data")
+	}
+	job := &analysisJob{Id: newJobId(), Status: jobQueued, Created: time.Now()}
+	fields := make(map[string]string)
+	var path string
+	cleanup := func() {
+		if path != "" {
+			os.Remove(path)
+		}
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cleanup()
+			return nil, uploadError(err)
+		}
+		if part.FormName() != "file" {
+			value, err := io.ReadAll(io.LimitReader(part, 4096))
+			if err != nil {
+				cleanup()
+				return nil, uploadError(err)
+			}
+			fields[part.FormName()] = strings.TrimSpace(string(value))
+			continue
+		}
+		if path != "" {
+			cleanup()
+			return nil, errors.New("每次只能上传一个文件")
+		}
+		job.Upload = uploadNameReplacer.ReplaceAllString(filepath.Base(part.FileName()), "_")
+		if job.Upload == "" || job.Upload == "." {
+			job.Upload = "upload.log"
+		}
+		path = filepath.Join(m.uploadDir, job.Id+"-"+job.Upload)
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, &jobError{http.StatusInternalServerError, "保存上传文件失败: " + err.Error()}
+		}
+		job.Size, err = io.Copy(f, part)
+		f.Close()
+		if err != nil {
+			cleanup()
+			return nil, uploadError(err)
+		}
+	}
+	if path == "" {
+		return nil, errors.New("没有上传日志文件（字段名 file）")
+	}
+	req, err := m.buildRequest(job, path, fields)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	job.req = req
+	return job, nil
+}
+
+func uploadError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &jobError{http.StatusRequestEntityTooLarge, fmt.Sprintf("上传的文件超过 %s 的限制", formatBytes(float64(tooLarge.Limit)))}
+	}
+	return fmt.Errorf("读取上传文件失败: %w", err)
+}
+
+// 根据表单字段生成任务的参数，未指定的参数使用命令行中的设置
+func (m *jobManager) buildRequest(job *analysisJob, path string, fields map[string]string) (reportRequest, error) {
+	req := m.defaults
+	req.Inputs = []logInput{{Source: getBaseFileName(job.Upload), Path: path}}
+	// 临时目录中的路径没有意义，报告中记录上传时的文件名
+	req.LogFiles = []string{job.Upload}
+	// 上传的文件只使用内置解析器，pt-query-digest 不支持压缩文件且依赖 Perl 环境
+	req.Parser = "go"
+	req.Baselines = nil
+	req.FileName = filepath.Join(m.reportDir, fmt.Sprintf("%s%s-%s.html", reportFilePrefix, job.Created.Format("2006-01-02-15-04"), job.Id))
+	req.Options.Quarantine = ""
+	for name, value := range fields {
+		if value == "" {
+			continue
+		}
+		switch name {
+		case "startTime", "endTime":
+			if _, err := parseTimeFlag(name, value); err != nil {
+				return req, err
+			}
+			if name == "startTime" {
+				req.StartTime = value
+			} else {
+				req.EndTime = value
+			}
+		case "format":
+			if value == "digest" {
+				return req, errors.New("上传的日志不支持 digest 格式，摘要快照需要起始快照和结束快照两个文件")
+			}
+			req.Format = value
+		case "sort":
+			req.Sort = value
+			req.SortExplicit = true
+		case "samples":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return req, errors.New("参数 samples 错误: 至少为 1")
+			}
+			req.Options.Samples = n
+		case "redact":
+			// 命令行中指定了 -redact 时，上传的日志同样按命令行的级别脱敏，不能通过表单关闭
+			if req.Options.Redactor != nil || value == redactNone {
+				continue
+			}
+			// 使用按 -redactRules 创建的脱敏器，自定义规则对上传的日志同样生效
+			redactor := m.analyses.redactors[value]
+			if redactor == nil {
+				return req, fmt.Errorf("不支持的脱敏级别: %s（可选 none、fingerprint、literals、pii）", value)
+			}
+			req.Options.Redactor = redactor
+		case "lenient":
+			lenient, err := strconv.ParseBool(value)
+			if err != nil {
+				return req, errors.New("参数 lenient 错误: 应为 true 或 false")
+			}
+			req.Options.Lenient = lenient
+		case "export":
+			for _, format := range strings.Split(value, ",") {
+				if format = strings.TrimSpace(format); format != "json" && format != "csv" {
+					return req, fmt.Errorf("不支持的导出格式: %s（可选 json、csv）", format)
+				}
+			}
+			req.Export = value
+		case "serverPort":
+			if _, err := parseServerPorts(value); err != nil {
+				return req, err
+			}
+			req.ServerPort = value
+		default:
+			return req, fmt.Errorf("不支持的参数: %s", name)
+		}
+	}
+	return req, nil
+}
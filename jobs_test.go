@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildRequestRedactRules(t *testing.T) {
+	dir := t.TempDir()
+	rules := filepath.Join(dir, "redact.rules")
+	writeTestFile(t, rules, "order_no=ORD\\d{8}\n")
+	store, err := newAnalysisStore(dir, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &jobManager{reportDir: dir, analyses: store}
+	job := &analysisJob{Id: "1", Upload: "slow.log", Created: time.Now()}
+
+	req, err := m.buildRequest(job, "slow.log", map[string]string{"redact": redactPII})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Options.Redactor == nil {
+		t.Fatal("Redactor is nil")
+	}
+	// 表单中的脱敏级别同样使用 -redactRules 中的自定义规则
+	if got := req.Options.Redactor.maskText("ORD20240416"); got != "<order_no>" {
+		t.Errorf("maskText = %q, want %q", got, "<order_no>")
+	}
+
+	req, err = m.buildRequest(job, "slow.log", map[string]string{"redact": redactNone})
+	if err != nil || req.Options.Redactor != nil {
+		t.Errorf("redact=none: Redactor = %v, err = %v, want nil", req.Options.Redactor, err)
+	}
+
+	_, err = m.buildRequest(job, "slow.log", map[string]string{"redact": "all"})
+	if err == nil || !strings.Contains(err.Error(), "不支持的脱敏级别: all") {
+		t.Errorf("redact=all: err = %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// malformedEntry 解析时发现的一条格式异常的记录
+type malformedEntry struct {
+	Path   string
+	Offset int64
+	Len    int64
+	Reason string
+	// 原始内容，只在宽松模式下保留，用于写入隔离文件
+	Raw string
+	// 是否未参与统计
+	Dropped bool
+}
+
+// 记录一条格式异常的记录，返回 true 时丢弃该记录。宽松模式下丢弃所有格式异常的记录，
+// 否则只丢弃没有 SQL 语句的记录，其余记录照常统计
+func (a *aggregator) reject(path string, e *slowEntry, lenient bool) bool {
+	m := malformedEntry{
+		Path:    path,
+		Offset:  e.Offset,
+		Len:     int64(len(e.Raw)),
+		Reason:  e.Malformed,
+		Dropped: lenient || e.Query == "",
+	}
+	if lenient {
+		m.Raw = e.Raw
+	}
+	a.malformed = append(a.malformed, m)
+	return lenient
+}
+
+// 汇总格式异常的记录，没有格式异常的记录时返回 nil
+func buildParseWarnings(entries []malformedEntry, lenient bool) *ParseWarnings {
+	if len(entries) == 0 {
+		return nil
+	}
+	w := &ParseWarnings{Lenient: lenient}
+	counts := make(map[string]int)
+	for _, e := range entries {
+		w.Entries++
+		w.Bytes += e.Len
+		if e.Dropped {
+			w.Dropped++
+		}
+		counts[e.Reason]++
+	}
+	for _, reason := range sortedKeys(counts) {
+		w.Reasons = append(w.Reasons, ParseWarningReason{Reason: reason, Count: counts[reason]})
+	}
+	sort.SliceStable(w.Reasons, func(i, j int) bool {
+		return w.Reasons[i].Count > w.Reasons[j].Count
+	})
+	return w
+}
+
+// 将格式异常的记录写入隔离文件，每条记录前有一行注明所在文件、偏移量、长度和原因。
+// 压缩文件的偏移量为解压后的位置，指定了 -redact 时记录中的 SQL 同样脱敏
+func writeQuarantine(path string, entries []malformedEntry, redactor *sqlRedactor) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range entries {
+		fmt.Fprintf(w, "# 文件: %s 偏移: %d 长度: %d 原因: %s\n", e.Path, e.Offset, e.Len, e.Reason)
+		raw := redactor.redactRaw(e.Raw)
+		w.WriteString(raw)
+		if !strings.HasSuffix(raw, "\n") {
+			w.WriteString("\n")
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// 检查慢查询日志中格式异常的记录，用于在交给 pt-query-digest 之前剔除这些记录
+func scanMalformed(inputs []logInput) ([]malformedEntry, error) {
+	agg := newAggregator(dialectMySQL)
+	for _, input := range inputs {
+		f, err := os.Open(input.Path)
+		if err != nil {
+			return nil, err
+		}
+		reject := func(e *slowEntry) bool {
+			return agg.reject(input.Path, e, true)
+		}
+		err = parseSlowLog(f, 0, 0, func(*slowEntry) {}, reject, nil)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("解析 %s 失败: %w", input.Path, err)
+		}
+	}
+	return agg.malformed, nil
+}
+
+// 在 dir 中生成剔除了格式异常记录的日志副本，返回副本的路径。没有格式异常记录的文件直接使用原文件
+func writeCleanedCopies(dir string, paths []string, entries []malformedEntry) ([]string, error) {
+	ranges := make(map[string][]malformedEntry)
+	for _, e := range entries {
+		ranges[e.Path] = append(ranges[e.Path], e)
+	}
+	cleaned := make([]string, len(paths))
+	for i, path := range paths {
+		skip := ranges[path]
+		if len(skip) == 0 {
+			cleaned[i] = path
+			continue
+		}
+		cleaned[i] = filepath.Join(dir, fmt.Sprintf("%d-%s", i, filepath.Base(path)))
+		if err := copySkipping(path, cleaned[i], skip); err != nil {
+			return nil, fmt.Errorf("生成 %s 的副本失败: %w", path, err)
+		}
+	}
+	return cleaned, nil
+}
+
+// 复制文件并跳过 skip 中各记录所在的字节区间，skip 按偏移量升序排列
+func copySkipping(src, dst string, skip []malformedEntry) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	var pos int64
+	for _, e := range skip {
+		if _, err := io.CopyN(out, in, e.Offset-pos); err != nil {
+			out.Close()
+			return err
+		}
+		if _, err := in.Seek(e.Offset+e.Len, io.SeekStart); err != nil {
+			out.Close()
+			return err
+		}
+		pos = e.Offset + e.Len
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
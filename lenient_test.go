@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSlowLogMalformedEntries(t *testing.T) {
+	const path = "testdata/slow-malformed.log"
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 格式异常的记录从第 N 行的 # Time: 开始
+	lineAt := func(offset int64) int {
+		return bytes.Count(content[:offset], []byte("\n")) + 1
+	}
+	wantMalformed := []struct {
+		line   int
+		reason string
+		// 严格模式下只丢弃没有 SQL 语句的记录
+		strictDropped bool
+	}{
+		{10, "SQL 中的引号未闭合，记录可能被截断", false},
+		{15, "没有 SQL 语句，记录可能被截断", true},
+		{17, "SQL 中包含二进制内容", false},
+		{22, "SQL 中的注释未闭合，记录可能被截断", false},
+	}
+
+	tests := []struct {
+		lenient bool
+		queries int
+		classes []string
+	}{
+		{
+			lenient: false,
+			queries: 6,
+			classes: []string{
+				"",
+				"insert into attachments (id, body) values(?+)",
+				"select * from orders where customer_id = ?",
+				"select name from customers where email = ? and id = ?",
+				"update orders set note = ?",
+			},
+		},
+		{
+			lenient: true,
+			queries: 3,
+			classes: []string{
+				"select * from orders where customer_id = ?",
+				"select name from customers where email = ? and id = ?",
+			},
+		},
+	}
+	for _, tt := range tests {
+		name := "严格模式"
+		if tt.lenient {
+			name = "宽松模式"
+		}
+		t.Run(name, func(t *testing.T) {
+			opts := analysisOptions{Format: "slowlog", Dialect: dialectMySQL, Lenient: tt.lenient}
+			task := parseTask{Source: "db1", Path: path, End: int64(len(content))}
+			agg, err := runParseTask(task, opts, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(agg.malformed) != len(wantMalformed) {
+				t.Fatalf("malformed = %d, want %d", len(agg.malformed), len(wantMalformed))
+			}
+			for i, want := range wantMalformed {
+				m := agg.malformed[i]
+				if line := lineAt(m.Offset); line != want.line || m.Reason != want.reason {
+					t.Errorf("#%d line/reason = %d/%q, want %d/%q", i, line, m.Reason, want.line, want.reason)
+				}
+				if dropped := tt.lenient || want.strictDropped; m.Dropped != dropped {
+					t.Errorf("#%d Dropped = %v, want %v", i, m.Dropped, dropped)
+				}
+				if !strings.HasPrefix(string(content[m.Offset:m.Offset+m.Len]), "# Time: ") {
+					t.Errorf("#%d does not start at an entry boundary", i)
+				}
+			}
+
+			report := mergeTaskResults([]parseTask{task}, []*aggregator{agg}, opts).report(nil)
+			if report.Global.QueryCount != tt.queries {
+				t.Errorf("QueryCount = %d, want %d", report.Global.QueryCount, tt.queries)
+			}
+			var classes []string
+			for _, class := range report.Classes {
+				classes = append(classes, class.Fingerprint)
+			}
+			sort.Strings(classes)
+			if strings.Join(classes, "\n") != strings.Join(tt.classes, "\n") {
+				t.Errorf("classes = %q, want %q", classes, tt.classes)
+			}
+
+			w := buildParseWarnings(agg.malformed, tt.lenient)
+			wantDropped := 1
+			if tt.lenient {
+				wantDropped = len(wantMalformed)
+			}
+			if w.Entries != len(wantMalformed) || w.Dropped != wantDropped {
+				t.Errorf("Entries/Dropped = %d/%d, want %d/%d", w.Entries, w.Dropped, len(wantMalformed), wantDropped)
+			}
+		})
+	}
+}
+
+func TestWriteQuarantine(t *testing.T) {
+	const path = "testdata/slow-malformed.log"
+	opts := analysisOptions{Format: "slowlog", Dialect: dialectMySQL, Lenient: true}
+	agg, err := runParseTask(parseTask{Source: "db1", Path: path}, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quarantine := filepath.Join(t.TempDir(), "bad-entries.log")
+	if err := writeQuarantine(quarantine, agg.malformed, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(quarantine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 每条记录前注明所在文件、偏移量、长度和原因，随后是记录的原文
+	for _, m := range agg.malformed {
+		entry := fmt.Sprintf("# 文件: %s 偏移: %d 长度: %d 原因: %s\n%s", path, m.Offset, m.Len, m.Reason, m.Raw)
+		if m.Raw == "" || !strings.Contains(string(got), entry) {
+			t.Errorf("quarantine does not contain the entry at offset %d (%s)", m.Offset, m.Reason)
+		}
+	}
+	if strings.Contains(string(got), "customer_id = 42") {
+		t.Error("quarantine contains a well-formed entry")
+	}
+}
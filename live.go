@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// 实时监控页面展示的最近记录数和排行榜中的查询类数
+	liveFeedSize = 100
+	liveTopN     = 20
+	// 检查日志文件新增内容的间隔，一个间隔内没有新内容时提交解析中的最后一条记录
+	livePollInterval = 500 * time.Millisecond
+	// 合并推送的间隔，日志写入频繁时不会每条记录推送一次
+	livePushInterval = time.Second
+	// 没有新记录时发送心跳，避免代理关闭空闲的连接
+	liveHeartbeat = 15 * time.Second
+	// 推送的 SQL 的最大长度，超过时截断
+	liveQueryLimit = 2000
+)
+
+// liveEntry 监控期间新增的一条慢查询
+type liveEntry struct {
+	Time         string  `json:"time"`
+	Source       string  `json:"source"`
+	User         string  `json:"user,omitempty"`
+	Host         string  `json:"host,omitempty"`
+	Db           string  `json:"db,omitempty"`
+	QueryTime    float64 `json:"queryTime"`
+	LockTime     float64 `json:"lockTime"`
+	RowsExamined float64 `json:"rowsExamined"`
+	Checksum     string  `json:"checksum"`
+	Query        string  `json:"query"`
+}
+
+// liveClass 监控期间一类查询的计数
+type liveClass struct {
+	Checksum     string  `json:"checksum"`
+	Fingerprint  string  `json:"fingerprint"`
+	Count        int64   `json:"count"`
+	TimeSum      float64 `json:"timeSum"`
+	TimeMax      float64 `json:"timeMax"`
+	RowsExamined float64 `json:"rowsExamined"`
+	LastSeen     string  `json:"lastSeen"`
+}
+
+// liveUpdate 推送给页面的一次更新，连接时 Entries 为最近的记录，之后为上次推送以来新增的记录
+type liveUpdate struct {
+	Started string      `json:"started"`
+	Queries int64       `json:"queries"`
+	Classes int         `json:"classes"`
+	TimeSum float64     `json:"timeSum"`
+	Top     []liveClass `json:"top"`
+	Entries []liveEntry `json:"entries"`
+}
+
+// 排行榜的排序方式: time 按总执行时间，count 按执行次数
+var liveSortKeys = map[string]bool{"time": true, "count": true}
+
+// liveSubscriber 一个订阅实时更新的页面
+type liveSubscriber struct {
+	sort string
+	ch   chan []byte
+}
+
+// liveMonitor 持续读取慢查询日志新增的记录，统计每类查询的计数，并通过 Server-Sent Events 推送给实时监控页面
+type liveMonitor struct {
+	inputs []logInput
+	// 开始监控时每个文件的读取位置，即分析开始前的文件大小
+	offsets  []int64
+	dialect  sqlDialect
+	redactor *sqlRedactor
+	// 启动时生成的分析结果，页面中链接到完整报告
+	Analysis string
+
+	mu      sync.Mutex
+	started time.Time
+	queries int64
+	timeSum float64
+	classes map[string]*liveClass
+	feed    []liveEntry
+	pending []liveEntry
+	subs    map[*liveSubscriber]struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// 记录各个日志文件的当前大小，开始监控后从这里读取新增的记录
+func newLiveMonitor(inputs []logInput, redactor *sqlRedactor) (*liveMonitor, error) {
+	m := &liveMonitor{
+		inputs:   inputs,
+		dialect:  dialectMySQL,
+		redactor: redactor,
+		classes:  make(map[string]*liveClass),
+		subs:     make(map[*liveSubscriber]struct{}),
+		stop:     make(chan struct{}),
+	}
+	for _, input := range inputs {
+		info, err := os.Stat(input.Path)
+		if err != nil {
+			return nil, err
+		}
+		m.offsets = append(m.offsets, info.Size())
+	}
+	return m, nil
+}
+
+// 检查输入是否可以持续读取，只支持未压缩的慢查询日志
+func (m *liveMonitor) check(detected []detectedInput) error {
+	for i, d := range detected {
+		if d.Compression != "" {
+			return fmt.Errorf("无法持续读取 %s 压缩的文件 %s", d.Compression, m.inputs[i].Path)
+		}
+		if d.Format != "slowlog" && d.Format != "" {
+			return fmt.Errorf("只支持 MySQL 慢查询日志，%s 的格式为 %s", m.inputs[i].Path, d.Format)
+		}
+	}
+	return nil
+}
+
+func (m *liveMonitor) start() {
+	m.started = time.Now()
+	for i, input := range m.inputs {
+		go m.follow(input, m.offsets[i])
+	}
+	go m.push()
+}
+
+// 停止读取日志并断开所有订阅的页面，Web服务停止时调用
+func (m *liveMonitor) close() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+// 持续读取一个日志文件新增的内容。文件被截断时从头读取，被轮转（重命名后重新创建）时读取新的文件
+func (m *liveMonitor) follow(input logInput, offset int64) {
+	parser := newSlowLogParser(func(e *slowEntry) {
+		e.Source = input.Source
+		m.add(e)
+	}, nil)
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	var partial []byte
+	buf := make([]byte, 64<<10)
+	warned := false
+	ticker := time.NewTicker(livePollInterval)
+	defer ticker.Stop()
+	for {
+		read := false
+		if f == nil {
+			var err error
+			if f, err = os.Open(input.Path); err != nil {
+				if !warned {
+					printColoredInfo("yellow", "警告: 无法读取日志文件 %s: %s，稍后重试", input.Path, err.Error())
+					warned = true
+				}
+				f = nil
+			} else if _, err := f.Seek(offset, io.SeekStart); err != nil {
+				f.Close()
+				f = nil
+			} else {
+				warned = false
+			}
+		}
+		if f != nil {
+			if cur, err := os.Stat(input.Path); err == nil {
+				opened, err := f.Stat()
+				switch {
+				case err == nil && !os.SameFile(cur, opened):
+					// 文件被轮转，读完旧文件剩余的内容后打开新的文件
+					m.readAvailable(f, parser, &offset, &partial, buf)
+					parser.close()
+					f.Close()
+					f, offset, partial = nil, 0, nil
+					continue
+				case cur.Size() < offset:
+					// 文件被截断，从头读取
+					parser.close()
+					f.Seek(0, io.SeekStart)
+					offset, partial = 0, nil
+				}
+			}
+			read = m.readAvailable(f, parser, &offset, &partial, buf)
+		}
+		// 慢查询日志的一条记录通常一次写入，一个间隔内没有新内容时提交最后一条记录，不必等到下一条记录开始
+		if !read && parser.cur != nil && len(parser.query) > 0 {
+			parser.flush()
+		}
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 读取文件中已有的新内容，完整的行交给解析器，末尾不完整的行留到下次读取。返回是否读到了新内容
+func (m *liveMonitor) readAvailable(f *os.File, parser *slowLogParser, offset *int64, partial *[]byte, buf []byte) bool {
+	read := false
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			read = true
+			data := append(*partial, buf[:n]...)
+			for {
+				i := bytes.IndexByte(data, '\n')
+				if i < 0 {
+					break
+				}
+				parser.line(string(data[:i+1]), *offset)
+				*offset += int64(i + 1)
+				data = data[i+1:]
+			}
+			*partial = append([]byte(nil), data...)
+		}
+		if err != nil || n == 0 {
+			return read
+		}
+	}
+}
+
+// 统计一条新增的记录
+func (m *liveMonitor) add(e *slowEntry) {
+	fp := m.dialect.fingerprint(e.Query)
+	checksum := fingerprintChecksum(fp)
+	query := e.Query
+	if m.redactor != nil {
+		if m.redactor.Level == redactFingerprint {
+			query = fp
+		} else {
+			query = m.redactor.maskSQL(query, m.dialect)
+		}
+	}
+	if len(query) > liveQueryLimit {
+		cut := liveQueryLimit
+		for cut > 0 && !utf8.RuneStart(query[cut]) {
+			cut--
+		}
+		query = query[:cut] + " ..."
+	}
+	ts := e.Ts
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	entry := liveEntry{
+		Time:         formatReportTime(ts),
+		Source:       e.Source,
+		User:         e.User,
+		Host:         e.Host,
+		Db:           e.Db,
+		QueryTime:    e.QueryTime,
+		LockTime:     e.LockTime,
+		RowsExamined: e.RowsExamined,
+		Checksum:     checksum,
+		Query:        query,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	class, ok := m.classes[checksum]
+	if !ok {
+		class = &liveClass{Checksum: checksum, Fingerprint: fp}
+		m.classes[checksum] = class
+	}
+	class.Count++
+	class.TimeSum += e.QueryTime
+	class.TimeMax = max(class.TimeMax, e.QueryTime)
+	class.RowsExamined += e.RowsExamined
+	class.LastSeen = entry.Time
+	m.queries++
+	m.timeSum += e.QueryTime
+	m.feed = append(m.feed, entry)
+	if len(m.feed) > liveFeedSize {
+		m.feed = m.feed[len(m.feed)-liveFeedSize:]
+	}
+	m.pending = append(m.pending, entry)
+}
+
+// 生成一次更新，调用方需持有 m.mu
+func (m *liveMonitor) update(sortKey string, entries []liveEntry) liveUpdate {
+	top := make([]liveClass, 0, len(m.classes))
+	for _, class := range m.classes {
+		top = append(top, *class)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		a, b := top[i], top[j]
+		if sortKey == "count" && a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.TimeSum != b.TimeSum {
+			return a.TimeSum > b.TimeSum
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Checksum < b.Checksum
+	})
+	if len(top) > liveTopN {
+		top = top[:liveTopN]
+	}
+	return liveUpdate{
+		Started: formatReportTime(m.started),
+		Queries: m.queries,
+		Classes: len(m.classes),
+		TimeSum: m.timeSum,
+		Top:     top,
+		Entries: append([]liveEntry{}, entries...),
+	}
+}
+
+// 定期将新增的记录和更新后的排行榜推送给所有订阅的页面
+func (m *liveMonitor) push() {
+	ticker := time.NewTicker(livePushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+		m.mu.Lock()
+		if len(m.pending) == 0 {
+			m.mu.Unlock()
+			continue
+		}
+		payloads := make(map[string][]byte)
+		for sub := range m.subs {
+			data, ok := payloads[sub.sort]
+			if !ok {
+				data, _ = json.Marshal(m.update(sub.sort, m.pending))
+				payloads[sub.sort] = data
+			}
+			select {
+			case sub.ch <- data:
+			default:
+				// 页面处理不过来时断开连接，浏览器会自动重连并重新获取最新的状态
+				delete(m.subs, sub)
+				close(sub.ch)
+			}
+		}
+		m.pending = nil
+		m.mu.Unlock()
+	}
+}
+
+// 订阅实时更新，同时返回当前的状态和最近的记录
+func (m *liveMonitor) subscribe(sortKey string) (*liveSubscriber, []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sub := &liveSubscriber{sort: sortKey, ch: make(chan []byte, 16)}
+	m.subs[sub] = struct{}{}
+	data, _ := json.Marshal(m.update(sortKey, m.feed))
+	return sub, data
+}
+
+func (m *liveMonitor) unsubscribe(sub *liveSubscriber) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.subs[sub]; ok {
+		delete(m.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// 实时更新的事件流（text/event-stream），连接时先发送当前状态，之后每秒推送一次新增的记录
+func (m *liveMonitor) handleEvents(w http.ResponseWriter, r *http.Request) {
+	sortKey := r.URL.Query().Get("sort")
+	if sortKey == "" {
+		sortKey = "time"
+	}
+	if !liveSortKeys[sortKey] {
+		writeJSONError(w, http.StatusBadRequest, "sort 参数错误，可选 time、count")
+		return
+	}
+	rc := http.NewResponseController(w)
+	// 事件流是长连接，不受Web服务写入超时的限制
+	rc.SetWriteDeadline(time.Time{})
+	setSecurityHeaders(w)
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// 避免 nginx 等反向代理缓冲事件
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	sub, snapshot := m.subscribe(sortKey)
+	defer m.unsubscribe(sub)
+	send := func(data []byte) bool {
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	if !send(snapshot) {
+		return
+	}
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-m.stop:
+			return
+		case data, ok := <-sub.ch:
+			if !ok || !send(data) {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
@@ -1,48 +1,112 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"embed"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"html/template"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
-	"path/filepath"
-	"regexp"
-	"sort"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 )
 
-//go:embed template/template.html
+//go:embed template/template.html template/index.html template/upload.html template/live.html template/fleet.html
 var templateFS embed.FS
 
 //go:embed cmd/pt-query-digest
 var ptQueryDigest []byte
 
+//go:embed openapi.json
+var openAPISpec []byte
+
 type ReportData struct {
 	GenerateTime string
 	SlowQueries  []SlowSqlInfo
 	LogFiles     []string
 	StartTime    string
 	EndTime      string
+	// 日志所属的数据库引擎，例如 MySQL、PostgreSQL
+	Engine  string
+	Sources []string
+	// 是否有查询带有全表扫描、磁盘临时表等执行特征
+	HasBadges bool
+	// 数据来源是否有执行耗时，通用查询日志和 binlog 没有，报告中隐藏耗时相关的列
+	HasLatency bool
+	// 按表汇总的读写次数，仅用于没有执行耗时的数据来源
+	TableStats []TableStat `json:",omitempty"`
+	// 解析时发现的格式异常记录
+	ParseWarnings *ParseWarningSummary `json:",omitempty"`
+	// 嵌入报告的表格数据，用于在浏览器中排序和筛选，与 SlowQueries 重复，不导出
+	TableRows []TableRow `json:"-"`
+	// Web服务按 limit 参数只展示前 N 类时，未展示的查询类数
+	Truncated int `json:",omitempty"`
 }
 
 const helpText = `慢查询日志分析工具 v1.0
 
 用法: 
     ./slowsql-analysis -f <慢查询日志路径1> [-f <慢查询日志路径2> ...] [-port <端口>] [-startTime <开始时间>] [-endTime <结束时间>]
+    ./slowsql-analysis -port <端口> -upload [-reportDir <报告目录>]
+    ./slowsql-analysis -port <端口> -collect [-reportDir <报告目录>]
+    ./slowsql-analysis -f <慢查询日志路径> -push <中心服务地址> [-instance <实例名>]
 
 参数:
-    -f          慢查询日志文件路径（可指定多个）
+    -f          慢查询日志文件路径（可指定多个），可使用 标签=路径 的形式指定来源标签，默认使用文件名
     -port       Web服务端口，设置后可通过浏览器访问报告
+    -reportDir  报告输出目录 (可选，默认当前目录，Web服务只提供该目录中生成的报告和导出文件)
+    -bind       Web服务的监听地址 (可选，默认监听所有网卡，例如 127.0.0.1 只允许本机访问)
+    -ipv6       打印访问地址时包含本机的 IPv6 地址 (可选，默认只打印 IPv4 地址)
+    -auth       Web服务的认证方式 (可选，默认 none，basic: 用户名和密码，token: Authorization: Bearer 令牌，
+                浏览器访问 token 方式时在登录框中以令牌作为密码)
+    -authFile   保存认证信息的文件 (可选，basic 方式为 用户名:密码，token 方式为令牌，未指定时读取环境变量 SLOWSQL_AUTH)
+    -tls        Web服务启用 HTTPS (可选，未指定证书时自动生成自签名证书)
+    -tlsCert    HTTPS 证书文件 (可选，PEM 格式，需与 -tlsKey 同时指定)
+    -tlsKey     HTTPS 私钥文件 (可选，PEM 格式)
+    -save       Web服务模式下同时将 HTML 报告写入报告目录 (可选，默认只在内存中保留分析结果，按请求生成报告)
+    -upload     Web服务提供上传日志生成报告的页面 /upload 和接口 POST /api/analyze (可选，不指定 -f 时只启动Web服务)
+    -uploadLimit 上传文件的大小上限 (可选，单位 MB，默认 1024)
+    -collect    Web服务接收各实例推送的分析结果 (POST /api/instances/<实例名>)，在 /fleet 中按指纹汇总所有实例的查询
+    -push       将分析结果推送给 -collect 模式的中心服务 (可选，例如 http://10.0.0.1:6033，推送每类查询的统计和示例，不推送原始日志；
+                未启动Web服务时默认不在本机生成 HTML 报告)
+    -instance   推送时使用的实例名 (可选，默认为主机名，只能包含字母、数字、下划线和 -)
+    -pushAuthFile 中心服务的认证信息 (可选，用户名:密码 使用 basic 认证，否则作为令牌，未指定时读取环境变量 SLOWSQL_PUSH_AUTH)
+    -pushCA     中心服务的 CA 证书或自签名证书 (可选，PEM 格式)
+    -follow     Web服务模式下持续读取慢查询日志新增的记录，在实时监控页面 /live 中推送 (可选，只支持未压缩的慢查询日志)
+    -schedule   定时报告的配置文件 (可选，Web服务模式下按 cron 表达式定时分析日志，每行一条 名称 = cron 表达式 时间窗口 [来源标签]，
+                时间窗口可选 yesterday、today、lastHour，或 last 加时长如 last30m)
+    -scheduleKeep 每个定时报告保留的报告数 (可选，默认 30，超过时删除最早的报告)
     -startTime  开始时间 (可选，格式: yyyy-mm-dd HH:mm:ss)
     -endTime    结束时间 (可选，格式: yyyy-mm-dd HH:mm:ss)
+    -parser     日志解析器 (可选，go: 内置并行解析器，pt: pt-query-digest，默认 go)
+    -workers    内置解析器的并行解析数 (可选，默认为CPU核数)
+    -source     只分析指定来源标签的日志 (可选)
+    -sort       报告排序指标 (可选，默认 time95，可选 time_sum、time_max、count、rows_examined、lock_time、killed、errors，
+                或扩展指标名称如 Tmp_disk_tables、Bytes_sent、Full_scan)
+    -export     同时导出其他格式的报告 (可选，json、csv，多个用逗号分隔)
+    -samples    每类查询展示的示例数 (可选，默认 5，包括执行时间最长的一条，其余随机选取；-parser pt 只有一条)
+    -format     输入格式 (可选，默认 auto: 根据文件内容自动识别，支持 gzip、bzip2 压缩的文件)
+                slowlog: 慢查询日志，postgres: PostgreSQL 日志（stderr/csvlog/jsonlog），tcpdump: MySQL 流量的 pcap/pcapng 抓包，
+                general: 通用查询日志，binlog: mysqlbinlog 输出的文本（统计执行次数和各表的写入热点，没有执行耗时），
+                digest: performance_schema 语句摘要快照，
+                aliyun: 阿里云 RDS 导出的 CSV/JSON，aws: AWS RDS 导出的 CloudWatch Logs JSON/CSV，tencent: 腾讯云 CDB 导出的 CSV/JSON
+    -pgPrefix   PostgreSQL 的 log_line_prefix (可选，用于解析 stderr 格式的日志，默认 '%m [%p] ')
+    -serverPort 抓包文件中 MySQL 服务端的端口 (可选，多个用逗号分隔，默认 3306)
+    -baseline   起始摘要快照 (可选，可指定多个，与 -f 中来源标签相同的快照做差得到区间内的统计)
+    -lenient    宽松模式 (可选，跳过慢查询日志中被截断、包含二进制内容等格式异常的记录，同时对 -parser pt 生效)
+    -quarantine 宽松模式下保存被跳过记录的隔离文件 (可选，默认为 <报告文件名>-quarantine.log)
+    -redact     报告中 SQL 的脱敏级别 (可选，默认 none，对 HTML、导出文件和隔离文件均生效)
+                fingerprint: 只展示 SQL 指纹，literals: 所有字符串和数字替换为 ?，
+                pii: 只替换邮箱、身份证号、手机号、银行卡号、令牌等敏感信息
+    -redactRules 自定义脱敏规则文件 (可选，每行一条 名称=正则表达式，与内置规则 email、id_card、card、phone、token 同名时替换，
+                正则为空时删除该内置规则)
 
 示例:
     1. 基本分析:
@@ -54,24 +118,96 @@ const helpText = `慢查询日志分析工具 v1.0
     3. 指定时间范围:
        ./slowsql-analysis -f /var/log/mysql-slow1.log -f /var/log/mysql-slow2.log -startTime="2024-04-16 00:00:00" -endTime="2024-04-16 23:59:59"
 
-    4. 完整功能:
+    4. 多实例分析:
+       ./slowsql-analysis -f primary=/logs/db1-slow.log -f replica=/logs/db2-slow.log -export csv
+
+    5. 分析 performance_schema 摘要快照的区间增量:
+       ./slowsql-analysis -format digest -baseline /tmp/digest-0900.tsv -f /tmp/digest-1000.tsv
+
+    6. 统计通用查询日志中的高频语句和 binlog 中的写入热点:
+       ./slowsql-analysis -format general -f /var/lib/mysql/general.log
+       mysqlbinlog -v --base64-output=DECODE-ROWS mysql-bin.000123 > binlog.txt && ./slowsql-analysis -format binlog -f binlog.txt
+
+    7. 跳过崩溃时被截断的记录，并将其保存到隔离文件中:
+       ./slowsql-analysis -lenient -quarantine /tmp/bad-entries.log -f /var/log/mysql-slow.log
+
+    8. 生成可以分享给其他团队的脱敏报告:
+       ./slowsql-analysis -redact literals -f /var/log/mysql-slow.log -export json,csv
+
+    9. 在数据库主机上启动带认证的 HTTPS 服务:
+       ./slowsql-analysis -f /var/log/mysql-slow.log -port 6033 -auth basic -authFile /etc/slowsql/auth -tls
+
+    10. 启动Web服务，供开发人员上传日志自助生成报告:
+       ./slowsql-analysis -port 6033 -upload -reportDir /data/slowsql-reports -auth basic -authFile /etc/slowsql/auth -tls
+
+    11. 实时监控慢查询日志新增的记录:
+       ./slowsql-analysis -f /var/log/mysql-slow.log -port 6033 -follow
+
+    12. 多实例汇总，各数据库主机定时推送分析结果，中心服务按指纹汇总:
+       ./slowsql-analysis -port 6033 -collect -reportDir /data/slowsql-reports -auth token -authFile /etc/slowsql/token
+       ./slowsql-analysis -f /var/log/mysql-slow.log -startTime="2024-04-16 00:00:00" -push http://10.0.0.1:6033 -pushAuthFile /etc/slowsql/token
+
+    13. 定时生成报告，每天凌晨分析前一天的日志，每小时分析上一个小时的日志:
+       ./slowsql-analysis -f primary=/var/log/mysql-slow.log -port 6033 -schedule /etc/slowsql/schedule.conf -reportDir /data/slowsql-reports
+       schedule.conf 的内容:
+           daily = 0 1 * * * yesterday
+           hourly = 5 * * * * lastHour primary
+
+    14. 完整功能:
        ./slowsql-analysis -f /var/log/mysql-slow1.log -f /var/log/mysql-slow2.log -port 6033 -startTime="2024-04-16 00:00:00" -endTime="2024-04-16 23:59:59"
 
 输出:
-    生成的报告文件格式: slowsql-analysis-<生成时间>.html
-    如果指定了端口，可以通过浏览器访问: http://<IP>:<端口>/<报告文件名>`
+    生成的报告文件格式: <报告目录>/slowsql-analysis-<生成时间>.html，同一分钟内已有同名报告时加上序号
+    定时报告: <报告目录>/slowsql-analysis-schedule-<名称>-<执行时间>.json (-save 时同时生成 HTML 报告)，在报告列表中展示
+    如果指定了端口，报告只保留在内存中 (-save 时同时写入文件)，可以通过浏览器访问: http://<IP>:<端口>/analyses/<报告ID>，
+    支持参数 sort (排序指标)、limit (只展示前 N 类)、redact (脱敏级别)、format (json、csv 下载导出文件)，报告列表: http://<IP>:<端口>/
+    JSON 接口: http://<IP>:<端口>/api/analyses，接口说明 (OpenAPI): http://<IP>:<端口>/api/openapi.json`
 
 func init() {
 	flag.Usage = func() {
 		printColoredInfo("blue", helpText)
 	}
 	flag.Var(&logAddresses, "f", "慢查询日志文件路径（可指定多个）")
+	flag.Var(&baselineAddresses, "baseline", "起始摘要快照文件路径（可指定多个）")
 }
 
 var logAddresses arrayFlags
+var baselineAddresses arrayFlags
 var startTime = flag.String("startTime", "", "分析开始时间 (格式: yyyy-mm-dd HH:mm:ss)")
 var endTime = flag.String("endTime", "", "分析结束时间 (格式: yyyy-mm-dd HH:mm:ss)")
 var port = flag.Int("port", 0, "Web服务端口，设置后可通过浏览器访问报告")
+var parserName = flag.String("parser", "go", "日志解析器: go（内置并行解析器）或 pt（pt-query-digest）")
+var workers = flag.Int("workers", runtime.NumCPU(), "内置解析器的并行解析数")
+var sourceFilter = flag.String("source", "", "只分析指定来源标签的日志")
+var sortKey = flag.String("sort", "time95", "报告排序指标: time95、time_sum、time_max、count、rows_examined、lock_time、killed、errors 或扩展指标名称（如 Tmp_disk_tables、Full_scan）")
+var inputFormat = flag.String("format", "auto", "输入格式: auto（根据文件内容自动识别）、slowlog（慢查询日志）、postgres（PostgreSQL 日志）、tcpdump（MySQL 流量抓包）、general（通用查询日志）、binlog（mysqlbinlog 输出的文本）、digest（performance_schema 语句摘要快照）、aliyun、aws 或 tencent（云厂商导出的慢查询）")
+var pgPrefix = flag.String("pgPrefix", defaultPgLinePrefix, "PostgreSQL 的 log_line_prefix，用于解析 stderr 格式的日志")
+var serverPort = flag.String("serverPort", "3306", "抓包文件中 MySQL 服务端的端口，多个用逗号分隔")
+var lenient = flag.Bool("lenient", false, "宽松模式，跳过慢查询日志中格式异常的记录并写入隔离文件")
+var quarantinePath = flag.String("quarantine", "", "宽松模式下保存被跳过记录的隔离文件，默认为 <报告文件名>-quarantine.log")
+var redactLevel = flag.String("redact", "none", "报告中 SQL 的脱敏级别: none、fingerprint（只展示指纹）、literals（字面量替换为 ?）或 pii（替换邮箱、身份证号、手机号、银行卡号等）")
+var redactRulesFile = flag.String("redactRules", "", "自定义脱敏规则文件，每行一条 名称=正则表达式")
+var sampleCount = flag.Int("samples", 5, "每类查询展示的示例数，包括执行时间最长的一条，其余随机选取")
+var exportFormats = flag.String("export", "", "同时导出其他格式的报告: json、csv，多个用逗号分隔")
+var reportDir = flag.String("reportDir", ".", "报告输出目录，Web服务只提供该目录中生成的报告")
+var bindAddr = flag.String("bind", "", "Web服务的监听地址，默认监听所有网卡，例如 127.0.0.1")
+var showIPv6 = flag.Bool("ipv6", false, "打印访问地址时包含本机的 IPv6 地址")
+var authMode = flag.String("auth", "none", "Web服务的认证方式: none、basic（用户名:密码）或 token（Bearer 令牌）")
+var authFile = flag.String("authFile", "", "保存认证信息的文件，basic 方式为 用户名:密码，token 方式为令牌；未指定时读取环境变量 "+authEnvVar)
+var useTLS = flag.Bool("tls", false, "Web服务启用 HTTPS，未指定 -tlsCert 和 -tlsKey 时使用自动生成的自签名证书")
+var tlsCert = flag.String("tlsCert", "", "HTTPS 证书文件（PEM）")
+var tlsKey = flag.String("tlsKey", "", "HTTPS 私钥文件（PEM）")
+var upload = flag.Bool("upload", false, "Web服务提供上传日志生成报告的页面和 POST /api/analyze 接口")
+var saveReport = flag.Bool("save", false, "Web服务模式下同时将 HTML 报告写入报告目录，默认只在内存中保留分析结果")
+var uploadLimit = flag.Int64("uploadLimit", 1024, "上传文件的大小上限（MB）")
+var collect = flag.Bool("collect", false, "Web服务接收各实例推送的分析结果，提供多实例汇总页面 /fleet")
+var pushURL = flag.String("push", "", "将分析结果推送给 -collect 模式的中心服务，例如 http://10.0.0.1:6033")
+var instanceName = flag.String("instance", "", "推送时使用的实例名，默认为主机名")
+var pushAuthFile = flag.String("pushAuthFile", "", "中心服务的认证信息，用户名:密码 使用 basic 认证，否则作为令牌；未指定时读取环境变量 "+pushAuthEnvVar)
+var pushCA = flag.String("pushCA", "", "中心服务的 CA 证书或自签名证书（PEM）")
+var follow = flag.Bool("follow", false, "Web服务模式下持续读取慢查询日志新增的记录，在实时监控页面中推送")
+var schedulePath = flag.String("schedule", "", "定时报告的配置文件，Web服务模式下按 cron 表达式定时分析日志")
+var scheduleKeep = flag.Int("scheduleKeep", 30, "每个定时报告保留的报告数，超过时删除最早的报告")
 
 // 自定义类型用于支持多个-f参数
 type arrayFlags []string
@@ -111,16 +247,26 @@ func hasDuplicate(items []string, target string) bool {
 	return false
 }
 
-type SlowSqlInfoSliceDecrement []SlowSqlInfo
-
-func (s SlowSqlInfoSliceDecrement) Len() int { return len(s) }
-
-func (s SlowSqlInfoSliceDecrement) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
-
-func (s SlowSqlInfoSliceDecrement) Less(i, j int) bool { 
-	time95i, _ := strconv.ParseFloat(s[i].Time95, 64)
-	time95j, _ := strconv.ParseFloat(s[j].Time95, 64)
-	return time95i > time95j 
+// 解析 -f 参数，支持 标签=路径 的形式；未指定标签时使用文件名作为标签
+func parseLogInputs(values []string) []logInput {
+	var inputs []logInput
+	derived := make(map[string]int)
+	for _, value := range values {
+		if label, path, ok := strings.Cut(value, "="); ok && label != "" && !strings.ContainsAny(label, "/\\") {
+			if _, err := os.Stat(value); err != nil {
+				inputs = append(inputs, logInput{Source: label, Path: path})
+				continue
+			}
+		}
+		// 不同目录下的同名文件使用序号区分
+		label := getBaseFileName(value)
+		derived[label]++
+		if n := derived[label]; n > 1 {
+			label = fmt.Sprintf("%s-%d", label, n)
+		}
+		inputs = append(inputs, logInput{Source: label, Path: value})
+	}
+	return inputs
 }
 
 func getBaseFileName(logPath string) string {
@@ -131,53 +277,169 @@ func getBaseFileName(logPath string) string {
 	return baseName
 }
 
-// 启动Web服务
-func startWebServer(port int, fileName string) {
-	// 创建一个文件服务器，提供当前目录下的文件访问
-	fs := http.FileServer(http.Dir("."))
-	http.Handle("/", fs)
+// 启动Web服务，提供内存中的分析结果和报告目录中生成的报告，reportPath 为本次生成的报告的访问路径。
+// 收到中断信号后等待进行中的请求和分析任务结束再返回，启动失败时返回错误
+func startWebServer(web webOptions, dir, reportPath string) error {
+	if web.Jobs != nil {
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+			defer cancel()
+			web.Jobs.shutdown(ctx)
+		}()
+	}
+	if web.Schedules != nil {
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+			defer cancel()
+			web.Schedules.shutdown(ctx)
+		}()
+	}
+	server, err := newReportServer(dir, web)
+	if err != nil {
+		return fmt.Errorf("创建Web服务失败: %w", err)
+	}
 
 	// 获取本机IP地址
-	addrs, err := getLocalIPs()
+	addrs := web.addrs()
+
+	// 先监听端口，端口被占用等错误在打印访问链接之前给出
+	listener, err := net.Listen("tcp", net.JoinHostPort(web.Bind, strconv.Itoa(web.Port)))
 	if err != nil {
-		printColoredInfo("red", "获取本机IP地址失败: %s", err.Error())
-		return
+		return fmt.Errorf("启动Web服务失败: %w", err)
+	}
+	httpServer := &http.Server{
+		Handler:           web.Auth.wrap(server.routes()),
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+	}
+	scheme := "http"
+	if web.TLS {
+		config, fingerprint, err := web.tlsConfig(addrs)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("生成 HTTPS 证书失败: %w", err)
+		}
+		httpServer.TLSConfig = config
+		listener = tls.NewListener(listener, config)
+		scheme = "https"
+		if fingerprint != "" {
+			printColoredInfo("yellow", "\n使用自签名证书，浏览器会提示证书不受信任，请核对证书的 SHA-256 指纹:\n%s", fingerprint)
+		}
 	}
 
 	// 打印访问链接
-	printColoredInfo("green", "\n报告可通过以下地址访问:")
+	if reportPath != "" {
+		printColoredInfo("green", "\n报告可通过以下地址访问:")
+		for _, addr := range addrs {
+			printColoredInfo("blue", "%s://%s/%s", scheme, net.JoinHostPort(addr, strconv.Itoa(web.Port)), reportPath)
+		}
+	}
+	printColoredInfo("green", "报告列表:")
+	for _, addr := range addrs {
+		printColoredInfo("blue", "%s://%s/", scheme, net.JoinHostPort(addr, strconv.Itoa(web.Port)))
+	}
+	printColoredInfo("green", "JSON 接口的 OpenAPI 描述:")
 	for _, addr := range addrs {
-		printColoredInfo("blue", "http://%s:%d/%s", addr, port, fileName)
+		printColoredInfo("blue", "%s://%s/api/openapi.json", scheme, net.JoinHostPort(addr, strconv.Itoa(web.Port)))
+	}
+	if web.Live != nil {
+		// 停止Web服务时断开实时监控的长连接，否则要等到超时才能停止
+		httpServer.RegisterOnShutdown(web.Live.close)
+		printColoredInfo("green", "实时监控:")
+		for _, addr := range addrs {
+			printColoredInfo("blue", "%s://%s/live", scheme, net.JoinHostPort(addr, strconv.Itoa(web.Port)))
+		}
+	}
+	if web.Fleet != nil {
+		printColoredInfo("green", "多实例汇总:")
+		for _, addr := range addrs {
+			printColoredInfo("blue", "%s://%s/fleet", scheme, net.JoinHostPort(addr, strconv.Itoa(web.Port)))
+		}
+	}
+	if web.Jobs != nil {
+		printColoredInfo("green", "上传日志:")
+		for _, addr := range addrs {
+			printColoredInfo("blue", "%s://%s/upload", scheme, net.JoinHostPort(addr, strconv.Itoa(web.Port)))
+		}
+	}
+	if !web.loopback() {
+		if web.Auth == nil {
+			printColoredInfo("yellow", "警告: Web服务未启用认证，能访问该端口的人都可以查看报告中的 SQL，建议使用 -auth 或 -bind 127.0.0.1")
+		} else if !web.TLS {
+			printColoredInfo("yellow", "警告: 认证信息以明文传输，建议同时使用 -tls 启用 HTTPS")
+		}
 	}
 	printColoredInfo("yellow", "按 Ctrl+C 停止Web服务\n")
 
-	// 启动HTTP服务
+	// 启动HTTP服务，等待中断信号或服务异常退出
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 1)
 	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
-			printColoredInfo("red", "启动Web服务失败: %s", err.Error())
-			os.Exit(1)
-		}
+		serveErr <- httpServer.Serve(listener)
 	}()
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("Web服务异常退出: %w", err)
+	case <-ctx.Done():
+	}
+	// 恢复默认的信号处理，停止过程中再次按 Ctrl+C 直接退出
+	stop()
 
-	// 等待中断信号
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	printColoredInfo("yellow", "\n正在停止Web服务，等待进行中的请求结束...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		httpServer.Close()
+		printColoredInfo("yellow", "等待请求结束超时，已强制关闭连接")
+	}
+	return nil
 }
 
-// 获取本机IP地址
-func getLocalIPs() ([]string, error) {
-	cmd := exec.Command("hostname", "-I")
-	output, err := cmd.Output()
+// 容器和虚拟网桥的网卡名前缀，这些网卡的地址无法从其他主机访问
+var virtualInterfacePrefixes = []string{"docker", "br-", "veth", "virbr", "cni", "flannel", "cali"}
+
+// 获取本机IP地址，跳过未启用的网卡、回环地址、链路本地地址和容器网卡，ipv6 为 false 时只返回 IPv4 地址
+func getLocalIPs(ipv6 bool) ([]string, error) {
+	interfaces, err := net.Interfaces()
 	if err != nil {
 		return nil, err
 	}
-	
-	// 分割并清理IP地址
-	ips := strings.Fields(string(output))
+	var ips []string
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || isVirtualInterface(iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipNet.IP
+			if ip.IsLoopback() || ip.IsLinkLocalUnicast() || (ip.To4() == nil && !ipv6) {
+				continue
+			}
+			ips = append(ips, ip.String())
+		}
+	}
 	return ips, nil
 }
 
+func isVirtualInterface(name string) bool {
+	for _, prefix := range virtualInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // 在 main 函数之前添加这个新函数
 func checkAndSetPermissions(filePath string) error {
 	// 检查文件是否存在
@@ -275,434 +537,328 @@ func formatMysqlTimestamp(timestamp string) string {
 	return t.Format("2006-01-02 15:04:05")
 }
 
+// 宽松模式下先用内置解析器找出格式异常的记录，将剔除这些记录后的副本交给 pt-query-digest 分析
+func runPtQueryDigestLenient(inputs []logInput, logPaths []string, start, end string, opts analysisOptions) (*Report, error) {
+	// 环境检查失败时直接退出，先检查可以避免遗留临时文件
+	checkSystemEnvironment()
+	checkPerlModules()
+
+	printColoredInfo("blue", "宽松模式: 正在检查格式异常的记录...")
+	malformed, err := scanMalformed(inputs)
+	if err != nil {
+		return nil, err
+	}
+	if len(malformed) == 0 {
+		return runPtQueryDigest(logPaths, start, end)
+	}
+	tempDir, err := os.MkdirTemp("", "slowsql-analysis-lenient")
+	if err != nil {
+		return nil, fmt.Errorf("创建临时目录失败: %s", err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	cleaned, err := writeCleanedCopies(tempDir, logPaths, malformed)
+	if err != nil {
+		return nil, err
+	}
+	report, err := runPtQueryDigest(cleaned, start, end)
+	if err != nil {
+		return nil, err
+	}
+	report.Global.ParseWarnings = buildParseWarnings(malformed, true)
+	if err := writeQuarantine(opts.Quarantine, malformed, opts.Redactor); err != nil {
+		return nil, fmt.Errorf("写入隔离文件失败: %w", err)
+	}
+	report.Global.ParseWarnings.Quarantine = opts.Quarantine
+	return report, nil
+}
+
+// 判断命令行中是否显式指定了某个参数
+func flagPassed(name string) bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
+
+// 解析命令行中的时间参数
+func parseTimeFlag(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("参数 -%s 格式错误，应为 yyyy-mm-dd HH:mm:ss: %s", name, value)
+	}
+	return t, nil
+}
+
 func main() {
 	execStartTime := time.Now()
-	
+
 	flag.Parse()
 
+	opts := analysisOptions{Workers: *workers, Samples: *sampleCount}
+	if opts.Samples < 1 {
+		printColoredInfo("red", "参数 -samples 错误: 至少为 1")
+		os.Exit(1)
+	}
+	var err error
+	web := webOptions{Port: *port, Bind: *bindAddr, IPv6: *showIPv6, TLS: *useTLS || *tlsCert != "", TLSCert: *tlsCert, TLSKey: *tlsKey}
+	if *port > 0 {
+		// 在分析之前检查Web服务的配置，避免分析完成后才发现证书或认证信息有误
+		if web.Auth, err = loadServerAuth(*authMode, *authFile); err != nil {
+			printColoredInfo("red", "参数 -auth 错误: %s", err.Error())
+			os.Exit(1)
+		}
+		if err := web.check(); err != nil {
+			printColoredInfo("red", "HTTPS 配置错误: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	if *collect && *port == 0 {
+		printColoredInfo("red", "参数 -collect 需要同时指定 -port")
+		os.Exit(1)
+	}
+	var push *pushTarget
+	if *pushURL != "" {
+		// 在分析之前检查推送参数，避免分析完成后才发现地址或认证信息有误
+		name := *instanceName
+		if name == "" {
+			name = defaultInstanceName()
+		}
+		if push, err = newPushTarget(*pushURL, name, *pushAuthFile, *pushCA); err != nil {
+			printColoredInfo("red", "参数 -push 错误: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	if opts.PgPrefix, err = compilePgLinePrefix(*pgPrefix); err != nil {
+		printColoredInfo("red", "参数 -pgPrefix 错误: %s", err.Error())
+		os.Exit(1)
+	}
+	if opts.Redactor, err = newSQLRedactor(*redactLevel, *redactRulesFile); err != nil {
+		printColoredInfo("red", "参数 -redact 错误: %s", err.Error())
+		os.Exit(1)
+	}
+	opts.Lenient = *lenient
+	opts.Quarantine = *quarantinePath
+	if err := os.MkdirAll(*reportDir, 0755); err != nil {
+		printColoredInfo("red", "创建报告目录失败: %s", err.Error())
+		os.Exit(1)
+	}
+	request := reportRequest{
+		Format:       *inputFormat,
+		Parser:       *parserName,
+		Baselines:    parseLogInputs(baselineAddresses),
+		StartTime:    *startTime,
+		EndTime:      *endTime,
+		ServerPort:   *serverPort,
+		Sort:         *sortKey,
+		SortExplicit: flagPassed("sort"),
+		Export:       *exportFormats,
+		SaveHTML:     *port == 0 && push == nil || *saveReport,
+		Options:      opts,
+	}
+	if *port > 0 {
+		if web.Analyses, err = newAnalysisStore(*reportDir, *redactRulesFile); err != nil {
+			printColoredInfo("red", "参数 -redactRules 错误: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	if *collect {
+		if web.Fleet, err = newFleetStore(*reportDir); err != nil {
+			printColoredInfo("red", "读取实例的分析结果失败: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	if *port > 0 && *upload {
+		if *uploadLimit < 1 {
+			printColoredInfo("red", "参数 -uploadLimit 错误: 至少为 1")
+			os.Exit(1)
+		}
+		// 上传的日志使用命令行中的参数作为默认值，时间范围由上传时指定
+		defaults := request
+		defaults.StartTime, defaults.EndTime = "", ""
+		defaults.Options.Quarantine = ""
+		if web.Jobs, err = newJobManager(*reportDir, defaults, *uploadLimit<<20, web.Analyses); err != nil {
+			printColoredInfo("red", "创建上传目录失败: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if *follow && (*port == 0 || len(logAddresses) == 0) {
+		printColoredInfo("red", "参数 -follow 需要同时指定 -port 和 -f")
+		os.Exit(1)
+	}
+	if *follow && *endTime != "" {
+		printColoredInfo("red", "参数 -follow 不能与 -endTime 同时使用")
+		os.Exit(1)
+	}
+	if *schedulePath != "" && (*port == 0 || len(logAddresses) == 0) {
+		printColoredInfo("red", "参数 -schedule 需要同时指定 -port 和 -f")
+		os.Exit(1)
+	}
+	if *scheduleKeep < 1 {
+		printColoredInfo("red", "参数 -scheduleKeep 错误: 至少为 1")
+		os.Exit(1)
+	}
+
+	if len(logAddresses) == 0 && *port > 0 {
+		// 没有指定日志文件时只启动Web服务，查看已有的报告或上传日志
+		if err := startWebServer(web, *reportDir, ""); err != nil {
+			printColoredInfo("red", "%s", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(logAddresses) == 0 {
 		printColoredInfo("blue", "使用方法: ./slowsql-analysis -f <慢查询日志路径1> [-f <慢查询日志路径2> ...] [-port <端口>]")
 		printColoredInfo("blue", "示例: ./slowsql-analysis -f /var/log/mysql-slow1.log -f /var/log/mysql-slow2.log -port 6033")
 		printColoredInfo("yellow", "请输入慢查询日志文件路径: ")
-		
+
 		// 读取用户输入
 		var input string
 		fmt.Scanln(&input)
-		
+
 		if input == "" {
 			os.Exit(1)
 		}
-		
+
 		logAddresses = append(logAddresses, input)
 	}
 
+	inputs := parseLogInputs(logAddresses)
+	if *sourceFilter != "" {
+		var filtered []logInput
+		for _, input := range inputs {
+			if input.Source == *sourceFilter {
+				filtered = append(filtered, input)
+			}
+		}
+		if len(filtered) == 0 {
+			printColoredInfo("red", "没有来源标签为 %s 的日志文件", *sourceFilter)
+			os.Exit(1)
+		}
+		inputs = filtered
+	}
+	var logPaths []string
+	for _, input := range inputs {
+		logPaths = append(logPaths, input.Path)
+	}
+	if *schedulePath != "" {
+		// 定时报告使用命令行中的参数，时间范围由时间窗口决定
+		defaults := request
+		defaults.StartTime, defaults.EndTime = "", ""
+		defaults.Options.Quarantine = ""
+		if web.Schedules, err = newReportScheduler(*schedulePath, inputs, defaults, *scheduleKeep, *reportDir, web.Analyses); err != nil {
+			printColoredInfo("red", "参数 -schedule 错误: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
 	printDivider()
 	printColoredInfo("blue", "开始分析慢查询日志...")
-	for i, logAddress := range logAddresses {
-		printColoredInfo("blue", "日志文件%d: %s", i+1, logAddress)
+	for i, input := range inputs {
+		printColoredInfo("blue", "日志文件%d: [%s] %s", i+1, input.Source, input.Path)
 	}
 	if *startTime != "" && *endTime != "" {
 		printColoredInfo("blue", "分析时间范围: %s 至 %s", *startTime, *endTime)
 	}
 	printDivider()
 
-	// 检查系统环境
-	checkSystemEnvironment()
-	
-	// 检查 Perl 模块
-	checkPerlModules()
-
-	// 创建临时目录
-	tempDir, err := os.MkdirTemp("", "slowsql-analysis")
-	if err != nil {
-		printColoredInfo("red", "创建临时目录失败: %s", err.Error())
-		os.Exit(1)
-	}
-	defer os.RemoveAll(tempDir)
-
-	// 将pt-query-digest写入临时目录
-	ptQueryDigestPath := filepath.Join(tempDir, "pt-query-digest")
-	err = os.WriteFile(ptQueryDigestPath, ptQueryDigest, 0755)
-	if err != nil {
-		printColoredInfo("red", "写入pt-query-digest失败: %s", err.Error())
-		os.Exit(1)
-	}
-
-	// 检查并设置权限
-	if err := checkAndSetPermissions(ptQueryDigestPath); err != nil {
-		printColoredInfo("red", "权限检查失败: %s", err)
-		os.Exit(1)
-	}
-
 	// 检查所有日志文件是否存在
-	for _, logAddress := range logAddresses {
+	for _, logAddress := range logPaths {
 		if _, err := os.Stat(logAddress); os.IsNotExist(err) {
 			printColoredInfo("red", "日志文件不存在: %s", logAddress)
 			os.Exit(1)
 		}
 	}
 
-	var ptCmd string
-	if *startTime == "" || *endTime == "" {
-		ptCmd = fmt.Sprintf("%s %s --output json --noversion-check --progress time,1 --charset=utf8mb4 >mysql_slow.json", ptQueryDigestPath, strings.Join(logAddresses, " "))
-	} else {
-		ptCmd = fmt.Sprintf("%s %s --output json --noversion-check --set-vars time_zone='+8:00' --progress time,1 --charset=utf8mb4 --since='%s' --until='%s' >mysql_slow.json", ptQueryDigestPath, strings.Join(logAddresses, " "), *startTime, *endTime)
-	}
-
-	printColoredInfo("yellow", "正在执行日志分析...")
-	cmd := exec.Command("/bin/bash", "-c", ptCmd)
-	
-	// 捕获标准错误输出
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	
-	if err := cmd.Run(); err != nil {
-		if _, ok := err.(*exec.ExitError); ok {
-			printColoredInfo("red", "分析过程出错: %v", err)
-			printColoredInfo("yellow", "详细错误信息:")
-			printColoredInfo("red", "1. 请检查日志文件权限是否正确")
-			printColoredInfo("red", "2. 请检查是否有执行权限")
-			printColoredInfo("red", "3. 如果是SELinux相关问题，可以尝试临时关闭: sudo setenforce 0")
-			printColoredInfo("red", "4. 使用 strace 命令查看详细错误: strace ./slowsql-analysis-linux-amd64 -port 6033 -f mysql-slow.log")
-		} else {
-			printColoredInfo("red", "执行命令失败: %v", err)
-		}
-		os.Exit(1)
-	}
-
-	// 生成输出文件名
-	currentTime := time.Now().Format("2006-01-02-15-04")
-	fileName := fmt.Sprintf("slowsql-analysis-%s.html", currentTime)
-
-	printColoredInfo("yellow", "正在生成分析报告: %s", fileName)
-
-	newFile, err := os.Create(fileName)
-	if err != nil {
-		printColoredInfo("red", "创建报告文件失败: %s", err.Error())
-		os.Exit(1)
-	}
-
-	file, err := os.Open("mysql_slow.json")
-	if err != nil {
-		printColoredInfo("red", "打开分析结果失败: %s", err.Error())
-		os.Exit(1)
-	}
-	defer file.Close()
-
-	var report Report
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&report)
-	if err != nil {
-		printColoredInfo("red", "解析JSON数据失败: %s", err.Error())
-		os.Exit(1)
-	}
+	// 分析之前先识别所有文件的格式，文件不对时尽早给出明确的错误，而不是生成一份空报告
+	printColoredInfo("yellow", "正在识别日志格式...")
 
-	var slowSqlInfos []SlowSqlInfo
-	allSqlInfo := report.Classes
-
-	printColoredInfo("yellow", "正在处理查询信息...")
-	for _, sqlInfo := range allSqlInfo {
-		var allTables []string
-		var slowSqlInfo SlowSqlInfo
-		for _, slowTable := range sqlInfo.Tables {
-			s := strings.Split(slowTable.Create, ".")
-			re := regexp.MustCompile("`([^`]+)`")
-			match := re.FindStringSubmatch(s[1])
-			tableName := match[1]
-			flag := hasDuplicate(allTables, tableName)
-			if !flag {
-				allTables = append(allTables, tableName)
-			}
-		}
-		slowSqlInfo.RowsSum = sqlInfo.Metrics.RowsExamined.Sum
-		slowSqlInfo.RowsMax = sqlInfo.Metrics.RowsExamined.Max
-		slowSqlInfo.LengthSum = sqlInfo.Metrics.QueryLength.Sum
-		slowSqlInfo.LengthMax = sqlInfo.Metrics.QueryLength.Max
-		slowSqlInfo.TimeMax = sqlInfo.Metrics.QueryTime.Max
-		slowSqlInfo.TimeMin = sqlInfo.Metrics.QueryTime.Min
-		slowSqlInfo.Time95 = sqlInfo.Metrics.QueryTime.Pct95
-		slowSqlInfo.TimeMedian = sqlInfo.Metrics.QueryTime.Median
-		slowSqlInfo.RowSendMax = sqlInfo.Metrics.RowsSent.Max
-		slowSqlInfo.QueryDb = sqlInfo.Metrics.Db.Value
-		slowSqlInfo.QueryCount = sqlInfo.QueryCount
-		slowSqlInfo.Sql = sqlInfo.Example.Query
-		slowSqlInfo.QueryTables = allTables
-		slowSqlInfo.Id = sqlInfo.Checksum
-		slowSqlInfo.User = sqlInfo.Metrics.User.Value
-		slowSqlInfo.Host = sqlInfo.Metrics.Host.Value
-		slowSqlInfo.LockTimeMax = sqlInfo.Metrics.LockTime.Max
-		slowSqlInfo.LockTimeMin = sqlInfo.Metrics.LockTime.Min
-		slowSqlInfo.LockTime95 = sqlInfo.Metrics.LockTime.Pct95
-		slowSqlInfo.QueryId = sqlInfo.Example.Id
-		slowSqlInfo.Timestamp = sqlInfo.Example.Ts
-		slowSqlInfos = append(slowSqlInfos, slowSqlInfo)
-	}
-
-	sort.Sort(SlowSqlInfoSliceDecrement(slowSqlInfos))
-
-	// 创建报告数据
-	reportData := ReportData{
-		GenerateTime: time.Now().Format("2006-01-02 15:04:05"),
-		SlowQueries:  slowSqlInfos,
-		LogFiles:     logAddresses,
-	}
-
-	// 从所有查询中找出最早和最晚的时间
-	if len(report.Classes) > 0 {
-		minTime := report.Classes[0].TsMin
-		maxTime := report.Classes[0].TsMax
-		
-		for _, class := range report.Classes {
-			if class.TsMin < minTime {
-				minTime = class.TsMin
-			}
-			if class.TsMax > maxTime {
-				maxTime = class.TsMax
-			}
+	if *follow {
+		// 在分析之前记录文件的大小，分析期间新增的记录同样会推送到实时监控页面
+		if web.Live, err = newLiveMonitor(inputs, opts.Redactor); err != nil {
+			printColoredInfo("red", "读取日志文件失败: %s", err.Error())
+			os.Exit(1)
 		}
-		
-		reportData.StartTime = formatMysqlTimestamp(minTime)
-		reportData.EndTime = formatMysqlTimestamp(maxTime)
-	}
-
-	// 添加自定义模板函数
-	funcMap := template.FuncMap{
-		"float64": func(s string) float64 {
-			f, _ := strconv.ParseFloat(s, 64)
-			return f
-		},
-		"mul": func(a, b float64) float64 {
-			return a * b
-		},
-		"int64": func(i int64) int64 {
-			return i
-		},
-		"formatTime": func(s string) string {
-			t, _ := strconv.ParseFloat(s, 64)
-			switch {
-			case t >= 1:
-				return fmt.Sprintf("%.2fs", t)
-			case t >= 0.001:
-				return fmt.Sprintf("%.0fms", t*1000)
-			default:
-				return fmt.Sprintf("%.0fμs", t*1000000)
-			}
-		},
-		"join": func(arr []string, sep string) string {
-			return strings.Join(arr, sep)
-		},
-		"add": func(a, b int) int {
-			return a + b
-		},
-	}
-
-	printColoredInfo("yellow", "正在生成HTML报告...")
-	
-	// 使用嵌入的模板文件
-	tmplContent, err := templateFS.ReadFile("template/template.html")
-	if err != nil {
-		printColoredInfo("red", "读取模板文件失败: %s", err.Error())
-		os.Exit(1)
 	}
 
-	tmpl, err := template.New("template.html").Funcs(funcMap).Parse(string(tmplContent))
-	if err != nil {
-		printColoredInfo("red", "创建HTML模板失败: %s", err.Error())
-		os.Exit(1)
-	}
-
-	err = tmpl.Execute(newFile, reportData)
+	// 生成输出文件名
+	request.Inputs = inputs
+	request.FileName = newReportFileName(*reportDir, time.Now())
+	result, err := generateReport(request)
 	if err != nil {
-		printColoredInfo("red", "生成HTML报告失败: %s", err.Error())
+		printColoredInfo("red", "%s", err.Error())
 		os.Exit(1)
 	}
-
-	// 清理临时文件
-	os.Remove("mysql_slow.json")
+	reportData := result.Data
 
 	printDivider()
 	printColoredInfo("green", "分析完成!")
 	printColoredInfo("blue", "统计信息:")
-	printColoredInfo("blue", "- 分析的日志文件数: %d", len(logAddresses))
-	printColoredInfo("blue", "- 总分析SQL数: %d", len(slowSqlInfos))
+	printColoredInfo("blue", "- 分析的日志文件数: %d", len(logPaths))
+	printColoredInfo("blue", "- 总分析SQL数: %d", len(reportData.SlowQueries))
+	if result.KilledCount > 0 || result.ErrorCount > 0 {
+		printColoredInfo("yellow", "- 被终止的查询: %d，执行出错的查询: %d", result.KilledCount, result.ErrorCount)
+	}
+	if w := reportData.ParseWarnings; w != nil {
+		printColoredInfo("yellow", "- 格式异常的记录: %d（%s，占 %s），未参与统计: %d", w.Entries, w.Size, w.Pct, w.Dropped)
+		if w.Quarantine != "" {
+			printColoredInfo("yellow", "- 隔离文件: %s", w.Quarantine)
+		} else if !w.Lenient {
+			printColoredInfo("yellow", "  可使用 -lenient 跳过这些记录并保存到隔离文件中")
+		}
+	}
 	printColoredInfo("blue", "- 分析耗时: %.2f秒", time.Since(execStartTime).Seconds())
 	printColoredInfo("blue", "- 日志时间范围: %s 至 %s", reportData.StartTime, reportData.EndTime)
-	printColoredInfo("blue", "- 报告文件: %s", fileName)
+	if result.FileName != "" {
+		printColoredInfo("blue", "- 报告文件: %s", result.FileName)
+	} else if *port > 0 {
+		printColoredInfo("blue", "- 报告: 只保留在Web服务的内存中，按请求生成（使用 -save 同时写入报告目录）")
+	} else {
+		printColoredInfo("blue", "- 报告: 未在本机生成 HTML 报告（使用 -save 同时写入报告目录）")
+	}
+	for _, exportFile := range result.ExportFiles {
+		printColoredInfo("blue", "- 导出文件: %s", exportFile)
+	}
+	if push != nil {
+		if err := push.push(reportData); err != nil {
+			printColoredInfo("red", "推送分析结果失败: %s", err.Error())
+			os.Exit(1)
+		}
+		printColoredInfo("blue", "- 已推送到中心服务: %s（实例 %s）", push.Url.Redacted(), push.Instance)
+	}
 	printDivider()
 
 	// 在生成报告后，如果指定了端口，启动Web服务
 	if *port > 0 {
-		startWebServer(*port, fileName)
-	} else {
+		web.Analyses.add(result)
+		if web.Live != nil {
+			if err := web.Live.check(result.detected); err != nil {
+				printColoredInfo("red", "参数 -follow 错误: %s", err.Error())
+				os.Exit(1)
+			}
+			web.Live.Analysis = result.Id
+			web.Live.start()
+			printColoredInfo("green", "正在监控日志文件新增的记录")
+		}
+		if web.Schedules != nil {
+			web.Schedules.start()
+			for _, schedule := range web.Schedules.list() {
+				printColoredInfo("green", "定时报告 %s: %s %s，下次执行: %s", schedule.Name, schedule.Spec, schedule.Window, schedule.Next.Format("2006-01-02 15:04"))
+			}
+		}
+		if err := startWebServer(web, *reportDir, "analyses/"+result.Id); err != nil {
+			printColoredInfo("red", "%s", err.Error())
+			os.Exit(1)
+		}
+	} else if push == nil {
 		printColoredInfo("blue", "\n提示: 使用 -port 参数可启动Web服务访问报告")
 		printColoredInfo("blue", "示例: ./slowsql-analysis -f %s -port 6033\n", strings.Join(logAddresses, " -f "))
 	}
 }
-
-type Report struct {
-	Global struct {
-		UniqueQueryCount int `json:"unique_query_count"`
-		Files            []struct {
-			Name string `json:"name"`
-			Size int    `json:"size"`
-		} `json:"files"`
-		QueryCount int `json:"query_count"`
-		TsMin      string `json:"ts_min"`
-		TsMax      string `json:"ts_max"`
-		Metrics    struct {
-			QueryLength struct {
-				Sum    string `json:"sum"`
-				Stddev string `json:"stddev"`
-				Min    string `json:"min"`
-				Avg    string `json:"avg"`
-				Median string `json:"median"`
-				Max    string `json:"max"`
-				Pct95  string `json:"pct_95"`
-			} `json:"Query_length"`
-			LockTime struct {
-				Pct95  string `json:"pct_95"`
-				Max    string `json:"max"`
-				Median string `json:"median"`
-				Avg    string `json:"avg"`
-				Min    string `json:"min"`
-				Stddev string `json:"stddev"`
-				Sum    string `json:"sum"`
-			} `json:"Lock_time"`
-			RowsExamined struct {
-				Avg    string `json:"avg"`
-				Min    string `json:"min"`
-				Median string `json:"median"`
-				Max    string `json:"max"`
-				Pct95  string `json:"pct_95"`
-				Sum    string `json:"sum"`
-				Stddev string `json:"stddev"`
-			} `json:"Rows_examined"`
-			RowsSent struct {
-				Max    string `json:"max"`
-				Pct95  string `json:"pct_95"`
-				Avg    string `json:"avg"`
-				Min    string `json:"min"`
-				Median string `json:"median"`
-				Sum    string `json:"sum"`
-				Stddev string `json:"stddev"`
-			} `json:"Rows_sent"`
-			QueryTime struct {
-				Median string `json:"median"`
-				Min    string `json:"min"`
-				Avg    string `json:"avg"`
-				Pct95  string `json:"pct_95"`
-				Max    string `json:"max"`
-				Stddev string `json:"stddev"`
-				Sum    string `json:"sum"`
-			} `json:"Query_time"`
-		} `json:"metrics"`
-	} `json:"global"`
-	Classes []struct {
-		Distillate string `json:"distillate"`
-		Example    struct {
-			QueryTime string `json:"Query_time"`
-			Query     string `json:"query"`
-			Ts        string `json:"ts"`
-			AsSelect  string `json:"as_select,omitempty"`
-			Id        string `json:"Id,omitempty"`
-		} `json:"example"`
-		Histograms struct {
-			QueryTime []int `json:"Query_time"`
-		} `json:"histograms"`
-		Fingerprint string `json:"fingerprint"`
-		Metrics     struct {
-			LockTime struct {
-				Pct    string `json:"pct"`
-				Stddev string `json:"stddev"`
-				Sum    string `json:"sum"`
-				Pct95  string `json:"pct_95"`
-				Max    string `json:"max"`
-				Median string `json:"median"`
-				Avg    string `json:"avg"`
-				Min    string `json:"min"`
-			} `json:"Lock_time"`
-			QueryLength struct {
-				Pct    string `json:"pct"`
-				Stddev string `json:"stddev"`
-				Sum    string `json:"sum"`
-				Pct95  string `json:"pct_95"`
-				Max    string `json:"max"`
-				Median string `json:"median"`
-				Avg    string `json:"avg"`
-				Min    string `json:"min"`
-			} `json:"Query_length"`
-			RowsSent struct {
-				Max    string `json:"max"`
-				Pct95  string `json:"pct_95"`
-				Avg    string `json:"avg"`
-				Min    string `json:"min"`
-				Median string `json:"median"`
-				Pct    string `json:"pct"`
-				Sum    string `json:"sum"`
-				Stddev string `json:"stddev"`
-			} `json:"Rows_sent"`
-			User struct {
-				Value string `json:"value"`
-			} `json:"user"`
-			Db struct {
-				Value string `json:"value"`
-			} `json:"db,omitempty"`
-			RowsExamined struct {
-				Median string `json:"median"`
-				Min    string `json:"min"`
-				Avg    string `json:"avg"`
-				Pct95  string `json:"pct_95"`
-				Max    string `json:"max"`
-				Stddev string `json:"stddev"`
-				Sum    string `json:"sum"`
-				Pct    string `json:"pct"`
-			} `json:"Rows_examined"`
-			Host struct {
-				Value string `json:"value"`
-			} `json:"host"`
-			QueryTime struct {
-				Avg    string `json:"avg"`
-				Min    string `json:"min"`
-				Median string `json:"median"`
-				Max    string `json:"max"`
-				Pct95  string `json:"pct_95"`
-				Sum    string `json:"sum"`
-				Stddev string `json:"stddev"`
-				Pct    string `json:"pct"`
-			} `json:"Query_time"`
-		} `json:"metrics"`
-		TsMin      string `json:"ts_min"`
-		Attribute  string `json:"attribute"`
-		TsMax      string `json:"ts_max"`
-		Checksum   string `json:"checksum"`
-		QueryCount int    `json:"query_count"`
-		Tables     []struct {
-			Status string `json:"status"`
-			Create string `json:"create"`
-		} `json:"tables,omitempty"`
-	} `json:"classes"`
-}
-
-type SlowSqlInfo struct {
-	Id          string
-	RowsSum     string
-	RowsMax     string
-	LengthSum   string
-	LengthMax   string
-	TimeMax     string
-	TimeMin     string
-	Time95      string
-	TimeMedian  string
-	RowSendMax  string
-	QueryDb     string
-	QueryCount  int
-	QueryTables []string
-	Sql         string
-	User        string
-	Host        string
-	LockTimeMax string
-	LockTimeMin string
-	LockTime95  string
-	QueryId     string
-	Timestamp   string
-}
\ No newline at end of file
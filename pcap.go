@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+)
+
+// pcap/pcapng 文件中的链路层类型
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRawOld   = 12
+	linkTypeRaw      = 101
+	linkTypeLoop     = 108
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+)
+
+// pcap 文件头标记，分别对应微秒和纳秒精度的时间戳
+const (
+	pcapMagicMicroseconds = 0xA1B2C3D4
+	pcapMagicNanoseconds  = 0xA1B23C4D
+	pcapMaxPacketSize     = 256 << 10
+)
+
+// pcapng 的块类型
+const (
+	pcapngSectionHeader  = 0x0A0D0D0A
+	pcapngInterfaceBlock = 0x00000001
+	pcapngPacket         = 0x00000002
+	pcapngSimplePacket   = 0x00000003
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1A2B3C4D
+	pcapngOptionTsresol  = 9
+	pcapngMaxBlockSize   = 16 << 20
+)
+
+// capturePacket 抓包文件中的一个数据包
+type capturePacket struct {
+	Ts       time.Time
+	LinkType uint32
+	Data     []byte
+}
+
+// pcapngInterface pcapng 中的一个抓包接口
+type pcapngInterface struct {
+	linkType uint32
+	// 时间戳单位，tsDiv 为 10^n 或 2^n，表示一秒包含的单位数
+	tsDiv uint64
+}
+
+// captureReader 顺序读取 pcap 或 pcapng 文件中的数据包
+type captureReader struct {
+	r      *bufio.Reader
+	ng     bool
+	order  binary.ByteOrder
+	nano   bool
+	link   uint32
+	ifaces []pcapngInterface
+	lastTs time.Time
+}
+
+func newCaptureReader(r io.Reader) (*captureReader, error) {
+	c := &captureReader{r: bufio.NewReaderSize(r, 1<<16)}
+	magic, err := c.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("不是 pcap/pcapng 文件: %w", err)
+	}
+	if binary.BigEndian.Uint32(magic) == pcapngSectionHeader {
+		c.ng = true
+		return c, nil
+	}
+
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return nil, fmt.Errorf("pcap 文件头不完整: %w", err)
+	}
+	switch {
+	case binary.LittleEndian.Uint32(header) == pcapMagicMicroseconds:
+		c.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(header) == pcapMagicMicroseconds:
+		c.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(header) == pcapMagicNanoseconds:
+		c.order, c.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(header) == pcapMagicNanoseconds:
+		c.order, c.nano = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("不是 pcap/pcapng 文件，文件头: % x", header[:4])
+	}
+	c.link = c.order.Uint32(header[20:]) & 0x0FFFFFFF
+	return c, nil
+}
+
+// 读取下一个数据包，文件结束时返回 io.EOF
+func (c *captureReader) next() (*capturePacket, error) {
+	if c.ng {
+		return c.nextBlock()
+	}
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// 抓包被中断时最后一个数据包可能不完整
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	sec := int64(c.order.Uint32(header))
+	frac := int64(c.order.Uint32(header[4:]))
+	capLen := c.order.Uint32(header[8:])
+	if capLen > pcapMaxPacketSize {
+		return nil, fmt.Errorf("数据包长度异常: %d", capLen)
+	}
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, io.EOF
+	}
+	if !c.nano {
+		frac *= 1000
+	}
+	return &capturePacket{Ts: time.Unix(sec, frac), LinkType: c.link, Data: data}, nil
+}
+
+// 按 pcapng 接口的时间戳精度换算时间
+func (c *captureReader) pcapngTime(iface int, high, low uint32) time.Time {
+	div := uint64(1000000)
+	if iface < len(c.ifaces) {
+		div = c.ifaces[iface].tsDiv
+	}
+	units := uint64(high)<<32 | uint64(low)
+	sec := units / div
+	nsec := (units % div) * 1000000000 / div
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+func (c *captureReader) nextBlock() (*capturePacket, error) {
+	for {
+		head := make([]byte, 8)
+		if _, err := io.ReadFull(c.r, head); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		blockType := binary.BigEndian.Uint32(head)
+		if blockType == pcapngSectionHeader {
+			// 每个 Section Header 都可能改变字节序，接口列表也随之重置
+			magic, err := c.r.Peek(4)
+			if err != nil {
+				return nil, io.EOF
+			}
+			if binary.LittleEndian.Uint32(magic) == pcapngByteOrderMagic {
+				c.order = binary.LittleEndian
+			} else if binary.BigEndian.Uint32(magic) == pcapngByteOrderMagic {
+				c.order = binary.BigEndian
+			} else {
+				return nil, fmt.Errorf("pcapng 字节序标记无效: % x", magic)
+			}
+			c.ifaces = nil
+		} else if c.order == nil {
+			return nil, errors.New("pcapng 文件缺少 Section Header Block")
+		} else {
+			blockType = c.order.Uint32(head)
+		}
+
+		total := c.order.Uint32(head[4:])
+		if total < 12 || total%4 != 0 || total > pcapngMaxBlockSize {
+			return nil, fmt.Errorf("pcapng 块长度异常: %d", total)
+		}
+		body := make([]byte, total-8)
+		if _, err := io.ReadFull(c.r, body); err != nil {
+			return nil, io.EOF
+		}
+		body = body[:len(body)-4]
+
+		switch blockType {
+		case pcapngInterfaceBlock:
+			if len(body) < 8 {
+				continue
+			}
+			iface := pcapngInterface{
+				linkType: uint32(c.order.Uint16(body)),
+				tsDiv:    1000000,
+			}
+			for opts := body[8:]; len(opts) >= 4; {
+				code := c.order.Uint16(opts)
+				length := int(c.order.Uint16(opts[2:]))
+				if code == 0 || 4+length > len(opts) {
+					break
+				}
+				if code == pcapngOptionTsresol && length >= 1 {
+					res := opts[4]
+					iface.tsDiv = 1
+					for i := 0; i < int(res&0x7F); i++ {
+						if res&0x80 != 0 {
+							iface.tsDiv *= 2
+						} else {
+							iface.tsDiv *= 10
+						}
+					}
+				}
+				opts = opts[4+(length+3)&^3:]
+			}
+			c.ifaces = append(c.ifaces, iface)
+		case pcapngEnhancedPacket:
+			if len(body) < 20 {
+				continue
+			}
+			id := int(c.order.Uint32(body))
+			capLen := int(c.order.Uint32(body[12:]))
+			if id >= len(c.ifaces) || 20+capLen > len(body) {
+				continue
+			}
+			ts := c.pcapngTime(id, c.order.Uint32(body[4:]), c.order.Uint32(body[8:]))
+			c.lastTs = ts
+			return &capturePacket{Ts: ts, LinkType: c.ifaces[id].linkType, Data: body[20 : 20+capLen]}, nil
+		case pcapngPacket:
+			if len(body) < 20 {
+				continue
+			}
+			id := int(c.order.Uint16(body))
+			capLen := int(c.order.Uint32(body[12:]))
+			if id >= len(c.ifaces) || 20+capLen > len(body) {
+				continue
+			}
+			ts := c.pcapngTime(id, c.order.Uint32(body[4:]), c.order.Uint32(body[8:]))
+			c.lastTs = ts
+			return &capturePacket{Ts: ts, LinkType: c.ifaces[id].linkType, Data: body[20 : 20+capLen]}, nil
+		case pcapngSimplePacket:
+			// Simple Packet Block 没有时间戳，使用上一个数据包的时间
+			if len(body) < 4 || len(c.ifaces) == 0 {
+				continue
+			}
+			data := body[4:]
+			origLen := int(c.order.Uint32(body))
+			if origLen < len(data) {
+				data = data[:origLen]
+			}
+			return &capturePacket{Ts: c.lastTs, LinkType: c.ifaces[0].linkType, Data: data}, nil
+		}
+	}
+}
+
+// tcpSegment 从数据包中解析出的 TCP 报文段
+type tcpSegment struct {
+	Ts      time.Time
+	Src     netip.AddrPort
+	Dst     netip.AddrPort
+	Seq     uint32
+	SYN     bool
+	FIN     bool
+	RST     bool
+	Payload []byte
+}
+
+// 从链路层数据中解析 TCP 报文段，非 TCP 数据包或分片返回 false
+func decodeTCPSegment(pkt *capturePacket) (*tcpSegment, bool) {
+	data := pkt.Data
+	var etherType uint16
+	switch pkt.LinkType {
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType = binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		// 802.1Q / 802.1ad VLAN 标签
+		for (etherType == 0x8100 || etherType == 0x88A8) && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		etherType = binary.BigEndian.Uint16(data[14:])
+		data = data[16:]
+	case linkTypeSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		etherType = binary.BigEndian.Uint16(data)
+		data = data[20:]
+	case linkTypeNull, linkTypeLoop:
+		if len(data) < 4 {
+			return nil, false
+		}
+		// 协议族使用抓包主机的字节序，IPv6 在不同系统上取值不同
+		family := binary.LittleEndian.Uint32(data)
+		if pkt.LinkType == linkTypeLoop || family > 0xFFFF {
+			family = binary.BigEndian.Uint32(data)
+		}
+		switch family {
+		case 2:
+			etherType = 0x0800
+		case 10, 24, 28, 30:
+			etherType = 0x86DD
+		}
+		data = data[4:]
+	case linkTypeRaw, linkTypeRawOld, linkTypeIPv4, linkTypeIPv6:
+		if len(data) == 0 {
+			return nil, false
+		}
+		switch data[0] >> 4 {
+		case 4:
+			etherType = 0x0800
+		case 6:
+			etherType = 0x86DD
+		}
+	default:
+		return nil, false
+	}
+
+	var src, dst netip.Addr
+	switch etherType {
+	case 0x0800:
+		if len(data) < 20 || data[0]>>4 != 4 {
+			return nil, false
+		}
+		ihl := int(data[0]&0x0F) * 4
+		total := int(binary.BigEndian.Uint16(data[2:]))
+		// 分片的数据包不做重组，MySQL 流量通常不会出现 IP 分片
+		if ihl < 20 || data[9] != 6 || binary.BigEndian.Uint16(data[6:])&0x3FFF != 0 {
+			return nil, false
+		}
+		if total >= ihl && total < len(data) {
+			// 去掉以太网帧的填充字节
+			data = data[:total]
+		}
+		if len(data) < ihl {
+			return nil, false
+		}
+		src = netip.AddrFrom4([4]byte(data[12:16]))
+		dst = netip.AddrFrom4([4]byte(data[16:20]))
+		data = data[ihl:]
+	case 0x86DD:
+		if len(data) < 40 || data[0]>>4 != 6 {
+			return nil, false
+		}
+		payloadLen := int(binary.BigEndian.Uint16(data[4:]))
+		next := data[6]
+		src = netip.AddrFrom16([16]byte(data[8:24])).Unmap()
+		dst = netip.AddrFrom16([16]byte(data[24:40])).Unmap()
+		data = data[40:]
+		if payloadLen < len(data) {
+			data = data[:payloadLen]
+		}
+		// 跳过逐跳选项、路由和目的选项扩展头
+		for (next == 0 || next == 43 || next == 60) && len(data) >= 8 {
+			length := (int(data[1]) + 1) * 8
+			if length > len(data) {
+				return nil, false
+			}
+			next = data[0]
+			data = data[length:]
+		}
+		if next != 6 {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	if len(data) < 20 {
+		return nil, false
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || offset > len(data) {
+		return nil, false
+	}
+	flags := data[13]
+	return &tcpSegment{
+		Ts:      pkt.Ts,
+		Src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(data)),
+		Dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(data[2:])),
+		Seq:     binary.BigEndian.Uint32(data[4:]),
+		FIN:     flags&0x01 != 0,
+		SYN:     flags&0x02 != 0,
+		RST:     flags&0x04 != 0,
+		Payload: data[offset:],
+	}, true
+}
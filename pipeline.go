@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 大文件按固定大小切分成多个分片并行解析。分片大小固定而不是按 worker 数计算，
+// 这样无论使用多少个 worker，合并结果都完全一致
+const chunkSize = 64 << 20
+
+// analysisOptions 内置解析器的分析选项
+type analysisOptions struct {
+	Since   time.Time
+	Until   time.Time
+	Workers int
+	// 输入格式: slowlog、postgres、tcpdump、general 或 binlog，决定使用的解析器
+	Format string
+	// 日志所属数据库的 SQL 方言，决定 SQL 指纹规则
+	Dialect sqlDialect
+	// PostgreSQL 的 log_line_prefix，仅用于 stderr 格式的日志
+	PgPrefix *pgLinePrefix
+	// 抓包文件中 MySQL 服务端使用的端口
+	ServerPorts map[uint16]bool
+	// 宽松模式，跳过慢查询日志中格式异常的记录并写入隔离文件 Quarantine
+	Lenient    bool
+	Quarantine string
+	// 隔离文件中 SQL 的脱敏方式，为 nil 时不脱敏
+	Redactor *sqlRedactor
+	// 每个类保留的示例数，包括执行时间最长的一条
+	Samples int
+}
+
+// 判断记录是否在分析时间范围内
+func (o analysisOptions) inRange(ts time.Time) bool {
+	if o.Since.IsZero() && o.Until.IsZero() {
+		return true
+	}
+	if ts.IsZero() {
+		return false
+	}
+	if !o.Since.IsZero() && ts.Before(o.Since) {
+		return false
+	}
+	if !o.Until.IsZero() && ts.After(o.Until) {
+		return false
+	}
+	return true
+}
+
+// 通用查询日志和 binlog 只记录执行了哪些语句，没有执行耗时和扫描行数
+func (o analysisOptions) hasLatency() bool {
+	return o.Format != "general" && o.Format != "binlog"
+}
+
+// logInput 一个待分析的日志文件及其来源标签
+type logInput struct {
+	Source string
+	Path   string
+}
+
+// parseTask 一个待解析的文件分片 [Start, End)
+type parseTask struct {
+	Source string
+	Path   string
+	Start  int64
+	End    int64
+	// gzip、bzip2 压缩的文件需要解压后解析
+	Compressed bool
+}
+
+// 在 offset 之后查找下一条以 "# Time:" 开头的记录，找不到时返回 -1
+func findEntryBoundary(f *os.File, offset int64) (int64, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReaderSize(f, 1<<16)
+	pos := offset
+	// 跳过 offset 所在的不完整行
+	skipped, err := reader.ReadBytes('\n')
+	pos += int64(len(skipped))
+	for err == nil {
+		var line []byte
+		line, err = reader.ReadBytes('\n')
+		if isEntryStart(line) {
+			return pos, nil
+		}
+		pos += int64(len(line))
+	}
+	if err == io.EOF {
+		return -1, nil
+	}
+	return 0, err
+}
+
+// 将文件切分为若干个从记录边界开始、大小约为 chunk 的分片
+func planChunks(input logInput, size, chunk int64) ([]parseTask, error) {
+	if size <= chunk {
+		return []parseTask{{Source: input.Source, Path: input.Path, Start: 0, End: size}}, nil
+	}
+	f, err := os.Open(input.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bounds := []int64{0}
+	for offset := chunk; offset < size; offset += chunk {
+		if offset <= bounds[len(bounds)-1] {
+			continue
+		}
+		boundary, err := findEntryBoundary(f, offset)
+		if err != nil {
+			return nil, err
+		}
+		if boundary < 0 {
+			break
+		}
+		if boundary > bounds[len(bounds)-1] {
+			bounds = append(bounds, boundary)
+		}
+	}
+	bounds = append(bounds, size)
+
+	tasks := make([]parseTask, 0, len(bounds)-1)
+	for i := 0; i+1 < len(bounds); i++ {
+		tasks = append(tasks, parseTask{Source: input.Source, Path: input.Path, Start: bounds[i], End: bounds[i+1]})
+	}
+	return tasks, nil
+}
+
+// 解析一个分片并返回其统计结果
+func runParseTask(task parseTask, opts analysisOptions, progress func(int64)) (*aggregator, error) {
+	var f io.Reader
+	if task.Compressed {
+		// 进度按压缩前的字节数统计，与进度条的总量一致
+		rc, _, err := openInput(task.Path, progress)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		f, progress = rc, nil
+	} else {
+		file, err := os.Open(task.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if _, err := file.Seek(task.Start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		f = file
+	}
+
+	agg := newAggregator(opts.Dialect)
+	agg.samples = opts.Samples
+	emit := func(e *slowEntry) {
+		e.Source = task.Source
+		if e.Db != "" {
+			agg.lastDb = e.Db
+		}
+		if opts.inRange(e.Ts) {
+			agg.add(e)
+		}
+	}
+	var err error
+	switch opts.Format {
+	case "postgres":
+		err = parsePostgresLog(f, opts.PgPrefix, emit, progress)
+	case "tcpdump":
+		err = parseCapture(f, opts.ServerPorts, emit, progress)
+	case "general":
+		err = parseGeneralLog(f, emit, progress)
+	case "binlog":
+		err = parseBinlog(f, emit, progress)
+	default:
+		reject := func(e *slowEntry) bool {
+			if !e.Ts.IsZero() && !opts.inRange(e.Ts) {
+				return true
+			}
+			return agg.reject(task.Path, e, opts.Lenient)
+		}
+		err = parseSlowLog(f, task.Start, task.End, emit, reject, progress)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %w", task.Path, err)
+	}
+	return agg, nil
+}
+
+// 使用内置解析器并行分析多个慢查询日志文件，PostgreSQL 日志、抓包文件、通用查询日志和 binlog 同样使用该流程
+func analyzeSlowLogs(inputs []logInput, opts analysisOptions) (*Report, error) {
+	var tasks []parseTask
+	var files []ReportFile
+	var total int64
+	for _, input := range inputs {
+		info, err := os.Stat(input.Path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, ReportFile{Name: input.Path, Size: info.Size(), Source: input.Source})
+		total += info.Size()
+		compression, err := fileCompression(input.Path)
+		if err != nil {
+			return nil, err
+		}
+		if compression != "" {
+			// 压缩文件无法定位到分片的起点，整个文件作为一个分片
+			tasks = append(tasks, parseTask{Source: input.Source, Path: input.Path, Start: 0, End: 0, Compressed: true})
+			continue
+		}
+		if opts.Format != "slowlog" && opts.Format != "" {
+			// PostgreSQL 日志的多行语句没有统一的记录边界，抓包文件中的 TCP 连接、通用查询日志和 binlog 中的
+			// 连接状态跨越整个文件，均按文件并行解析
+			tasks = append(tasks, parseTask{Source: input.Source, Path: input.Path, Start: 0, End: info.Size()})
+			continue
+		}
+		chunks, err := planChunks(input, info.Size(), chunkSize)
+		if err != nil {
+			return nil, fmt.Errorf("切分日志文件 %s 失败: %w", input.Path, err)
+		}
+		tasks = append(tasks, chunks...)
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	if workers > len(tasks) {
+		workers = len(tasks)
+	}
+
+	bar := newProgressBar(total)
+	bar.start()
+
+	results := make([]*aggregator, len(tasks))
+	errs := make([]error, len(tasks))
+	taskCh := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range taskCh {
+				results[i], errs[i] = runParseTask(tasks[i], opts, bar.add)
+			}
+		}()
+	}
+	for i := range tasks {
+		taskCh <- i
+	}
+	close(taskCh)
+	wg.Wait()
+	bar.finish()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	merged := mergeTaskResults(tasks, results, opts)
+	report := merged.report(files)
+	report.Global.ParseWarnings = buildParseWarnings(merged.malformed, opts.Lenient)
+	if w := report.Global.ParseWarnings; w != nil && opts.Lenient && opts.Quarantine != "" {
+		if err := writeQuarantine(opts.Quarantine, merged.malformed, opts.Redactor); err != nil {
+			return nil, fmt.Errorf("写入隔离文件失败: %w", err)
+		}
+		w.Quarantine = opts.Quarantine
+	}
+	return report, nil
+}
+
+// 按文件和分片顺序合并，保证结果确定。同一文件的分片开头没有数据库的记录沿用前一个分片最后的数据库，
+// 与不分片解析的结果一致
+func mergeTaskResults(tasks []parseTask, results []*aggregator, opts analysisOptions) *aggregator {
+	merged := newAggregator(opts.Dialect)
+	merged.samples = opts.Samples
+	merged.noLatency = !opts.hasLatency()
+	var lastDb string
+	for i, agg := range results {
+		if tasks[i].Start == 0 {
+			lastDb = ""
+		}
+		agg.resolvePendingDb(lastDb)
+		if agg.lastDb != "" {
+			lastDb = agg.lastDb
+		}
+		merged.merge(agg)
+	}
+	return merged
+}
+
+// progressBar 在标准错误输出上显示解析进度
+type progressBar struct {
+	total     int64
+	done      atomic.Int64
+	startTime time.Time
+	stop      chan struct{}
+	stopped   sync.WaitGroup
+}
+
+func newProgressBar(total int64) *progressBar {
+	return &progressBar{total: total, stop: make(chan struct{})}
+}
+
+func (p *progressBar) add(n int64) {
+	p.done.Add(n)
+}
+
+func (p *progressBar) start() {
+	p.startTime = time.Now()
+	p.stopped.Add(1)
+	go func() {
+		defer p.stopped.Done()
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.render()
+			case <-p.stop:
+				p.render()
+				fmt.Fprintln(os.Stderr)
+				return
+			}
+		}
+	}()
+}
+
+func (p *progressBar) finish() {
+	close(p.stop)
+	p.stopped.Wait()
+}
+
+func (p *progressBar) render() {
+	const width = 30
+	done := p.done.Load()
+	ratio := 1.0
+	if p.total > 0 {
+		ratio = float64(done) / float64(p.total)
+	}
+	if ratio > 1 {
+		ratio = 1
+	}
+	filled := int(ratio * width)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	elapsed := time.Since(p.startTime).Seconds()
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(done) / elapsed
+	}
+	fmt.Fprintf(os.Stderr, "\r解析进度 [%s] %5.1f%% %s/%s %s/s ", bar, ratio*100, formatBytes(float64(done)), formatBytes(float64(p.total)), formatBytes(rate))
+}
+
+// 将字节数格式化为易读的形式
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 生成测试用的慢查询日志，只在第 1 条和第 db 条记录前出现 use 语句，其余记录沿用前一条记录的数据库
+func writeSlowLog(t *testing.T, path string, entries, db int) {
+	t.Helper()
+	var b strings.Builder
+	for i := 0; i < entries; i++ {
+		fmt.Fprintf(&b, "# Time: 2024-04-16T08:%02d:00.000000Z\n", i%60)
+		fmt.Fprintf(&b, "# User@Host: app[app] @  [10.0.1.15]  Id: %d\n", i)
+		fmt.Fprintf(&b, "# Query_time: %d.5  Lock_time: 0.000100 Rows_sent: 1  Rows_examined: %d\n", i%4, i*10)
+		switch i {
+		case 0:
+			b.WriteString("use shop;\n")
+		case db:
+			b.WriteString("use crm;\n")
+		}
+		fmt.Fprintf(&b, "SET timestamp=%d;\n", 1713254400+i*60)
+		fmt.Fprintf(&b, "SELECT * FROM t%d WHERE id = %d;\n", i%3, i)
+	}
+	writeTestFile(t, path, b.String())
+}
+
+func TestChunkedParseMatchesSingleStream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slow.log")
+	writeSlowLog(t, path, 40, 25)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := logInput{Source: "db1", Path: path}
+	files := []ReportFile{{Name: path, Size: info.Size(), Source: "db1"}}
+	opts := analysisOptions{Format: "slowlog", Dialect: dialectMySQL, Samples: 3}
+
+	parse := func(chunk int64) (*Report, int) {
+		tasks, err := planChunks(input, info.Size(), chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results := make([]*aggregator, len(tasks))
+		for i, task := range tasks {
+			if results[i], err = runParseTask(task, opts, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return mergeTaskResults(tasks, results, opts).report(files), len(tasks)
+	}
+
+	want, n := parse(info.Size())
+	if n != 1 {
+		t.Fatalf("single stream tasks = %d, want 1", n)
+	}
+	for _, chunk := range []int64{300, 1000, 4096} {
+		got, n := parse(chunk)
+		if n < 2 {
+			t.Fatalf("chunk %d: tasks = %d, want more than 1", chunk, n)
+		}
+		if !reflect.DeepEqual(got, want) {
+			gotJSON, _ := json.MarshalIndent(got.Classes, "", "  ")
+			wantJSON, _ := json.MarshalIndent(want.Classes, "", "  ")
+			t.Errorf("chunk %d (%d tasks): report differs from single stream\ngot:  %s\nwant: %s", chunk, n, gotJSON, wantJSON)
+		}
+	}
+	for _, class := range want.Classes {
+		if class.Metrics.Db.Value == "" {
+			t.Errorf("%s: db is empty", class.Fingerprint)
+		}
+	}
+}
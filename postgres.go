@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PostgreSQL 10 及以上版本默认的 log_line_prefix
+const defaultPgLinePrefix = "%m [%p] "
+
+var (
+	// log_min_duration_statement 输出的 "duration: 12.345 ms  statement: ..."，
+	// 扩展协议为 "execute <unnamed>: ..."，log_duration 单独输出时只有 "duration: 12.345 ms"
+	pgDurationRegexp  = regexp.MustCompile(`(?s)^duration: ([0-9.]+) ms(?:\s+(statement|execute|parse|bind)[^:]*:\s*(.*))?$`)
+	pgStatementRegexp = regexp.MustCompile(`(?s)^(?:statement|execute [^:]*):\s*(.*)$`)
+	pgCsvlogRegexp    = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?(?: [A-Za-z0-9+\-:]+)?,`)
+)
+
+// log_line_prefix 中各转义符对应的正则，带名字的分组会被提取到记录中
+var pgPrefixEscapes = map[byte]string{
+	'a': `(?P<app>.*?)`,
+	'u': `(?P<user>.*?)`,
+	'd': `(?P<db>.*?)`,
+	'r': `(?P<host>.*?)(?:\(\d+\))?`,
+	'h': `(?P<host>.*?)`,
+	'b': `.*?`,
+	'p': `(?P<pid>\d+)`,
+	'P': `\d*`,
+	't': `(?P<ts>\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?: [A-Za-z0-9+\-:]+)?)`,
+	'm': `(?P<ts>\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}\.\d+(?: [A-Za-z0-9+\-:]+)?)`,
+	'n': `(?P<epoch>\d+(?:\.\d+)?)`,
+	'i': `.*?`,
+	'e': `[0-9A-Z]{5}`,
+	'c': `[0-9a-f]+\.[0-9a-f]+`,
+	'l': `\d+`,
+	's': `\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?: [A-Za-z0-9+\-:]+)?`,
+	'v': `\S*`,
+	'x': `\d*`,
+	'Q': `-?\d*`,
+}
+
+// pgLinePrefix 由 log_line_prefix 编译得到的日志行匹配规则
+type pgLinePrefix struct {
+	line  *regexp.Regexp
+	names map[string]int
+}
+
+var pgPrefixNameRegexp = regexp.MustCompile(`\(\?P<(\w+)>`)
+
+// 将 log_line_prefix 编译为匹配整行日志的正则，例如 "%m [%p] " 或 "%t [%p]: user=%u,db=%d,client=%h "
+func compilePgLinePrefix(prefix string) (*pgLinePrefix, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	used := make(map[string]bool)
+	optional := false
+	for i := 0; i < len(prefix); i++ {
+		c := prefix[i]
+		if c != '%' {
+			b.WriteString(regexp.QuoteMeta(string(c)))
+			continue
+		}
+		// 跳过 %-10u 这样的宽度设置，填充的空格用 \s* 匹配
+		j := i + 1
+		padded := false
+		for j < len(prefix) && (prefix[j] == '-' || prefix[j] >= '0' && prefix[j] <= '9') {
+			padded = true
+			j++
+		}
+		if j == len(prefix) {
+			return nil, fmt.Errorf("log_line_prefix 以不完整的转义符结尾: %s", prefix)
+		}
+		i = j
+		escape := prefix[i]
+		switch escape {
+		case '%':
+			b.WriteString("%")
+			continue
+		case 'q':
+			// %q 之后的内容只在会话进程中输出
+			b.WriteString("(?:")
+			optional = true
+			continue
+		}
+		pattern, ok := pgPrefixEscapes[escape]
+		if !ok {
+			return nil, fmt.Errorf("不支持的 log_line_prefix 转义符: %%%c", escape)
+		}
+		// 同名分组只保留第一个
+		pattern = pgPrefixNameRegexp.ReplaceAllStringFunc(pattern, func(group string) string {
+			name := pgPrefixNameRegexp.FindStringSubmatch(group)[1]
+			if used[name] {
+				return "("
+			}
+			used[name] = true
+			return group
+		})
+		if padded {
+			pattern = `\s*` + pattern + `\s*`
+		}
+		b.WriteString(pattern)
+	}
+	if optional {
+		b.WriteString(")?")
+	}
+	b.WriteString(`(?P<level>[A-Z]+[0-9]?):\s+(?P<msg>.*)$`)
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("无法解析 log_line_prefix %q: %w", prefix, err)
+	}
+	p := &pgLinePrefix{line: re, names: make(map[string]int)}
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			p.names[name] = i
+		}
+	}
+	return p, nil
+}
+
+// 将日志行拆分为前缀中的字段和消息，不匹配时返回 false
+func (p *pgLinePrefix) match(line string) (*pgMessage, bool) {
+	m := p.line.FindStringSubmatch(line)
+	if m == nil {
+		return nil, false
+	}
+	get := func(name string) string {
+		if i, ok := p.names[name]; ok {
+			return m[i]
+		}
+		return ""
+	}
+	msg := &pgMessage{
+		User:    get("user"),
+		Db:      get("db"),
+		Host:    get("host"),
+		Pid:     get("pid"),
+		Level:   get("level"),
+		Message: get("msg"),
+	}
+	if ts := get("ts"); ts != "" {
+		msg.Ts, _ = parsePgTime(ts)
+	} else if epoch := get("epoch"); epoch != "" {
+		if sec, err := strconv.ParseFloat(epoch, 64); err == nil {
+			msg.Ts = time.UnixMilli(int64(sec * 1000))
+		}
+	}
+	return msg, true
+}
+
+// 解析 PostgreSQL 日志中的时间，例如 "2024-04-16 08:01:12.345 CST"。
+// UTC 和数字形式的时区按其偏移量转换为本地时间，其他时区缩写有歧义，按本地时区处理
+func parsePgTime(value string) (time.Time, bool) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return time.Time{}, false
+	}
+	loc := time.Local
+	if len(fields) > 2 {
+		zone := fields[2]
+		switch {
+		case zone == "UTC" || zone == "GMT" || zone == "Z":
+			loc = time.UTC
+		case zone[0] == '+' || zone[0] == '-':
+			if t, err := time.Parse("-07", zone); err == nil {
+				loc = t.Location()
+			} else if t, err := time.Parse("-0700", zone); err == nil {
+				loc = t.Location()
+			} else if t, err := time.Parse("-07:00", zone); err == nil {
+				loc = t.Location()
+			}
+		}
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05.999999999", fields[0]+" "+fields[1], loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t.In(time.Local), true
+}
+
+// pgMessage PostgreSQL 日志中的一条消息，多行消息已合并
+type pgMessage struct {
+	Ts      time.Time
+	User    string
+	Db      string
+	Host    string
+	Pid     string
+	Level   string
+	Message string
+}
+
+// pgLogState 将日志消息转换为 slowEntry。
+// log_statement 与 log_duration 分开输出时，语句和耗时按进程号配对
+type pgLogState struct {
+	emit    func(*slowEntry)
+	pending map[string]string
+}
+
+func newPgLogState(emit func(*slowEntry)) *pgLogState {
+	return &pgLogState{emit: emit, pending: make(map[string]string)}
+}
+
+func (s *pgLogState) handle(m *pgMessage) {
+	if m == nil || m.Level != "LOG" {
+		return
+	}
+	if d := pgDurationRegexp.FindStringSubmatch(m.Message); d != nil {
+		var query string
+		switch d[2] {
+		case "statement", "execute":
+			query = d[3]
+		case "":
+			query = s.pending[m.Pid]
+			delete(s.pending, m.Pid)
+		}
+		// parse/bind 阶段的耗时与 execute 重复，不单独统计
+		query = strings.TrimSpace(query)
+		if query == "" {
+			return
+		}
+		ms, _ := strconv.ParseFloat(d[1], 64)
+		s.emit(&slowEntry{
+			Ts:        m.Ts,
+			User:      m.User,
+			Host:      m.Host,
+			Db:        m.Db,
+			ThreadId:  m.Pid,
+			QueryTime: ms / 1000,
+			Query:     query,
+		})
+		return
+	}
+	if st := pgStatementRegexp.FindStringSubmatch(m.Message); st != nil {
+		s.pending[m.Pid] = st[1]
+	}
+}
+
+// countingReader 统计已读取的字节数，用于显示解析进度
+type countingReader struct {
+	r        io.Reader
+	progress func(int64)
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 && c.progress != nil {
+		c.progress(int64(n))
+	}
+	return n, err
+}
+
+// 解析 PostgreSQL 日志，根据首行内容识别 stderr、csvlog 和 jsonlog 三种格式
+func parsePostgresLog(r io.Reader, prefix *pgLinePrefix, emit func(*slowEntry), progress func(int64)) error {
+	reader := bufio.NewReaderSize(&countingReader{r: r, progress: progress}, 1<<16)
+	head, _ := reader.Peek(4096)
+	first := bytes.TrimLeft(head, " \t\r\n\xEF\xBB\xBF")
+	state := newPgLogState(emit)
+	switch {
+	case len(first) > 0 && first[0] == '{':
+		return parsePgJsonlog(reader, state)
+	case pgCsvlogRegexp.Match(first):
+		return parsePgCsvlog(reader, state)
+	}
+	if prefix == nil {
+		var err error
+		if prefix, err = compilePgLinePrefix(defaultPgLinePrefix); err != nil {
+			return err
+		}
+	}
+	return parsePgStderr(reader, prefix, state)
+}
+
+func parsePgStderr(reader *bufio.Reader, prefix *pgLinePrefix, state *pgLogState) error {
+	var cur *pgMessage
+	var lineNo, matched int
+	firstLine := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			lineNo++
+			line = strings.TrimRight(line, "\r\n")
+			if m, ok := prefix.match(line); ok {
+				state.handle(cur)
+				cur = m
+				matched++
+			} else if cur != nil && line != "" {
+				// 多行语句的后续行以制表符开头
+				cur.Message += "\n" + strings.TrimPrefix(line, "\t")
+			} else if firstLine == 0 && strings.TrimSpace(line) != "" {
+				firstLine = lineNo
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	state.handle(cur)
+	if matched == 0 && firstLine > 0 {
+		return fmt.Errorf("第 %d 行与 log_line_prefix 不匹配，请通过 -pgPrefix 指定与 postgresql.conf 一致的 log_line_prefix", firstLine)
+	}
+	return nil
+}
+
+// csvlog 各列的位置
+const (
+	pgCsvLogTime        = 0
+	pgCsvUserName       = 1
+	pgCsvDatabaseName   = 2
+	pgCsvProcessId      = 3
+	pgCsvConnectionFrom = 4
+	pgCsvErrorSeverity  = 11
+	pgCsvMessage        = 13
+)
+
+func parsePgCsvlog(reader *bufio.Reader, state *pgLogState) error {
+	r := csv.NewReader(reader)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("csvlog 格式错误: %w", err)
+		}
+		if len(record) <= pgCsvMessage {
+			continue
+		}
+		host := record[pgCsvConnectionFrom]
+		if i := strings.LastIndexByte(host, ':'); i > 0 {
+			host = host[:i]
+		}
+		m := &pgMessage{
+			User:    record[pgCsvUserName],
+			Db:      record[pgCsvDatabaseName],
+			Host:    host,
+			Pid:     record[pgCsvProcessId],
+			Level:   record[pgCsvErrorSeverity],
+			Message: record[pgCsvMessage],
+		}
+		m.Ts, _ = parsePgTime(record[pgCsvLogTime])
+		state.handle(m)
+	}
+}
+
+// jsonlog 中用到的字段（PostgreSQL 15 及以上版本）
+type pgJsonlogRecord struct {
+	Timestamp     string      `json:"timestamp"`
+	User          string      `json:"user"`
+	Dbname        string      `json:"dbname"`
+	Pid           json.Number `json:"pid"`
+	RemoteHost    string      `json:"remote_host"`
+	ErrorSeverity string      `json:"error_severity"`
+	Message       string      `json:"message"`
+}
+
+func parsePgJsonlog(reader *bufio.Reader, state *pgLogState) error {
+	decoder := json.NewDecoder(reader)
+	for {
+		var record pgJsonlogRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("jsonlog 格式错误: %w", err)
+		}
+		m := &pgMessage{
+			User:    record.User,
+			Db:      record.Dbname,
+			Host:    record.RemoteHost,
+			Pid:     record.Pid.String(),
+			Level:   record.ErrorSeverity,
+			Message: record.Message,
+		}
+		m.Ts, _ = parsePgTime(record.Timestamp)
+		state.handle(m)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePostgresLog(t *testing.T) {
+	type entry struct {
+		query     string
+		queryTime float64
+		pid       string
+		user      string
+		db        string
+		host      string
+		ts        time.Time
+	}
+	tests := []struct {
+		name    string
+		path    string
+		entries []entry
+	}{
+		{
+			// parse 阶段的耗时、ERROR 和 STATEMENT 不统计，单独输出的 duration 与前一条 statement 按进程号配对
+			name: "stderr",
+			path: "testdata/postgresql-stderr.log",
+			entries: []entry{
+				{
+					query: "SELECT o.id, o.total::numeric(10,2) FROM \"public\".\"orders\" o\n" +
+						"WHERE o.user_id = 1024 AND o.created_at > '2024-01-01'::timestamp with time zone\n" +
+						"ORDER BY o.created_at DESC LIMIT 20;",
+					queryTime: 1.523456,
+					pid:       "12345",
+					ts:        time.Date(2024, 4, 16, 8, 1, 12, 345000000, time.UTC),
+				},
+				{
+					query:     "SELECT o.id, o.total::numeric(10,2) FROM \"public\".\"orders\" o WHERE o.user_id = $1 AND o.created_at > $2::timestamptz ORDER BY o.created_at DESC LIMIT $3",
+					queryTime: 2.1,
+					pid:       "12346",
+					ts:        time.Date(2024, 4, 16, 8, 1, 13, 1000000, time.UTC),
+				},
+				{
+					query:     "UPDATE accounts SET balance = balance - 100 WHERE id = 7",
+					queryTime: 0.812,
+					pid:       "12348",
+					ts:        time.Date(2024, 4, 16, 8, 3, 0, 200000000, time.UTC),
+				},
+				{
+					query:     "DO $$BEGIN PERFORM pg_sleep(3); END$$;",
+					queryTime: 3.0001,
+					pid:       "12350",
+					ts:        time.Date(2024, 4, 16, 8, 5, 0, 0, time.UTC),
+				},
+				{
+					query:     "INSERT INTO events (id, payload) VALUES (1, E'it\\'s'), (2, 'x') ON CONFLICT (id) DO NOTHING",
+					queryTime: 0.9,
+					pid:       "12351",
+					ts:        time.Date(2024, 4, 16, 8, 6, 0, 0, time.UTC),
+				},
+			},
+		},
+		{
+			// 客户端地址去掉端口，消息中的换行保留
+			name: "csvlog",
+			path: "testdata/postgresql.csv",
+			entries: []entry{
+				{
+					query:     "SELECT *\nFROM orders WHERE id = 1",
+					queryTime: 1.523456,
+					pid:       "12345",
+					user:      "app",
+					db:        "shop",
+					host:      "10.0.0.5",
+					ts:        time.Date(2024, 4, 16, 8, 1, 12, 345000000, time.UTC),
+				},
+				{
+					query:     "SELECT * FROM orders WHERE id = 2",
+					queryTime: 0.01,
+					pid:       "12345",
+					user:      "app",
+					db:        "shop",
+					host:      "10.0.0.5",
+					ts:        time.Date(2024, 4, 16, 8, 1, 13, 345000000, time.UTC),
+				},
+			},
+		},
+		{
+			name: "jsonlog",
+			path: "testdata/postgresql.json",
+			entries: []entry{
+				{
+					query:     "SELECT * FROM orders WHERE id = 1",
+					queryTime: 1.523456,
+					pid:       "12345",
+					user:      "app",
+					db:        "shop",
+					host:      "10.0.0.5",
+					ts:        time.Date(2024, 4, 16, 8, 1, 12, 345000000, time.UTC),
+				},
+				{
+					query:     "SELECT * FROM \"Orders\" WHERE id = 2",
+					queryTime: 0.005,
+					pid:       "12346",
+					user:      "app",
+					db:        "shop",
+					host:      "10.0.0.6",
+					ts:        time.Date(2024, 4, 16, 8, 1, 13, 345000000, time.UTC),
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Open(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var entries []*slowEntry
+			if err := parsePostgresLog(f, nil, func(e *slowEntry) { entries = append(entries, e) }, nil); err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(tt.entries) {
+				t.Fatalf("entries = %d, want %d", len(entries), len(tt.entries))
+			}
+			for i, want := range tt.entries {
+				e := entries[i]
+				if e.Query != want.query {
+					t.Errorf("#%d Query = %q, want %q", i, e.Query, want.query)
+				}
+				if math.Abs(e.QueryTime-want.queryTime) > 1e-9 {
+					t.Errorf("#%d QueryTime = %v, want %v", i, e.QueryTime, want.queryTime)
+				}
+				if e.ThreadId != want.pid || e.User != want.user || e.Db != want.db || e.Host != want.host {
+					t.Errorf("#%d Pid/User/Db/Host = %q/%q/%q/%q, want %q/%q/%q/%q", i,
+						e.ThreadId, e.User, e.Db, e.Host, want.pid, want.user, want.db, want.host)
+				}
+				if !e.Ts.Equal(want.ts) {
+					t.Errorf("#%d Ts = %v, want %v", i, e.Ts, want.ts)
+				}
+			}
+		})
+	}
+}
+
+func TestCompilePgLinePrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		line   string
+		want   pgMessage
+	}{
+		{
+			prefix: "%t [%p]: user=%u,db=%d,client=%h ",
+			line:   "2024-04-16 08:01:12 UTC [123]: user=app,db=shop,client=10.0.0.5 LOG:  duration: 1.000 ms  statement: SELECT 1",
+			want: pgMessage{
+				Ts: time.Date(2024, 4, 16, 8, 1, 12, 0, time.UTC), User: "app", Db: "shop", Host: "10.0.0.5",
+				Pid: "123", Level: "LOG", Message: "duration: 1.000 ms  statement: SELECT 1",
+			},
+		},
+		{
+			// %r 中的端口不属于主机名，%-10u 的填充空格被忽略
+			prefix: "%m %-10u %r ",
+			line:   "2024-04-16 08:01:12.345 +08 app        10.0.0.5(51234) LOG:  statement: SELECT 1",
+			want: pgMessage{
+				Ts: time.Date(2024, 4, 16, 0, 1, 12, 345000000, time.UTC), User: "app", Host: "10.0.0.5",
+				Level: "LOG", Message: "statement: SELECT 1",
+			},
+		},
+		{
+			// %q 之后的内容只在会话进程中输出，后台进程的日志行没有这部分
+			prefix: "%m [%p] %q%u@%d ",
+			line:   "2024-04-16 08:01:12.345 UTC [99] LOG:  checkpoint starting: time",
+			want: pgMessage{
+				Ts:  time.Date(2024, 4, 16, 8, 1, 12, 345000000, time.UTC),
+				Pid: "99", Level: "LOG", Message: "checkpoint starting: time",
+			},
+		},
+		{
+			prefix: "%m [%p] %q%u@%d ",
+			line:   "2024-04-16 08:01:12.345 UTC [100] app@shop LOG:  duration: 2.5 ms",
+			want: pgMessage{
+				Ts:   time.Date(2024, 4, 16, 8, 1, 12, 345000000, time.UTC),
+				User: "app", Db: "shop", Pid: "100", Level: "LOG", Message: "duration: 2.5 ms",
+			},
+		},
+		{
+			prefix: "%n [%p] ",
+			line:   "1713254472.345 [7] LOG:  duration: 2.5 ms",
+			want: pgMessage{
+				Ts:  time.UnixMilli(1713254472345),
+				Pid: "7", Level: "LOG", Message: "duration: 2.5 ms",
+			},
+		},
+	}
+	for _, tt := range tests {
+		p, err := compilePgLinePrefix(tt.prefix)
+		if err != nil {
+			t.Errorf("compilePgLinePrefix(%q): %v", tt.prefix, err)
+			continue
+		}
+		got, ok := p.match(tt.line)
+		if !ok {
+			t.Errorf("%q does not match %q", tt.prefix, tt.line)
+			continue
+		}
+		if !got.Ts.Equal(tt.want.Ts) {
+			t.Errorf("%q: Ts = %v, want %v", tt.prefix, got.Ts, tt.want.Ts)
+		}
+		got.Ts = tt.want.Ts
+		if *got != tt.want {
+			t.Errorf("%q: match = %+v, want %+v", tt.prefix, *got, tt.want)
+		}
+	}
+}
+
+func TestCompilePgLinePrefixErrors(t *testing.T) {
+	tests := []struct {
+		prefix string
+		err    string
+	}{
+		{"%m [%p] %Z ", "不支持的 log_line_prefix 转义符: %Z"},
+		{"%m [%p] %-", "log_line_prefix 以不完整的转义符结尾: %m [%p] %-"},
+	}
+	for _, tt := range tests {
+		if _, err := compilePgLinePrefix(tt.prefix); err == nil || err.Error() != tt.err {
+			t.Errorf("compilePgLinePrefix(%q) error = %v, want %q", tt.prefix, err, tt.err)
+		}
+	}
+}
+
+func TestParsePgStderrPrefixMismatch(t *testing.T) {
+	log := "\n" +
+		"Apr 16 08:01:12 db1 postgres[123]: [1-1] LOG:  duration: 1.000 ms  statement: SELECT 1\n"
+	err := parsePostgresLog(strings.NewReader(log), nil, func(*slowEntry) {}, nil)
+	want := "第 2 行与 log_line_prefix 不匹配"
+	if err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("error = %v, want it to start with %q", err, want)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// 使用内置的 pt-query-digest 分析日志（-parser pt）
+func runPtQueryDigest(logFiles []string, since, until string) (*Report, error) {
+	// 检查系统环境
+	checkSystemEnvironment()
+
+	// 检查 Perl 模块
+	checkPerlModules()
+
+	// 创建临时目录
+	tempDir, err := os.MkdirTemp("", "slowsql-analysis")
+	if err != nil {
+		return nil, fmt.Errorf("创建临时目录失败: %s", err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+
+	// 将pt-query-digest写入临时目录
+	ptQueryDigestPath := filepath.Join(tempDir, "pt-query-digest")
+	err = os.WriteFile(ptQueryDigestPath, ptQueryDigest, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("写入pt-query-digest失败: %s", err.Error())
+	}
+
+	// 检查并设置权限
+	if err := checkAndSetPermissions(ptQueryDigestPath); err != nil {
+		return nil, fmt.Errorf("权限检查失败: %s", err)
+	}
+
+	resultPath := filepath.Join(tempDir, "mysql_slow.json")
+	var ptCmd string
+	if since == "" || until == "" {
+		ptCmd = fmt.Sprintf("%s %s --output json --noversion-check --progress time,1 --charset=utf8mb4 >%s", ptQueryDigestPath, strings.Join(logFiles, " "), resultPath)
+	} else {
+		ptCmd = fmt.Sprintf("%s %s --output json --noversion-check --set-vars time_zone='+8:00' --progress time,1 --charset=utf8mb4 --since='%s' --until='%s' >%s", ptQueryDigestPath, strings.Join(logFiles, " "), since, until, resultPath)
+	}
+
+	cmd := exec.Command("/bin/bash", "-c", ptCmd)
+
+	// 捕获标准错误输出
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			printColoredInfo("red", "分析过程出错: %v", err)
+			printColoredInfo("yellow", "详细错误信息:")
+			printColoredInfo("red", "1. 请检查日志文件权限是否正确")
+			printColoredInfo("red", "2. 请检查是否有执行权限")
+			printColoredInfo("red", "3. 如果是SELinux相关问题，可以尝试临时关闭: sudo setenforce 0")
+			printColoredInfo("red", "4. 使用 strace 命令查看详细错误: strace ./slowsql-analysis-linux-amd64 -port 6033 -f mysql-slow.log")
+			return nil, err
+		}
+		return nil, fmt.Errorf("执行命令失败: %v", err)
+	}
+
+	file, err := os.Open(resultPath)
+	if err != nil {
+		return nil, fmt.Errorf("打开分析结果失败: %s", err.Error())
+	}
+	defer file.Close()
+
+	var report Report
+	if err := json.NewDecoder(file).Decode(&report); err != nil {
+		return nil, fmt.Errorf("解析JSON数据失败: %s", err.Error())
+	}
+	return &report, nil
+}
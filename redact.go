@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// 脱敏级别
+const (
+	// 不脱敏，报告中展示原始 SQL
+	redactNone = "none"
+	// 只展示 SQL 指纹
+	redactFingerprint = "fingerprint"
+	// 所有字符串和数字替换为 ?
+	redactLiterals = "literals"
+	// 只替换字面量和注释中匹配脱敏规则的内容，例如邮箱、身份证号、手机号、银行卡号
+	redactPII = "pii"
+)
+
+// redactRule 一条敏感信息匹配规则，匹配的内容替换为 <名称>
+type redactRule struct {
+	Name   string
+	Regexp *regexp.Regexp
+	// 对匹配内容的额外校验，例如银行卡号的 Luhn 校验
+	Check func(string) bool
+}
+
+// 内置的脱敏规则，按顺序匹配。身份证号在银行卡号之前匹配，避免 18 位身份证号被识别为银行卡号
+var defaultRedactRules = []redactRule{
+	{Name: "email", Regexp: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)},
+	{Name: "id_card", Regexp: regexp.MustCompile(`\b[1-9]\d{5}(?:18|19|20)\d{2}(?:0[1-9]|1[0-2])(?:0[1-9]|[12]\d|3[01])\d{3}[\dXx]\b`)},
+	{Name: "card", Regexp: regexp.MustCompile(`\b\d{4}(?:[ \-]?\d{4}){2,3}(?:[ \-]?\d{1,3})?\b`), Check: luhnValid},
+	{Name: "phone", Regexp: regexp.MustCompile(`(?:\+\d{1,3}[ \-]?)?\b(?:1[3-9]\d{9}|\d{3,4}-\d{7,8})\b`)},
+	{Name: "token", Regexp: regexp.MustCompile(`\b(?:[A-Za-z0-9_\-]{8,}\.){2}[A-Za-z0-9_\-]{8,}\b|\b[A-Za-z0-9]{32,}\b`)},
+}
+
+// sqlRedactor 按脱敏级别处理报告中的 SQL
+type sqlRedactor struct {
+	Level string
+	Rules []redactRule
+}
+
+// 创建脱敏器，rulesFile 中的规则与内置规则同名时替换内置规则，规则为空时删除内置规则
+func newSQLRedactor(level, rulesFile string) (*sqlRedactor, error) {
+	switch level {
+	case "", redactNone:
+		return nil, nil
+	case redactFingerprint, redactLiterals, redactPII:
+	default:
+		return nil, fmt.Errorf("不支持的脱敏级别: %s（可选 none、fingerprint、literals、pii）", level)
+	}
+	r := &sqlRedactor{Level: level, Rules: append([]redactRule(nil), defaultRedactRules...)}
+	if rulesFile != "" {
+		if err := r.loadRules(rulesFile); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// 读取脱敏规则文件，每行一条 "名称=正则表达式"，# 开头的行为注释
+func (r *sqlRedactor) loadRules(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, expr, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return fmt.Errorf("%s 第 %d 行格式错误，应为 名称=正则表达式", path, lineNo)
+		}
+		rule := redactRule{Name: name}
+		if expr = strings.TrimSpace(expr); expr != "" {
+			if rule.Regexp, err = regexp.Compile(expr); err != nil {
+				return fmt.Errorf("%s 第 %d 行的正则表达式错误: %w", path, lineNo, err)
+			}
+		}
+		r.setRule(rule)
+	}
+	return scanner.Err()
+}
+
+func (r *sqlRedactor) setRule(rule redactRule) {
+	for i, existing := range r.Rules {
+		if existing.Name != rule.Name {
+			continue
+		}
+		if rule.Regexp == nil {
+			r.Rules = append(r.Rules[:i], r.Rules[i+1:]...)
+		} else {
+			r.Rules[i] = rule
+		}
+		return
+	}
+	if rule.Regexp != nil {
+		r.Rules = append(r.Rules, rule)
+	}
+}
+
+// 银行卡号的 Luhn 校验，用于排除恰好是 16 位左右的普通数字
+func luhnValid(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// 替换文本中匹配脱敏规则的内容
+func (r *sqlRedactor) maskText(s string) string {
+	for _, rule := range r.Rules {
+		s = rule.Regexp.ReplaceAllStringFunc(s, func(m string) string {
+			if rule.Check != nil && !rule.Check(m) {
+				return m
+			}
+			return "<" + rule.Name + ">"
+		})
+	}
+	return s
+}
+
+// 对 SQL 中的字面量和注释脱敏，保留关键字、标识符和空白字符，方便阅读。
+// literals 级别将字面量替换为 ?，pii 级别只替换字面量中匹配脱敏规则的内容，注释中匹配规则的内容在两种级别下都会被替换
+func (r *sqlRedactor) maskSQL(q string, dialect sqlDialect) string {
+	pg := dialect == dialectPostgres
+	literals := r.Level != redactPII
+	var b strings.Builder
+	b.Grow(len(q))
+	literal := func(s string) {
+		if literals {
+			b.WriteByte('?')
+		} else {
+			b.WriteString(r.maskText(s))
+		}
+	}
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == '/' && i+1 < len(q) && q[i+1] == '*':
+			end := strings.Index(q[i+2:], "*/")
+			if end < 0 {
+				// 未闭合的注释通常是被截断的记录，之后的内容仍按 SQL 处理
+				b.WriteString("/*")
+				i += 2
+				continue
+			}
+			end += i + 4
+			b.WriteString(r.maskText(q[i:end]))
+			i = end
+		case c == '#' && !pg || c == '-' && i+1 < len(q) && q[i+1] == '-' && (i+2 == len(q) || isSpaceByte(q[i+2])):
+			end := strings.IndexByte(q[i:], '\n')
+			if end < 0 {
+				end = len(q)
+			} else {
+				end += i
+			}
+			b.WriteString(r.maskText(q[i:end]))
+			i = end
+		case pg && c == '$' && skipPgDollar(q, i) > 0:
+			end := skipPgDollar(q, i)
+			if i+1 < len(q) && q[i+1] >= '0' && q[i+1] <= '9' {
+				// $1 参数占位符
+				b.WriteString(q[i:end])
+			} else {
+				literal(q[i:end])
+			}
+			i = end
+		case c == '`' || pg && c == '"':
+			end := strings.IndexByte(q[i+1:], c)
+			if end < 0 {
+				end = len(q)
+			} else {
+				end += i + 2
+			}
+			b.WriteString(q[i:end])
+			i = end
+		case c == '\'' || c == '"':
+			// 与 normalizeQuery 相同，PostgreSQL 中只有 E'...' 字符串使用反斜杠转义
+			backslash := !pg || i > 0 && (q[i-1] == 'e' || q[i-1] == 'E')
+			j := i + 1
+			for j < len(q) {
+				if q[j] == '\\' && backslash {
+					j += 2
+					continue
+				}
+				if q[j] == c {
+					if j+1 < len(q) && q[j+1] == c {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			end := min(j+1, len(q))
+			literal(q[i:end])
+			i = end
+		case isWordByte(c):
+			j := i + 1
+			number := c >= '0' && c <= '9'
+			for j < len(q) && (isWordByte(q[j]) || number && q[j] == '.' ||
+				number && (q[j] == '+' || q[j] == '-') && (q[j-1] == 'e' || q[j-1] == 'E')) {
+				j++
+			}
+			if number {
+				literal(q[i:j])
+			} else {
+				b.WriteString(q[i:j])
+			}
+			i = j
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// 对报告中的示例 SQL 和表结构语句脱敏，所有输出格式都基于脱敏后的报告生成
+func (r *sqlRedactor) redactReport(report *Report) {
+	if r == nil {
+		return
+	}
+	dialect := reportDialect(report)
+	for i := range report.Classes {
+		class := &report.Classes[i]
+		if r.Level == redactFingerprint {
+			// 所有示例的指纹都相同，只保留一条
+			class.Example.Query = class.Fingerprint
+			class.Example.AsSelect = ""
+			class.Samples = nil
+		} else {
+			class.Example.Query = r.maskSQL(class.Example.Query, dialect)
+			class.Example.AsSelect = r.maskSQL(class.Example.AsSelect, dialect)
+			for j := range class.Samples {
+				class.Samples[j].Query = r.maskSQL(class.Samples[j].Query, dialect)
+			}
+		}
+		for j := range class.Tables {
+			class.Tables[j].Create = r.maskSQL(class.Tables[j].Create, dialect)
+		}
+	}
+}
+
+// 返回脱敏后的报告副本，不修改原报告，用于Web服务按请求脱敏
+func (r *sqlRedactor) redactedCopy(report *Report) *Report {
+	c := *report
+	c.Classes = make([]ReportClass, len(report.Classes))
+	for i, class := range report.Classes {
+		// 脱敏会修改示例和表结构，复制这两部分
+		class.Samples = append([]ClassExample(nil), class.Samples...)
+		class.Tables = append([]ClassTable(nil), class.Tables...)
+		c.Classes[i] = class
+	}
+	r.redactReport(&c)
+	return &c
+}
+
+// 对隔离文件中记录的原文脱敏，# 开头的头部行不包含 SQL，保持原样。
+// 格式异常的记录无法计算指纹，fingerprint 级别按 literals 处理
+func (r *sqlRedactor) redactRaw(raw string) string {
+	if r == nil {
+		return raw
+	}
+	level := r.Level
+	if level == redactFingerprint {
+		level = redactLiterals
+	}
+	masker := &sqlRedactor{Level: level, Rules: r.Rules}
+	lines := strings.SplitAfter(raw, "\n")
+	var sql strings.Builder
+	var b strings.Builder
+	flushSQL := func() {
+		if sql.Len() > 0 {
+			b.WriteString(masker.maskSQL(sql.String(), dialectMySQL))
+			sql.Reset()
+		}
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "# ") {
+			flushSQL()
+			b.WriteString(line)
+			continue
+		}
+		sql.WriteString(line)
+	}
+	flushSQL()
+	return b.String()
+}
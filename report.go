@@ -0,0 +1,831 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricStats 数值型指标的统计结果，字段格式与 pt-query-digest 的 JSON 输出保持一致
+type MetricStats struct {
+	Pct    string `json:"pct,omitempty"`
+	Stddev string `json:"stddev"`
+	Sum    string `json:"sum"`
+	Pct95  string `json:"pct_95"`
+	Max    string `json:"max"`
+	Median string `json:"median"`
+	Avg    string `json:"avg"`
+	Min    string `json:"min"`
+}
+
+// ValueMetric 字符串型指标（用户、主机、数据库），取出现次数最多的值
+type ValueMetric struct {
+	Value string `json:"value"`
+}
+
+type GlobalMetrics struct {
+	QueryLength  MetricStats `json:"Query_length"`
+	LockTime     MetricStats `json:"Lock_time"`
+	RowsExamined MetricStats `json:"Rows_examined"`
+	RowsSent     MetricStats `json:"Rows_sent"`
+	QueryTime    MetricStats `json:"Query_time"`
+}
+
+type ReportFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Source string `json:"source,omitempty"`
+}
+
+type ReportGlobal struct {
+	UniqueQueryCount int           `json:"unique_query_count"`
+	Files            []ReportFile  `json:"files"`
+	QueryCount       int           `json:"query_count"`
+	TsMin            string        `json:"ts_min"`
+	TsMax            string        `json:"ts_max"`
+	Metrics          GlobalMetrics `json:"metrics"`
+	// 数据库引擎，pt-query-digest 的输出中没有该字段，为空时表示 MySQL
+	Engine string `json:"engine,omitempty"`
+	// 数据来源没有执行耗时（通用查询日志、binlog），只统计执行次数
+	NoLatency bool `json:"no_latency,omitempty"`
+	// 解析时发现的格式异常记录，pt-query-digest 的输出中没有该字段
+	ParseWarnings *ParseWarnings `json:"parse_warnings,omitempty"`
+}
+
+// ParseWarnings 格式异常记录的汇总，例如进程崩溃时被截断的记录、SQL 中的二进制内容
+type ParseWarnings struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	// 未参与统计的记录数，宽松模式下为全部格式异常的记录
+	Dropped int  `json:"dropped"`
+	Lenient bool `json:"lenient"`
+	// 按原因分组的记录数，按记录数降序排列
+	Reasons []ParseWarningReason `json:"reasons"`
+	// 保存被丢弃记录原文的隔离文件
+	Quarantine string `json:"quarantine,omitempty"`
+}
+
+type ParseWarningReason struct {
+	Reason string `json:"reason"`
+	Count  int    `json:"count"`
+}
+
+// ParseWarningSummary 报告中展示的解析警告
+type ParseWarningSummary struct {
+	*ParseWarnings
+	// 格式异常记录的原始内容大小
+	Size string
+	// 格式异常的记录占全部记录的比例
+	Pct string
+}
+
+func buildParseWarningSummary(report *Report) *ParseWarningSummary {
+	w := report.Global.ParseWarnings
+	if w == nil {
+		return nil
+	}
+	total := report.Global.QueryCount + w.Dropped
+	pct := 0.0
+	if total > 0 {
+		pct = float64(w.Entries) / float64(total) * 100
+	}
+	return &ParseWarningSummary{
+		ParseWarnings: w,
+		Size:          formatBytes(float64(w.Bytes)),
+		Pct:           fmt.Sprintf("%.2f%%", pct),
+	}
+}
+
+type ClassExample struct {
+	QueryTime string `json:"Query_time"`
+	Query     string `json:"query"`
+	Ts        string `json:"ts"`
+	AsSelect  string `json:"as_select,omitempty"`
+	Id        string `json:"Id,omitempty"`
+	// pt-query-digest 的示例中没有以下字段
+	Host string `json:"host,omitempty"`
+	User string `json:"user,omitempty"`
+}
+
+type ClassHistograms struct {
+	QueryTime []int `json:"Query_time"`
+}
+
+// FlagStats 布尔型指标（例如 Full_scan），Yes 为取值为 Yes 的次数
+type FlagStats struct {
+	Yes string `json:"yes"`
+}
+
+type ClassMetrics struct {
+	LockTime     MetricStats `json:"Lock_time"`
+	QueryLength  MetricStats `json:"Query_length"`
+	RowsSent     MetricStats `json:"Rows_sent"`
+	User         ValueMetric `json:"user"`
+	Db           ValueMetric `json:"db,omitempty"`
+	RowsExamined MetricStats `json:"Rows_examined"`
+	Host         ValueMetric `json:"host"`
+	QueryTime    MetricStats `json:"Query_time"`
+	// Percona Server / MariaDB 等输出的扩展指标，JSON 中与上面的字段平铺在同一层
+	Extra map[string]MetricStats `json:"-"`
+	Flags map[string]FlagStats   `json:"-"`
+}
+
+type classMetricsFields ClassMetrics
+
+func (m ClassMetrics) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(classMetricsFields(m))
+	if err != nil || len(m.Extra) == 0 && len(m.Flags) == 0 {
+		return data, err
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name, stats := range m.Extra {
+		fields[name] = stats
+	}
+	for name, flag := range m.Flags {
+		fields[name] = flag
+	}
+	return json.Marshal(fields)
+}
+
+func (m *ClassMetrics) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*classMetricsFields)(m)); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for name, raw := range fields {
+		switch name {
+		case "Lock_time", "Query_length", "Rows_sent", "user", "db", "Rows_examined", "host", "Query_time":
+			continue
+		}
+		var values map[string]json.RawMessage
+		if json.Unmarshal(raw, &values) != nil {
+			continue
+		}
+		if _, ok := values["yes"]; ok {
+			var flag FlagStats
+			if json.Unmarshal(raw, &flag) == nil {
+				if m.Flags == nil {
+					m.Flags = make(map[string]FlagStats)
+				}
+				m.Flags[name] = flag
+			}
+			continue
+		}
+		if _, ok := values["sum"]; ok {
+			var stats MetricStats
+			if json.Unmarshal(raw, &stats) == nil {
+				if m.Extra == nil {
+					m.Extra = make(map[string]MetricStats)
+				}
+				m.Extra[name] = stats
+			}
+		}
+	}
+	return nil
+}
+
+// ClassSource 一个类在某个日志来源（实例）上的执行次数和耗时
+type ClassSource struct {
+	Source     string      `json:"source"`
+	QueryCount int         `json:"query_count"`
+	QueryTime  MetricStats `json:"Query_time"`
+}
+
+// ClassFailures 被终止（Killed）或执行出错（Errno 非 0）的查询统计
+type ClassFailures struct {
+	Killed    int            `json:"killed"`
+	Errored   int            `json:"errored"`
+	Errnos    map[string]int `json:"errnos,omitempty"`
+	QueryTime MetricStats    `json:"Query_time"`
+}
+
+type ClassTable struct {
+	Status string `json:"status"`
+	Create string `json:"create"`
+}
+
+type ReportClass struct {
+	Distillate string       `json:"distillate"`
+	Example    ClassExample `json:"example"`
+	// 除 example 之外随机选取的示例，pt-query-digest 的输出中没有该字段
+	Samples     []ClassExample  `json:"samples,omitempty"`
+	Histograms  ClassHistograms `json:"histograms"`
+	Fingerprint string          `json:"fingerprint"`
+	Metrics     ClassMetrics    `json:"metrics"`
+	TsMin       string          `json:"ts_min"`
+	Attribute   string          `json:"attribute"`
+	TsMax       string          `json:"ts_max"`
+	Checksum    string          `json:"checksum"`
+	QueryCount  int             `json:"query_count"`
+	Tables      []ClassTable    `json:"tables,omitempty"`
+	Sources     []ClassSource   `json:"sources,omitempty"`
+	Failures    *ClassFailures  `json:"failures,omitempty"`
+}
+
+// Report 分析结果，既可以由 pt-query-digest 的 JSON 解码得到，也可以由内置解析器直接生成
+type Report struct {
+	Global  ReportGlobal  `json:"global"`
+	Classes []ReportClass `json:"classes"`
+}
+
+type SlowSqlInfo struct {
+	Id          string
+	RowsSum     string
+	RowsMax     string
+	LengthSum   string
+	LengthMax   string
+	TimeMax     string
+	TimeMin     string
+	Time95      string
+	TimeMedian  string
+	RowSendMax  string
+	QueryDb     string
+	QueryCount  int
+	QueryTables []string
+	Sql         string
+	// 格式化并高亮后的 SQL，用于详情中展示，复制时仍使用原始的 Sql
+	SqlHTML     template.HTML `json:"-"`
+	User        string
+	Host        string
+	LockTimeMax string
+	LockTimeMin string
+	LockTime95  string
+	QueryId     string
+	Timestamp   string
+	TimeSum     string
+	Sources     []SourceStat
+	SourceNames []string
+	Metrics     []ExtraMetric
+	Flags       []FlagStat
+	// 全表扫描、磁盘临时表等需要重点关注的执行特征
+	Badges []string
+	// 被终止和执行出错的次数
+	KilledCount   int
+	ErrorCount    int
+	ErrorCodes    string
+	FailedTimeMax string
+	// 执行次数占全部语句的比例
+	CountPct string
+	// 规范化后的 SQL 指纹和提炼形式，例如 "SELECT ehr.drs_external_api_log"
+	Fingerprint     string
+	FingerprintHTML template.HTML `json:"-"`
+	Distillate      string
+	// 示例，第一条为执行时间最长的一条，其余为随机选取
+	Samples []SqlSample
+	// Query_time 直方图各分桶的次数，分桶为 1us、10us ... 10s+，没有执行耗时的数据来源为空
+	Histogram []int
+}
+
+// SqlSample 详情中展示的一条示例
+type SqlSample struct {
+	Query     string
+	QueryHTML template.HTML `json:"-"`
+	QueryTime string
+	Ts        string
+	Host      string
+	User      string
+	ThreadId  string
+}
+
+// TableRow 以 JSON 嵌入 HTML 报告中的一行数据，用于在浏览器中排序、搜索和筛选，
+// 与表格中的行按下标一一对应
+type TableRow struct {
+	Id      string   `json:"id"`
+	Db      string   `json:"db"`
+	User    string   `json:"user"`
+	Host    string   `json:"host"`
+	Sources []string `json:"sources,omitempty"`
+	Tables  []string `json:"tables,omitempty"`
+	Count   int      `json:"count"`
+	// 执行时间和锁等待单位为秒，没有该指标时为 null
+	TimeMedian *float64 `json:"timeMedian"`
+	TimeMax    *float64 `json:"timeMax"`
+	Time95     *float64 `json:"time95"`
+	RowsSum    *float64 `json:"rowsSum"`
+	RowsMax    *float64 `json:"rowsMax"`
+	LockMax    *float64 `json:"lockMax"`
+	CountPct   float64  `json:"countPct"`
+	Badges     []string `json:"badges,omitempty"`
+	// 用于全文搜索的示例 SQL 和指纹
+	Sql         string `json:"sql"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// 生成嵌入报告的表格数据，顺序与 infos 相同
+func buildTableRows(infos []SlowSqlInfo, totalCount int) []TableRow {
+	rows := make([]TableRow, 0, len(infos))
+	for _, info := range infos {
+		row := TableRow{
+			Id:         info.Id,
+			Db:         info.QueryDb,
+			User:       info.User,
+			Host:       info.Host,
+			Sources:    info.SourceNames,
+			Tables:     info.QueryTables,
+			Count:      info.QueryCount,
+			TimeMedian: parseMetric(info.TimeMedian),
+			TimeMax:    parseMetric(info.TimeMax),
+			Time95:     parseMetric(info.Time95),
+			RowsSum:    parseMetric(info.RowsSum),
+			RowsMax:    parseMetric(info.RowsMax),
+			LockMax:    parseMetric(info.LockTimeMax),
+			Badges:     info.Badges,
+			Sql:        info.Sql,
+		}
+		if totalCount > 0 {
+			row.CountPct = float64(info.QueryCount) * 100 / float64(totalCount)
+		}
+		if info.Fingerprint != info.Sql {
+			row.Fingerprint = info.Fingerprint
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// 解析数值形式的指标，没有该指标时返回 nil
+func parseMetric(s string) *float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil
+	}
+	return &f
+}
+
+// TableStat 报告中展示的单张表的读写次数，用于找出写入热点
+type TableStat struct {
+	Table        string
+	Selects      int
+	Inserts      int
+	Updates      int
+	Deletes      int
+	Others       int
+	Writes       int
+	RowsAffected string
+}
+
+// ExtraMetric 报告中展示的扩展数值指标
+type ExtraMetric struct {
+	Name   string
+	Label  string
+	IsTime bool
+	Sum    string
+	Avg    string
+	Pct95  string
+	Max    string
+}
+
+// FlagStat 报告中展示的布尔型指标
+type FlagStat struct {
+	Name  string
+	Label string
+	Count int64
+	Pct   string
+}
+
+// SourceStat 报告中展示的单个来源的统计
+type SourceStat struct {
+	Source     string
+	QueryCount int
+	TimeAvg    string
+	Time95     string
+	TimeMax    string
+}
+
+// 扩展指标的中文名称及展示顺序
+var extraMetricLabels = []struct {
+	Name  string
+	Label string
+}{
+	{"Rows_affected", "影响行数"},
+	{"Bytes_sent", "发送字节数"},
+	{"Tmp_tables", "临时表数"},
+	{"Tmp_disk_tables", "磁盘临时表数"},
+	{"Tmp_table_sizes", "临时表大小"},
+	{"Merge_passes", "排序合并次数"},
+	{"InnoDB_IO_r_ops", "InnoDB读IO次数"},
+	{"InnoDB_IO_r_bytes", "InnoDB读IO字节数"},
+	{"InnoDB_IO_r_wait", "InnoDB读IO等待"},
+	{"InnoDB_rec_lock_wait", "InnoDB行锁等待"},
+	{"InnoDB_queue_wait", "InnoDB队列等待"},
+	{"InnoDB_pages_distinct", "InnoDB访问页数"},
+	{"Bytes_received", "接收字节数"},
+	{"Read_first", "读取索引首行次数"},
+	{"Read_last", "读取索引末行次数"},
+	{"Read_key", "索引读取次数"},
+	{"Read_next", "索引顺序读取次数"},
+	{"Read_prev", "索引逆序读取次数"},
+	{"Read_rnd", "按位置读取次数"},
+	{"Read_rnd_next", "数据文件顺序读取次数"},
+	{"Sort_merge_passes", "排序合并次数"},
+	{"Sort_range_count", "范围排序次数"},
+	{"Sort_rows", "排序行数"},
+	{"Sort_scan_count", "全表扫描排序次数"},
+	{"Created_tmp_tables", "临时表数"},
+	{"Created_tmp_disk_tables", "磁盘临时表数"},
+	{"Select_full_join", "无索引连接次数"},
+	{"Select_scan", "全表扫描次数"},
+	{"No_index_used", "未使用索引次数"},
+	{"No_good_index_used", "未使用合适索引次数"},
+	{"Warnings", "警告数"},
+	{"QC_hit", "查询缓存命中"},
+	{"Full_scan", "全表扫描"},
+	{"Full_join", "无索引连接"},
+	{"Tmp_table", "使用临时表"},
+	{"Tmp_table_on_disk", "磁盘临时表"},
+	{"Filesort", "文件排序"},
+	{"Filesort_on_disk", "磁盘文件排序"},
+	{"Priority_queue", "优先队列排序"},
+}
+
+func extraMetricOrder(name string) (int, string) {
+	for i, item := range extraMetricLabels {
+		if item.Name == name {
+			return i, item.Label
+		}
+	}
+	return len(extraMetricLabels), name
+}
+
+// 以 _wait 或 _time 结尾的扩展指标单位为秒
+func isTimeMetric(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasSuffix(lower, "_wait") || strings.HasSuffix(lower, "_time")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		oi, _ := extraMetricOrder(keys[i])
+		oj, _ := extraMetricOrder(keys[j])
+		if oi != oj {
+			return oi < oj
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// 生成扩展指标、布尔指标以及执行特征标记
+func buildExtraMetrics(info *SlowSqlInfo, metrics ClassMetrics, queryCount int) {
+	for _, name := range sortedKeys(metrics.Extra) {
+		stats := metrics.Extra[name]
+		_, label := extraMetricOrder(name)
+		info.Metrics = append(info.Metrics, ExtraMetric{
+			Name:   name,
+			Label:  label,
+			IsTime: isTimeMetric(name),
+			Sum:    stats.Sum,
+			Avg:    stats.Avg,
+			Pct95:  stats.Pct95,
+			Max:    stats.Max,
+		})
+	}
+	flagCounts := make(map[string]int64)
+	for _, name := range sortedKeys(metrics.Flags) {
+		count, _ := strconv.ParseInt(metrics.Flags[name].Yes, 10, 64)
+		flagCounts[name] = count
+		_, label := extraMetricOrder(name)
+		pct := "0%"
+		if queryCount > 0 {
+			pct = fmt.Sprintf("%.1f%%", float64(count)*100/float64(queryCount))
+		}
+		info.Flags = append(info.Flags, FlagStat{Name: name, Label: label, Count: count, Pct: pct})
+	}
+
+	// 任一扩展指标的总和大于 0
+	anyExtra := func(names ...string) bool {
+		for _, name := range names {
+			if stats, ok := metrics.Extra[name]; ok {
+				if sum, _ := strconv.ParseFloat(stats.Sum, 64); sum > 0 {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if flagCounts["Full_scan"] > 0 || anyExtra("No_index_used") {
+		info.Badges = append(info.Badges, "全表扫描")
+	}
+	if flagCounts["Full_join"] > 0 || anyExtra("Select_full_join") {
+		info.Badges = append(info.Badges, "无索引连接")
+	}
+	if flagCounts["Tmp_table_on_disk"] > 0 || anyExtra("Tmp_disk_tables", "Created_tmp_disk_tables") {
+		info.Badges = append(info.Badges, "磁盘临时表")
+	}
+	if flagCounts["Filesort_on_disk"] > 0 {
+		info.Badges = append(info.Badges, "磁盘文件排序")
+	}
+}
+
+// 取排序使用的指标值，key 可以是内置排序字段、扩展指标或布尔指标的名称
+func (s SlowSqlInfo) sortValue(key string) (float64, bool) {
+	var value string
+	switch strings.ToLower(key) {
+	case "time95", "":
+		value = s.Time95
+	case "count":
+		return float64(s.QueryCount), true
+	case "time_sum":
+		value = s.TimeSum
+	case "time_max":
+		value = s.TimeMax
+	case "time_median":
+		value = s.TimeMedian
+	case "rows_examined":
+		value = s.RowsSum
+	case "rows_max":
+		value = s.RowsMax
+	case "lock_time":
+		value = s.LockTimeMax
+	case "killed":
+		return float64(s.KilledCount), true
+	case "errors":
+		return float64(s.ErrorCount), true
+	default:
+		found := false
+		for _, m := range s.Metrics {
+			if strings.EqualFold(m.Name, key) {
+				value, found = m.Sum, true
+				break
+			}
+		}
+		for _, f := range s.Flags {
+			if strings.EqualFold(f.Name, key) {
+				return float64(f.Count), true
+			}
+		}
+		if !found {
+			return 0, false
+		}
+	}
+	v, _ := strconv.ParseFloat(value, 64)
+	return v, true
+}
+
+// 按指定指标降序排列
+func sortSlowSqlInfos(infos []SlowSqlInfo, key string) error {
+	known := key == ""
+	for _, info := range infos {
+		if _, ok := info.sortValue(key); ok {
+			known = true
+			break
+		}
+	}
+	if !known && len(infos) > 0 {
+		return fmt.Errorf("不支持的排序指标: %s", key)
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		vi, _ := infos[i].sortValue(key)
+		vj, _ := infos[j].sortValue(key)
+		return vi > vj
+	})
+	return nil
+}
+
+var quotedNameRegexp = regexp.MustCompile("`([^`]+)`|\"([^\"]+)\"")
+
+// 从 "SHOW CREATE TABLE `db`.`table`\G" 或 PostgreSQL 的 "\d+ "schema"."table"" 中提取表名
+func tableNameFromCreate(create string) string {
+	matches := quotedNameRegexp.FindAllStringSubmatch(create, -1)
+	if len(matches) == 0 {
+		return ""
+	}
+	last := matches[len(matches)-1]
+	return last[1] + last[2]
+}
+
+// 报告中 SQL 所属的方言，pt-query-digest 的输出中没有引擎字段，按 MySQL 处理
+func reportDialect(report *Report) sqlDialect {
+	if report.Global.Engine == dialectPostgres.engine() {
+		return dialectPostgres
+	}
+	return dialectMySQL
+}
+
+// 将分析结果转换为报告展示使用的 SlowSqlInfo 列表
+func buildSlowSqlInfos(report *Report) []SlowSqlInfo {
+	var slowSqlInfos []SlowSqlInfo
+	dialect := reportDialect(report)
+	for _, sqlInfo := range report.Classes {
+		var allTables []string
+		var slowSqlInfo SlowSqlInfo
+		for _, slowTable := range sqlInfo.Tables {
+			tableName := tableNameFromCreate(slowTable.Create)
+			if tableName == "" {
+				continue
+			}
+			if !hasDuplicate(allTables, tableName) {
+				allTables = append(allTables, tableName)
+			}
+		}
+		slowSqlInfo.RowsSum = sqlInfo.Metrics.RowsExamined.Sum
+		slowSqlInfo.RowsMax = sqlInfo.Metrics.RowsExamined.Max
+		slowSqlInfo.LengthSum = sqlInfo.Metrics.QueryLength.Sum
+		slowSqlInfo.LengthMax = sqlInfo.Metrics.QueryLength.Max
+		slowSqlInfo.TimeMax = sqlInfo.Metrics.QueryTime.Max
+		slowSqlInfo.TimeMin = sqlInfo.Metrics.QueryTime.Min
+		slowSqlInfo.Time95 = sqlInfo.Metrics.QueryTime.Pct95
+		slowSqlInfo.TimeMedian = sqlInfo.Metrics.QueryTime.Median
+		slowSqlInfo.RowSendMax = sqlInfo.Metrics.RowsSent.Max
+		slowSqlInfo.QueryDb = sqlInfo.Metrics.Db.Value
+		slowSqlInfo.QueryCount = sqlInfo.QueryCount
+		slowSqlInfo.Sql = sqlInfo.Example.Query
+		slowSqlInfo.Fingerprint = sqlInfo.Fingerprint
+		slowSqlInfo.Distillate = sqlInfo.Distillate
+		for _, example := range append([]ClassExample{sqlInfo.Example}, sqlInfo.Samples...) {
+			slowSqlInfo.Samples = append(slowSqlInfo.Samples, SqlSample{
+				Query:     example.Query,
+				QueryTime: example.QueryTime,
+				Ts:        example.Ts,
+				Host:      example.Host,
+				User:      example.User,
+				ThreadId:  example.Id,
+			})
+		}
+		slowSqlInfo.QueryTables = allTables
+		slowSqlInfo.Id = sqlInfo.Checksum
+		slowSqlInfo.User = sqlInfo.Metrics.User.Value
+		slowSqlInfo.Host = sqlInfo.Metrics.Host.Value
+		slowSqlInfo.LockTimeMax = sqlInfo.Metrics.LockTime.Max
+		slowSqlInfo.LockTimeMin = sqlInfo.Metrics.LockTime.Min
+		slowSqlInfo.LockTime95 = sqlInfo.Metrics.LockTime.Pct95
+		slowSqlInfo.QueryId = sqlInfo.Example.Id
+		slowSqlInfo.Timestamp = sqlInfo.Example.Ts
+		slowSqlInfo.TimeSum = sqlInfo.Metrics.QueryTime.Sum
+		if !report.Global.NoLatency {
+			slowSqlInfo.Histogram = sqlInfo.Histograms.QueryTime
+		}
+		if total := report.Global.QueryCount; total > 0 {
+			slowSqlInfo.CountPct = fmt.Sprintf("%.2f%%", float64(sqlInfo.QueryCount)*100/float64(total))
+		}
+		buildExtraMetrics(&slowSqlInfo, sqlInfo.Metrics, sqlInfo.QueryCount)
+		if f := sqlInfo.Failures; f != nil {
+			slowSqlInfo.KilledCount = f.Killed
+			slowSqlInfo.ErrorCount = f.Errored
+			slowSqlInfo.FailedTimeMax = f.QueryTime.Max
+			var codes []string
+			for _, errno := range sortedKeys(f.Errnos) {
+				codes = append(codes, fmt.Sprintf("%s×%d", errno, f.Errnos[errno]))
+			}
+			slowSqlInfo.ErrorCodes = strings.Join(codes, ", ")
+			if f.Killed > 0 {
+				slowSqlInfo.Badges = append(slowSqlInfo.Badges, fmt.Sprintf("被终止%d次", f.Killed))
+			}
+			if f.Errored > 0 {
+				slowSqlInfo.Badges = append(slowSqlInfo.Badges, fmt.Sprintf("出错%d次", f.Errored))
+			}
+		}
+		for _, src := range sqlInfo.Sources {
+			slowSqlInfo.Sources = append(slowSqlInfo.Sources, SourceStat{
+				Source:     src.Source,
+				QueryCount: src.QueryCount,
+				TimeAvg:    src.QueryTime.Avg,
+				Time95:     src.QueryTime.Pct95,
+				TimeMax:    src.QueryTime.Max,
+			})
+			slowSqlInfo.SourceNames = append(slowSqlInfo.SourceNames, src.Source)
+		}
+		highlightSlowSqlInfo(&slowSqlInfo, dialect)
+		slowSqlInfos = append(slowSqlInfos, slowSqlInfo)
+	}
+	return slowSqlInfos
+}
+
+// 格式化并高亮详情中展示的 SQL、指纹和示例
+func highlightSlowSqlInfo(info *SlowSqlInfo, dialect sqlDialect) {
+	info.SqlHTML = prettySQL(info.Sql, dialect)
+	info.FingerprintHTML = prettySQL(info.Fingerprint, dialect)
+	for i := range info.Samples {
+		info.Samples[i].QueryHTML = prettySQL(info.Samples[i].Query, dialect)
+	}
+}
+
+// 从 SHOW CREATE TABLE 或 \d+ 语句中提取带库名（schema）的表名
+func qualifiedNameFromCreate(create string) string {
+	var parts []string
+	for _, m := range quotedNameRegexp.FindAllStringSubmatch(create, -1) {
+		parts = append(parts, m[1]+m[2])
+	}
+	return strings.Join(parts, ".")
+}
+
+// 按表汇总各类语句的执行次数。写语句只计入第一张表（INSERT ... SELECT 的目标表），
+// 其余表按读取计数；binlog 的行事件同时累计变更的行数
+func buildTableStats(report *Report) []TableStat {
+	stats := make(map[string]*TableStat)
+	var order []string
+	rowsAffected := make(map[string]float64)
+	hasRows := make(map[string]bool)
+	for _, class := range report.Classes {
+		verb, _, _ := strings.Cut(class.Distillate, " ")
+		for i, t := range class.Tables {
+			name := qualifiedNameFromCreate(t.Create)
+			if name == "" {
+				continue
+			}
+			stat, ok := stats[name]
+			if !ok {
+				stat = &TableStat{Table: name}
+				stats[name] = stat
+				order = append(order, name)
+			}
+			if i > 0 && verb != "SELECT" {
+				stat.Selects += class.QueryCount
+				continue
+			}
+			switch verb {
+			case "SELECT":
+				stat.Selects += class.QueryCount
+			case "INSERT", "REPLACE", "LOAD":
+				stat.Inserts += class.QueryCount
+			case "UPDATE":
+				stat.Updates += class.QueryCount
+			case "DELETE":
+				stat.Deletes += class.QueryCount
+			default:
+				stat.Others += class.QueryCount
+			}
+			if m, ok := class.Metrics.Extra["Rows_affected"]; ok {
+				sum, _ := strconv.ParseFloat(m.Sum, 64)
+				rowsAffected[name] += sum
+				hasRows[name] = true
+			}
+		}
+	}
+	result := make([]TableStat, 0, len(order))
+	for _, name := range order {
+		stat := stats[name]
+		stat.Writes = stat.Inserts + stat.Updates + stat.Deletes
+		if hasRows[name] {
+			stat.RowsAffected = formatCount(rowsAffected[name])
+		}
+		result = append(result, *stat)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Writes != result[j].Writes {
+			return result[i].Writes > result[j].Writes
+		}
+		return result[i].Selects+result[i].Others > result[j].Selects+result[j].Others
+	})
+	return result
+}
+
+// 从所有查询中找出最早和最晚的时间
+func reportTimeRange(report *Report) (string, string) {
+	if len(report.Classes) == 0 {
+		return "", ""
+	}
+	minTime := report.Classes[0].TsMin
+	maxTime := report.Classes[0].TsMax
+	for _, class := range report.Classes {
+		if class.TsMin != "" && (minTime == "" || class.TsMin < minTime) {
+			minTime = class.TsMin
+		}
+		if class.TsMax > maxTime {
+			maxTime = class.TsMax
+		}
+	}
+	return formatMysqlTimestamp(minTime), formatMysqlTimestamp(maxTime)
+}
+
+// PostgreSQL 中查看表统计信息和表结构的语句，未指定 schema 的表按 search_path 查找
+func pgClassTableFor(schema, table string) ClassTable {
+	if schema == "" {
+		return ClassTable{
+			Status: "SELECT * FROM pg_stat_user_tables WHERE relname = '" + table + "';",
+			Create: "\\d+ \"" + table + "\"",
+		}
+	}
+	return ClassTable{
+		Status: "SELECT * FROM pg_stat_user_tables WHERE schemaname = '" + schema + "' AND relname = '" + table + "';",
+		Create: "\\d+ \"" + schema + "\".\"" + table + "\"",
+	}
+}
+
+// 生成 pt-query-digest 风格的 SHOW CREATE TABLE / SHOW TABLE STATUS 语句
+func classTableFor(db, table string) ClassTable {
+	if db == "" {
+		return ClassTable{
+			Status: "SHOW TABLE STATUS LIKE '" + table + "'\\G",
+			Create: "SHOW CREATE TABLE `" + table + "`\\G",
+		}
+	}
+	return ClassTable{
+		Status: "SHOW TABLE STATUS FROM `" + db + "` LIKE '" + table + "'\\G",
+		Create: "SHOW CREATE TABLE `" + db + "`.`" + strings.Trim(table, "`") + "`\\G",
+	}
+}
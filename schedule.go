@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 定时报告的 ID 前缀，报告文件名为 slowsql-analysis-schedule-<名称>-<执行时间>
+	scheduleIdPrefix = "schedule-"
+	// 查找 cron 表达式下一次执行时间的范围，超过时认为表达式没有匹配的时间，例如 2 月 30 日
+	cronSearchLimit = 5
+)
+
+// 定时报告的名称，用于报告文件名
+var scheduleNamePattern = regexp.MustCompile(`^[0-9A-Za-z_\-]{1,32}$`)
+
+// 定时报告的 ID，第一组为定时报告的名称
+var scheduleReportPattern = regexp.MustCompile(`^` + scheduleIdPrefix + `([0-9A-Za-z_\-]+)-(\d{4}-\d{2}-\d{2}-\d{2}-\d{2})$`)
+
+// cron 表达式的简写
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// cronSchedule 5 段的 cron 表达式: 分钟 小时 日 月 星期，每段用位表示匹配的取值
+type cronSchedule struct {
+	minute, hour, day, month, weekday uint64
+	// 日和星期是否以 * 开头，两者都有限制时满足其一即可，与 cron 相同
+	anyDay, anyWeekday bool
+}
+
+// 解析 cron 表达式，每段支持 *、数字、范围 1-5、列表 1,3,5 和步长 */15
+func parseCron(spec string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron 表达式应为 5 段（分钟 小时 日 月 星期）: %s", spec)
+	}
+	c := &cronSchedule{anyDay: strings.HasPrefix(fields[2], "*"), anyWeekday: strings.HasPrefix(fields[4], "*")}
+	parts := []struct {
+		bits     *uint64
+		min, max int
+		name     string
+	}{
+		{&c.minute, 0, 59, "分钟"},
+		{&c.hour, 0, 23, "小时"},
+		{&c.day, 1, 31, "日"},
+		{&c.month, 1, 12, "月"},
+		{&c.weekday, 0, 7, "星期"},
+	}
+	for i, part := range parts {
+		bits, err := parseCronField(fields[i], part.min, part.max)
+		if err != nil {
+			return nil, fmt.Errorf("cron 表达式中的%s错误: %w", part.name, err)
+		}
+		*part.bits = bits
+	}
+	// 星期中的 7 和 0 都表示星期日
+	if c.weekday&(1<<7) != 0 {
+		c.weekday |= 1
+	}
+	return c, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		expr, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("步长 %s 应为正整数", stepText)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if expr != "*" {
+			from, to, isRange := strings.Cut(expr, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil || lo < min || lo > max {
+				return 0, fmt.Errorf("%s 应为 %d 到 %d 之间的数字", part, min, max)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil || hi < lo || hi > max {
+					return 0, fmt.Errorf("%s 应为 %d 到 %d 之间的范围", part, min, max)
+				}
+			} else if hasStep {
+				// 5/15 表示从 5 开始每隔 15
+				hi = max
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// 晚于 t 的下一个执行时间，没有匹配的时间时返回零值
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchLimit, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	day := c.day&(1<<uint(t.Day())) != 0
+	weekday := c.weekday&(1<<uint(t.Weekday())) != 0
+	if c.anyDay || c.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// 根据计划执行的时间计算分析的时间范围:
+// yesterday 为前一天 00:00 至当天 00:00，today 为当天 00:00 至执行时间，
+// lastHour 为上一个整点小时，last 加时长（例如 last30m、last6h）为执行时间之前的一段时间
+func scheduleWindow(window string, at time.Time) (time.Time, time.Time, error) {
+	year, month, day := at.Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, at.Location())
+	switch window {
+	case "yesterday":
+		return midnight.AddDate(0, 0, -1), midnight, nil
+	case "today":
+		return midnight, at, nil
+	case "lastHour":
+		end := time.Date(year, month, day, at.Hour(), 0, 0, 0, at.Location())
+		return end.Add(-time.Hour), end, nil
+	}
+	if text, ok := strings.CutPrefix(window, "last"); ok {
+		if d, err := time.ParseDuration(text); err == nil && d > 0 {
+			return at.Add(-d), at, nil
+		}
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("不支持的时间窗口: %s（可选 yesterday、today、lastHour，或 last 加时长，例如 last30m、last6h）", window)
+}
+
+// reportSchedule 定时报告的配置和最近一次执行的结果
+type reportSchedule struct {
+	Name   string
+	Spec   string
+	Window string
+	// 分析的日志的来源标签，为空时分析 -f 指定的所有日志
+	Sources []string
+	Next    time.Time
+	Running bool
+	// 最近一次执行的时间、生成的分析结果和错误，重启后从报告目录中最新的报告恢复
+	LastRun      time.Time
+	LastAnalysis string
+	LastError    string
+
+	cron   *cronSchedule
+	inputs []logInput
+}
+
+// reportScheduler 按 cron 表达式定时分析日志，报告保存在报告目录中，每个定时报告只保留最近的若干份
+type reportScheduler struct {
+	mu        sync.Mutex
+	schedules []*reportSchedule
+	reportDir string
+	// 每个定时报告保留的报告数，超过时删除最早的报告
+	keep int
+	// 定时报告使用的参数，来自命令行，时间范围由时间窗口决定
+	defaults reportRequest
+	// 分析完成后保存结果，供首页和 JSON 接口查询
+	analyses *analysisStore
+	// 停止时关闭 stop，正在执行的分析结束后关闭 done
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newReportScheduler(path string, inputs []logInput, defaults reportRequest, keep int, reportDir string, analyses *analysisStore) (*reportScheduler, error) {
+	s := &reportScheduler{
+		reportDir: reportDir,
+		keep:      keep,
+		defaults:  defaults,
+		analyses:  analyses,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	var err error
+	if s.schedules, err = readScheduleFile(path, inputs); err != nil {
+		return nil, err
+	}
+	if len(s.schedules) == 0 {
+		return nil, fmt.Errorf("%s 中没有定时报告", path)
+	}
+	for _, schedule := range s.schedules {
+		if ids := s.archived(schedule.Name); len(ids) > 0 {
+			schedule.LastAnalysis = ids[0]
+			if info, err := os.Stat(filepath.Join(reportDir, reportFilePrefix+ids[0]+".json")); err == nil {
+				schedule.LastRun = info.ModTime()
+			}
+		}
+	}
+	return s, nil
+}
+
+// 读取定时报告的配置文件，每行一条 "名称 = cron 表达式 时间窗口 [来源标签,...]"，# 开头的行为注释
+func readScheduleFile(path string, inputs []logInput) ([]*reportSchedule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var schedules []*reportSchedule
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		schedule, err := parseScheduleLine(line, inputs)
+		if err != nil {
+			return nil, fmt.Errorf("%s 第 %d 行: %w", path, lineNo, err)
+		}
+		for _, other := range schedules {
+			if other.Name == schedule.Name {
+				return nil, fmt.Errorf("%s 第 %d 行: 定时报告 %s 重复", path, lineNo, schedule.Name)
+			}
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, scanner.Err()
+}
+
+func parseScheduleLine(line string, inputs []logInput) (*reportSchedule, error) {
+	name, rest, ok := strings.Cut(line, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return nil, errors.New("格式错误，应为 名称 = cron 表达式 时间窗口 [来源标签]")
+	}
+	if !scheduleNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("名称 %s 只能包含字母、数字、下划线和 -，最长 32 个字符", name)
+	}
+	fields := strings.Fields(rest)
+	n := 5
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		n = 1
+	}
+	if len(fields) < n+1 || len(fields) > n+2 {
+		return nil, errors.New("格式错误，应为 名称 = cron 表达式 时间窗口 [来源标签]")
+	}
+	schedule := &reportSchedule{Name: name, Spec: strings.Join(fields[:n], " "), Window: fields[n]}
+	var err error
+	if schedule.cron, err = parseCron(schedule.Spec); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if _, _, err := scheduleWindow(schedule.Window, now); err != nil {
+		return nil, err
+	}
+	if schedule.Next = schedule.cron.next(now); schedule.Next.IsZero() {
+		return nil, fmt.Errorf("cron 表达式 %s 没有匹配的时间", schedule.Spec)
+	}
+	schedule.inputs = inputs
+	if len(fields) == n+2 && fields[n+1] != "*" {
+		schedule.Sources = strings.Split(fields[n+1], ",")
+		schedule.inputs = nil
+		for _, source := range schedule.Sources {
+			found := false
+			for _, input := range inputs {
+				if input.Source == source {
+					schedule.inputs = append(schedule.inputs, input)
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("没有来源标签为 %s 的日志文件", source)
+			}
+		}
+	}
+	return schedule, nil
+}
+
+func (s *reportScheduler) start() {
+	go s.run()
+}
+
+// 停止定时执行，等待正在执行的分析结束
+func (s *reportScheduler) shutdown(ctx context.Context) {
+	close(s.stop)
+	s.mu.Lock()
+	running := false
+	for _, schedule := range s.schedules {
+		running = running || schedule.Running
+	}
+	s.mu.Unlock()
+	if running {
+		printColoredInfo("yellow", "等待执行中的定时报告结束...")
+	}
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		printColoredInfo("yellow", "等待定时报告结束超时，未完成的报告已放弃")
+	}
+}
+
+func (s *reportScheduler) run() {
+	defer close(s.done)
+	for {
+		at, due := s.due()
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		for _, schedule := range due {
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+			s.execute(schedule, at)
+		}
+	}
+}
+
+// 最早的下一次执行时间，以及在该时间执行的定时报告
+func (s *reportScheduler) due() (time.Time, []*reportSchedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var at time.Time
+	var due []*reportSchedule
+	for _, schedule := range s.schedules {
+		switch {
+		case at.IsZero() || schedule.Next.Before(at):
+			at, due = schedule.Next, []*reportSchedule{schedule}
+		case schedule.Next.Equal(at):
+			due = append(due, schedule)
+		}
+	}
+	return at, due
+}
+
+// 按计划执行的时间 at 计算时间窗口并生成报告，分析期间错过的执行时间不再补做
+func (s *reportScheduler) execute(schedule *reportSchedule, at time.Time) {
+	start, end, _ := scheduleWindow(schedule.Window, at)
+	req := s.defaults
+	req.Inputs = schedule.inputs
+	req.StartTime = start.Format("2006-01-02 15:04:05")
+	req.EndTime = end.Format("2006-01-02 15:04:05")
+	id := fmt.Sprintf("%s%s-%s", scheduleIdPrefix, schedule.Name, at.Format("2006-01-02-15-04"))
+	req.FileName = filepath.Join(s.reportDir, reportFilePrefix+id+".html")
+	// 重启后从 JSON 导出文件中读取报告
+	if !hasDuplicate(strings.Split(req.Export, ","), "json") {
+		req.Export = strings.Trim(req.Export+",json", ",")
+	}
+	s.update(func() { schedule.Running = true })
+	printColoredInfo("blue", "开始生成定时报告 %s: %s 至 %s", schedule.Name, req.StartTime, req.EndTime)
+	var result *reportResult
+	err := func() (err error) {
+		// 分析出错不能影响Web服务
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("分析时发生内部错误: %v", r)
+			}
+		}()
+		result, err = generateReport(req)
+		return err
+	}()
+	if err == nil {
+		s.analyses.add(result)
+		printColoredInfo("green", "定时报告 %s 生成完成: analyses/%s", schedule.Name, result.Id)
+		s.prune(schedule.Name)
+	} else {
+		printColoredInfo("red", "定时报告 %s 生成失败: %s", schedule.Name, err.Error())
+	}
+	finished := time.Now()
+	s.update(func() {
+		schedule.Running = false
+		schedule.LastRun = finished
+		schedule.LastError = ""
+		if err != nil {
+			schedule.LastError = err.Error()
+		} else {
+			schedule.LastAnalysis = result.Id
+		}
+		schedule.Next = schedule.cron.next(finished)
+	})
+}
+
+func (s *reportScheduler) update(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+}
+
+// 定时报告的状态，返回副本避免与执行中的报告并发读写
+func (s *reportScheduler) list() []reportSchedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]reportSchedule, 0, len(s.schedules))
+	for _, schedule := range s.schedules {
+		list = append(list, *schedule)
+	}
+	return list
+}
+
+// 报告目录中该定时报告的所有报告 ID，最新的在前
+func (s *reportScheduler) archived(name string) []string {
+	entries, err := os.ReadDir(s.reportDir)
+	if err != nil {
+		return nil
+	}
+	var ids []string
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if !reportFilePattern.MatchString(fileName) {
+			continue
+		}
+		id := analysisId(fileName)
+		if m := scheduleReportPattern.FindStringSubmatch(id); m != nil && m[1] == name && !hasDuplicate(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	// ID 以执行时间结尾，按字符串倒序即从新到旧
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	return ids
+}
+
+// 删除超过保留数的报告、导出文件和隔离文件
+func (s *reportScheduler) prune(name string) {
+	ids := s.archived(name)
+	if len(ids) <= s.keep {
+		return
+	}
+	for _, id := range ids[s.keep:] {
+		base := filepath.Join(s.reportDir, reportFilePrefix+id)
+		for ext := range reportContentTypes {
+			os.Remove(base + ext)
+		}
+		os.Remove(base + "-quarantine.log")
+		s.analyses.remove(id)
+	}
+	printColoredInfo("blue", "定时报告 %s 删除了 %d 份较早的报告", name, len(ids)-s.keep)
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Web服务的超时设置
+const (
+	serverReadHeaderTimeout = 10 * time.Second
+	// 读取请求的超时，上传日志和接收推送的接口单独放宽
+	serverReadTimeout = time.Minute
+	// 写入响应的超时，足够传输较大的报告和导出文件
+	serverWriteTimeout = 5 * time.Minute
+	serverIdleTimeout  = 2 * time.Minute
+	// 停止时等待进行中的请求和分析任务结束的时间
+	serverShutdownTimeout = 30 * time.Second
+)
+
+// 报告文件名的前缀，Web服务只提供以此开头的 HTML 报告和导出文件
+const reportFilePrefix = "slowsql-analysis-"
+
+// 可以通过Web服务访问的报告文件，隔离文件、日志和其他文件一律不提供
+var reportFilePattern = regexp.MustCompile(`^` + reportFilePrefix + `[0-9A-Za-z_\-]+\.(html|json|csv)$`)
+
+// 报告文件的 Content-Type，不依赖系统的 MIME 配置
+var reportContentTypes = map[string]string{
+	".html": "text/html; charset=utf-8",
+	".json": "application/json; charset=utf-8",
+	".csv":  "text/csv; charset=utf-8",
+}
+
+// webOptions Web服务的监听地址、认证和 HTTPS 配置
+type webOptions struct {
+	Port int
+	// 监听地址，为空时监听所有网卡
+	Bind string
+	// 监听所有网卡时，打印的访问地址是否包含 IPv6 地址
+	IPv6 bool
+	Auth *serverAuth
+	// 上传日志的分析任务，为 nil 时不提供上传
+	Jobs *jobManager
+	// 可以通过 JSON 接口查询的分析结果
+	Analyses *analysisStore
+	// 持续读取日志新增记录的实时监控，为 nil 时不提供实时监控页面
+	Live *liveMonitor
+	// 各实例推送的分析结果，为 nil 时不接收推送
+	Fleet *fleetStore
+	// 定时生成的报告，为 nil 时没有配置定时报告
+	Schedules *reportScheduler
+	// 是否启用 HTTPS，没有指定证书时使用自签名证书
+	TLS     bool
+	TLSCert string
+	TLSKey  string
+}
+
+func (o webOptions) check() error {
+	if (o.TLSCert == "") != (o.TLSKey == "") {
+		return errors.New("-tlsCert 和 -tlsKey 需要同时指定")
+	}
+	if o.TLSCert != "" {
+		if _, err := tls.LoadX509KeyPair(o.TLSCert, o.TLSKey); err != nil {
+			return fmt.Errorf("读取证书失败: %w", err)
+		}
+	}
+	return nil
+}
+
+// 生成 TLS 配置，使用自签名证书时同时返回证书指纹
+func (o webOptions) tlsConfig(addrs []string) (*tls.Config, string, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(o.TLSCert, o.TLSKey)
+		if err != nil {
+			return nil, "", err
+		}
+		config.Certificates = []tls.Certificate{cert}
+		return config, "", nil
+	}
+	cert, err := selfSignedCertificate(selfSignedHosts(addrs))
+	if err != nil {
+		return nil, "", err
+	}
+	config.Certificates = []tls.Certificate{cert}
+	return config, certificateFingerprint(cert), nil
+}
+
+// 监听地址是否只能从本机访问
+func (o webOptions) loopback() bool {
+	if o.Bind == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(o.Bind)
+	return ip != nil && ip.IsLoopback()
+}
+
+// 打印的访问地址，监听所有网卡时为本机的各个 IP，获取失败或没有可用的地址时只打印本机访问地址
+func (o webOptions) addrs() []string {
+	ip := net.ParseIP(o.Bind)
+	if o.Bind != "" && (ip == nil || !ip.IsUnspecified()) {
+		return []string{o.Bind}
+	}
+	// 监听 0.0.0.0 时无法通过 IPv6 地址访问
+	ips, err := getLocalIPs(o.IPv6 && (ip == nil || ip.To4() == nil))
+	if err != nil {
+		printColoredInfo("yellow", "警告: 获取本机IP地址失败: %s，只打印本机访问地址", err.Error())
+	}
+	if len(ips) == 0 {
+		return []string{"127.0.0.1"}
+	}
+	return ips
+}
+
+// reportServer 提供内存中的分析结果和报告目录中生成的报告，不列出目录，也不提供目录中的其他文件
+type reportServer struct {
+	dir    string
+	index  *template.Template
+	upload *template.Template
+	live   *template.Template
+	fleet  *template.Template
+	// 上传日志的分析任务，为 nil 时不提供上传页面和接口
+	jobs *jobManager
+	// JSON 接口查询的分析结果
+	analyses *analysisStore
+	// 实时监控，为 nil 时不提供实时监控页面和事件流
+	monitor *liveMonitor
+	// 多实例汇总，为 nil 时不提供汇总页面和推送接口
+	instances *fleetStore
+	// 定时报告，为 nil 时首页不展示定时报告的状态
+	schedules *reportScheduler
+}
+
+// reportEntry 首页列出的一份报告及其导出文件
+type reportEntry struct {
+	Id string
+	// 报告目录中的 HTML 报告，只在内存中保留时为空
+	Name string
+	// 报告的访问路径，内存中的分析结果为按请求生成的报告
+	Link    string
+	ModTime time.Time
+	Size    string
+	Exports []string
+	// 是否为本次启动后生成、保留在内存中的分析结果
+	Live bool
+	// 定时报告的名称，不是定时生成的报告时为空
+	Schedule string
+}
+
+func newReportServer(dir string, web webOptions) (*reportServer, error) {
+	s := &reportServer{dir: dir, jobs: web.Jobs, analyses: web.Analyses, monitor: web.Live, instances: web.Fleet, schedules: web.Schedules}
+	var err error
+	if s.index, err = parsePageTemplate("index.html"); err != nil {
+		return nil, err
+	}
+	if s.upload, err = parsePageTemplate("upload.html"); err != nil {
+		return nil, err
+	}
+	if s.live, err = parsePageTemplate("live.html"); err != nil {
+		return nil, err
+	}
+	if s.fleet, err = parsePageTemplate("fleet.html"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// 页面模板中使用的函数
+var pageFuncMap = template.FuncMap{
+	// 以秒为单位的执行时间，没有执行耗时时为 "-"
+	"seconds": func(v *float64) string {
+		if v == nil {
+			return "-"
+		}
+		return strconv.FormatFloat(*v, 'f', 3, 64) + "s"
+	},
+}
+
+func parsePageTemplate(name string) (*template.Template, error) {
+	content, err := templateFS.ReadFile("template/" + name)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(name).Funcs(pageFuncMap).Parse(string(content))
+}
+
+func (s *reportServer) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handleIndex)
+	mux.HandleFunc("GET /{name}", s.handleReport)
+	mux.HandleFunc("GET /analyses/{id}", s.handleAnalysisReport)
+	mux.HandleFunc("GET /api/openapi.json", handleOpenAPI)
+	mux.HandleFunc("GET /api/analyses", s.handleAnalyses)
+	mux.HandleFunc("GET /api/analyses/{id}", s.handleSummary)
+	mux.HandleFunc("GET /api/analyses/{id}/classes", s.handleClasses)
+	mux.HandleFunc("GET /api/analyses/{id}/classes/{checksum}", s.handleClass)
+	mux.HandleFunc("GET /api/analyses/{id}/tables", s.handleTables)
+	if s.jobs != nil {
+		mux.HandleFunc("GET /upload", s.handleUpload)
+		mux.Handle("POST /api/analyze", sameOrigin(http.HandlerFunc(s.jobs.handleAnalyze)))
+		mux.HandleFunc("GET /api/jobs/{id}", s.jobs.handleJob)
+	}
+	if s.monitor != nil {
+		mux.HandleFunc("GET /live", s.handleLive)
+		mux.HandleFunc("GET /live/events", s.monitor.handleEvents)
+	}
+	if s.instances != nil {
+		mux.HandleFunc("GET /fleet", s.handleFleet)
+		mux.HandleFunc("GET /api/instances", s.instances.handleInstances)
+		mux.Handle("POST /api/instances/{name}", sameOrigin(http.HandlerFunc(s.instances.handlePush)))
+		mux.Handle("DELETE /api/instances/{name}", sameOrigin(http.HandlerFunc(s.instances.handleDelete)))
+		mux.HandleFunc("GET /api/fleet/classes", s.instances.handleClasses)
+	}
+	return mux
+}
+
+// 拒绝其他网站发起的请求，浏览器中缓存的认证信息会随跨站的表单提交一起发送
+func sameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || u.Host != r.Host {
+				writeJSONError(w, http.StatusForbidden, "不允许跨站请求")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 所有响应共用的安全相关响应头
+func setSecurityHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("Referrer-Policy", "no-referrer")
+}
+
+// 首页，按生成时间从新到旧列出报告
+func (s *reportServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	reports, err := s.listReports()
+	if err != nil {
+		printColoredInfo("red", "读取报告目录失败: %s", err.Error())
+		http.Error(w, "读取报告目录失败", http.StatusInternalServerError)
+		return
+	}
+	setSecurityHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// 报告列表随时可能变化，不缓存
+	w.Header().Set("Cache-Control", "no-store")
+	page := struct {
+		Reports   []reportEntry
+		Schedules []reportSchedule
+		Upload    bool
+		Live      bool
+		Fleet     bool
+	}{Reports: reports, Upload: s.jobs != nil, Live: s.monitor != nil, Fleet: s.instances != nil}
+	if s.schedules != nil {
+		page.Schedules = s.schedules.list()
+	}
+	if err := s.index.Execute(w, page); err != nil {
+		printColoredInfo("red", "生成报告列表失败: %s", err.Error())
+	}
+}
+
+// 多实例汇总页面，列出各实例最近一次推送的结果，以及按指纹汇总所有实例后的查询类
+func (s *reportServer) handleFleet(w http.ResponseWriter, r *http.Request) {
+	sortKey := r.URL.Query().Get("sort")
+	if sortKey == "" {
+		sortKey = "timeSum"
+	}
+	if !fleetSortKeys[sortKey] {
+		http.Error(w, "参数 sort 错误: 可选 timeSum、count、timeMax、instances", http.StatusBadRequest)
+		return
+	}
+	limit := classPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > classPageSizeMax {
+			http.Error(w, fmt.Sprintf("参数 limit 错误: 应为 1 到 %d", classPageSizeMax), http.StatusBadRequest)
+			return
+		}
+	}
+	classes := s.instances.classes(sortKey)
+	page := struct {
+		Instances []fleetInstance
+		Classes   []fleetClass
+		Total     int
+		Sort      string
+		Limit     int
+	}{s.instances.list(), classes[:min(limit, len(classes))], len(classes), sortKey, limit}
+	setSecurityHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := s.fleet.Execute(w, page); err != nil {
+		printColoredInfo("red", "生成汇总页面失败: %s", err.Error())
+	}
+}
+
+// 实时监控页面，通过 live/events 事件流接收更新
+func (s *reportServer) handleLive(w http.ResponseWriter, r *http.Request) {
+	setSecurityHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	page := struct {
+		Analysis string
+		Sources  []string
+	}{Analysis: s.monitor.Analysis}
+	for _, input := range s.monitor.inputs {
+		page.Sources = append(page.Sources, input.Path)
+	}
+	if err := s.live.Execute(w, page); err != nil {
+		printColoredInfo("red", "生成实时监控页面失败: %s", err.Error())
+	}
+}
+
+// 上传日志的页面
+func (s *reportServer) handleUpload(w http.ResponseWriter, r *http.Request) {
+	setSecurityHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	page := struct {
+		MaxUpload string
+		Redact    string
+	}{MaxUpload: formatBytes(float64(s.jobs.maxUpload))}
+	if r := s.jobs.defaults.Options.Redactor; r != nil {
+		page.Redact = r.Level
+	}
+	if err := s.upload.Execute(w, page); err != nil {
+		printColoredInfo("red", "生成上传页面失败: %s", err.Error())
+	}
+}
+
+func (s *reportServer) handleReport(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !reportFilePattern.MatchString(name) {
+		http.NotFound(w, r)
+		return
+	}
+	path := filepath.Join(s.dir, name)
+	// 不跟随符号链接，避免通过链接访问报告目录以外的文件
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	setSecurityHeaders(w)
+	w.Header().Set("Content-Type", reportContentTypes[filepath.Ext(name)])
+	// 同名报告可能在同一分钟内被重新生成，每次使用前向服务端确认，未修改时返回 304
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// 列出内存中的分析结果和报告目录中的报告，同名的 JSON、CSV 导出文件归到对应报告下
+func (s *reportServer) listReports() ([]reportEntry, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	reports := make(map[string]*reportEntry)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !reportFilePattern.MatchString(name) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		id := analysisId(name)
+		report, ok := reports[id]
+		if !ok {
+			report = &reportEntry{Id: id, ModTime: info.ModTime()}
+			reports[id] = report
+		}
+		if filepath.Ext(name) != ".html" {
+			report.Exports = append(report.Exports, name)
+			continue
+		}
+		report.Name = name
+		report.ModTime = info.ModTime()
+		report.Size = formatBytes(float64(info.Size()))
+	}
+	for _, analysis := range s.analyses.live() {
+		report, ok := reports[analysis.Id]
+		if !ok {
+			report = &reportEntry{Id: analysis.Id}
+			reports[analysis.Id] = report
+		}
+		report.Live = true
+		report.ModTime = analysis.Created
+	}
+	list := make([]reportEntry, 0, len(reports))
+	for _, report := range reports {
+		// 内存中的分析结果和只有 JSON 导出文件的报告按请求生成，其余直接提供 HTML 文件
+		switch {
+		case report.Live || report.Name == "" && report.hasJSON():
+			report.Link = "analyses/" + report.Id
+		default:
+			report.Link = report.Name
+		}
+		if m := scheduleReportPattern.FindStringSubmatch(report.Id); m != nil {
+			report.Schedule = m[1]
+		}
+		list = append(list, *report)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].ModTime.Equal(list[j].ModTime) {
+			return list[i].ModTime.After(list[j].ModTime)
+		}
+		return list[i].Id > list[j].Id
+	})
+	return list, nil
+}
+
+func (e reportEntry) hasJSON() bool {
+	return hasDuplicate(e.Exports, reportFilePrefix+e.Id+".json")
+}
+
+// GET /analyses/{id}，按请求生成 HTML 报告。sort 重新排序，limit 只展示排序后的前 N 类，
+// redact 在保存的结果上再次脱敏，format 为 json、csv 时下载对应格式的导出文件
+func (s *reportServer) handleAnalysisReport(w http.ResponseWriter, r *http.Request) {
+	entry, err := s.analyses.get(r.PathValue("id"))
+	if err != nil {
+		printColoredInfo("red", "%s", err.Error())
+		http.Error(w, "读取分析结果失败", http.StatusInternalServerError)
+		return
+	}
+	if entry == nil {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	var redactor *sqlRedactor
+	if level := q.Get("redact"); level != "" && level != redactNone {
+		if redactor = s.analyses.redactors[level]; redactor == nil {
+			http.Error(w, "不支持的脱敏级别: "+level+"（可选 none、fingerprint、literals、pii）", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			http.Error(w, "参数 limit 错误: 至少为 1", http.StatusBadRequest)
+			return
+		}
+	}
+	format := q.Get("format")
+	if format != "" && format != "html" && format != "json" && format != "csv" {
+		http.Error(w, "不支持的格式: "+format+"（可选 html、json、csv）", http.StatusBadRequest)
+		return
+	}
+	data, err := entry.view(redactor, q.Get("sort"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	setSecurityHeaders(w)
+	// 每次请求按参数重新生成，不缓存
+	w.Header().Set("Cache-Control", "no-store")
+	switch format {
+	case "json", "csv":
+		w.Header().Set("Content-Type", reportContentTypes["."+format])
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s%s.%s"`, reportFilePrefix, entry.Id, format))
+		if format == "json" {
+			err = writeJSONReport(w, data)
+		} else {
+			err = writeCSVReport(w, data)
+		}
+	default:
+		w.Header().Set("Content-Type", reportContentTypes[".html"])
+		err = renderHTMLReport(w, data)
+	}
+	if err != nil {
+		printColoredInfo("red", "生成报告失败: %s", err.Error())
+	}
+}
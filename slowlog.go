@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// slowEntry 慢查询日志中的一条记录
+type slowEntry struct {
+	Ts           time.Time
+	User         string
+	Host         string
+	Db           string
+	ThreadId     string
+	QueryTime    float64
+	LockTime     float64
+	RowsSent     float64
+	RowsExamined float64
+	// 头部中除上述字段之外的其他属性，例如 Percona Server 的 Bytes_sent
+	Attrs map[string]string
+	Query string
+	// 记录所属的日志来源标签
+	Source string
+	// 记录在日志文件中的起始偏移量
+	Offset int64
+	// 格式异常的原因，为空表示记录正常
+	Malformed string
+	// 格式异常的记录的原始内容，用于写入隔离文件
+	Raw string
+	// 分片中第一次出现数据库之前、没有数据库的记录，合并时使用前一个分片最后的数据库
+	dbPending bool
+}
+
+var (
+	userHostRegexp   = regexp.MustCompile(`^# User@Host:\s+(\S*?)\[[^\]]*\]\s+@\s+(\S*)\s*\[([^\]]*)\](?:\s+Id:\s+(\d+))?`)
+	setTimestampLine = regexp.MustCompile(`(?i)^SET\s+timestamp\s*=\s*(\d+)\s*;?\s*$`)
+	useLineRegexp    = regexp.MustCompile("(?i)^use\\s+`?([^`;\\s]+)`?\\s*;\\s*$")
+)
+
+// 慢查询日志中 # Time: 的几种时间格式
+var slowLogTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"060102 15:04:05",
+	"060102  15:04:05",
+	"060102 3:04:05",
+}
+
+// 解析 # Time: 行中的时间。带时区信息的时间统一转换为本地时区
+func parseSlowLogTime(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range slowLogTimeLayouts {
+		var t time.Time
+		var err error
+		if layout == time.RFC3339Nano {
+			t, err = time.Parse(layout, value)
+			if err == nil {
+				return t.In(time.Local), true
+			}
+			continue
+		}
+		t, err = time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// 判断一行是否为 mysqld 启动时写入的日志头
+func isSlowLogBanner(line string) bool {
+	return strings.Contains(line, ", Version: ") && strings.Contains(line, "started with:") ||
+		strings.HasPrefix(line, "Tcp port: ") ||
+		(strings.HasPrefix(line, "Time ") || strings.HasPrefix(line, "Time\t")) && strings.Contains(line, "Id Command")
+}
+
+// slowLogParser 逐行解析 MySQL/MariaDB/Percona 慢查询日志
+type slowLogParser struct {
+	emit func(*slowEntry)
+	// 处理格式异常的记录，返回 true 时丢弃该记录；为 nil 时格式异常的记录照常统计
+	reject func(*slowEntry) bool
+
+	cur      *slowEntry
+	query    []string
+	lastTime time.Time
+	lastDb   string
+	// 从文件中间开始解析时，开头的记录可能沿用前一个分片中的数据库
+	midFile bool
+	// 当前记录的原始行，以及是否有可解析的 Query_time
+	raw          []string
+	hasQueryTime bool
+	badQueryTime string
+}
+
+func newSlowLogParser(emit func(*slowEntry), reject func(*slowEntry) bool) *slowLogParser {
+	return &slowLogParser{emit: emit, reject: reject}
+}
+
+// 开始一条新的记录，如果当前记录已有 SQL 内容则先提交
+func (p *slowLogParser) begin(offset int64) *slowEntry {
+	if p.cur != nil && len(p.query) > 0 {
+		p.flush()
+	}
+	if p.cur == nil {
+		p.cur = &slowEntry{Offset: offset, Ts: p.lastTime}
+		p.raw = p.raw[:0]
+		p.hasQueryTime = false
+		p.badQueryTime = ""
+	}
+	return p.cur
+}
+
+func (p *slowLogParser) flush() {
+	if p.cur == nil {
+		return
+	}
+	entry := p.cur
+	p.cur = nil
+	query := strings.TrimSpace(strings.Join(p.query, "\n"))
+	p.query = p.query[:0]
+	query = strings.TrimSuffix(query, ";")
+	if p.reject != nil {
+		if entry.Malformed = p.malformed(query); entry.Malformed != "" {
+			entry.Query = query
+			entry.Raw = strings.Join(p.raw, "")
+			if p.reject(entry) || query == "" {
+				return
+			}
+		}
+	}
+	if query == "" {
+		return
+	}
+	if entry.Db == "" {
+		entry.Db = p.lastDb
+		entry.dbPending = entry.Db == "" && p.midFile
+	} else {
+		p.lastDb = entry.Db
+	}
+	entry.Query = query
+	p.emit(entry)
+}
+
+// 检查记录是否完整，返回格式异常的原因
+func (p *slowLogParser) malformed(query string) string {
+	switch {
+	case query == "":
+		return "没有 SQL 语句，记录可能被截断"
+	case p.badQueryTime != "":
+		return "Query_time 不是有效的数字"
+	case !p.hasQueryTime:
+		return "缺少 # Query_time 行，记录头部可能被截断"
+	case strings.ContainsRune(query, 0) || !utf8.ValidString(query):
+		return "SQL 中包含二进制内容"
+	}
+	return sqlIncomplete(query)
+}
+
+// 检查 SQL 中的引号和块注释是否闭合，未闭合通常说明记录在写入过程中被截断
+func sqlIncomplete(query string) string {
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			end := i + 1
+			for ; end < len(query); end++ {
+				if query[end] == '\\' && c != '`' {
+					end++
+					continue
+				}
+				if query[end] == c {
+					// 两个连续的引号表示转义
+					if end+1 < len(query) && query[end+1] == c {
+						end++
+						continue
+					}
+					break
+				}
+			}
+			if end >= len(query) {
+				return "SQL 中的引号未闭合，记录可能被截断"
+			}
+			i = end
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return "SQL 中的注释未闭合，记录可能被截断"
+			}
+			i += end + 3
+		case c == '#' || c == '-' && strings.HasPrefix(query[i:], "-- "):
+			// 单行注释中的引号不需要闭合
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return ""
+			}
+			i += end
+		}
+	}
+	return ""
+}
+
+// 解析头部中的 Key: Value 属性
+func (p *slowLogParser) parseAttrs(entry *slowEntry, line string) {
+	fields := strings.Fields(line)
+	for i := 0; i+1 < len(fields); i++ {
+		if !strings.HasSuffix(fields[i], ":") || strings.HasSuffix(fields[i+1], ":") {
+			continue
+		}
+		key, value := strings.TrimSuffix(fields[i], ":"), fields[i+1]
+		i++
+		switch key {
+		case "Query_time":
+			var err error
+			if entry.QueryTime, err = strconv.ParseFloat(value, 64); err != nil {
+				p.badQueryTime = value
+			} else {
+				p.hasQueryTime = true
+			}
+		case "Lock_time":
+			entry.LockTime, _ = strconv.ParseFloat(value, 64)
+		case "Rows_sent":
+			entry.RowsSent, _ = strconv.ParseFloat(value, 64)
+		case "Rows_examined":
+			entry.RowsExamined, _ = strconv.ParseFloat(value, 64)
+		case "Id", "Thread_id":
+			entry.ThreadId = value
+		case "Schema":
+			entry.Db = value
+		default:
+			if entry.Attrs == nil {
+				entry.Attrs = make(map[string]string)
+			}
+			entry.Attrs[key] = value
+		}
+	}
+}
+
+// 处理一行日志，offset 为该行在文件中的起始位置
+func (p *slowLogParser) line(rawLine string, offset int64) {
+	p.handle(strings.TrimRight(rawLine, "\r\n"), offset)
+	if p.cur != nil && p.reject != nil {
+		p.raw = append(p.raw, rawLine)
+	}
+}
+
+func (p *slowLogParser) handle(line string, offset int64) {
+	switch {
+	case strings.HasPrefix(line, "# Time: "):
+		p.flush()
+		entry := p.begin(offset)
+		if t, ok := parseSlowLogTime(line[len("# Time: "):]); ok {
+			entry.Ts = t
+			p.lastTime = t
+		}
+	case strings.HasPrefix(line, "# User@Host: "):
+		if p.cur != nil && (len(p.query) > 0 || p.cur.User != "" || p.cur.Host != "") {
+			p.flush()
+		}
+		entry := p.begin(offset)
+		if m := userHostRegexp.FindStringSubmatch(line); m != nil {
+			entry.User = m[1]
+			entry.Host = m[3]
+			if entry.Host == "" {
+				entry.Host = m[2]
+			}
+			if m[4] != "" {
+				entry.ThreadId = m[4]
+			}
+		}
+	case strings.HasPrefix(line, "# Query_time: ") && (p.cur == nil || len(p.query) > 0):
+		// 没有 User@Host 行的记录
+		entry := p.begin(offset)
+		p.parseAttrs(entry, line)
+	case strings.HasPrefix(line, "# administrator command: ") && p.cur != nil:
+		p.query = append(p.query, line[2:])
+	case strings.HasPrefix(line, "# explain: ") && p.cur != nil && len(p.query) == 0:
+		// MariaDB log_slow_verbosity=explain 输出的执行计划，不参与统计
+	case strings.HasPrefix(line, "# ") && p.cur != nil && len(p.query) == 0:
+		p.parseAttrs(p.cur, line[2:])
+	case isSlowLogBanner(line):
+		p.flush()
+	default:
+		if p.cur == nil {
+			// 不属于任何记录的内容（例如文件开头被截断的部分）
+			return
+		}
+		if len(p.query) == 0 {
+			if m := setTimestampLine.FindStringSubmatch(line); m != nil {
+				if sec, err := strconv.ParseInt(m[1], 10, 64); err == nil && p.cur.Ts.IsZero() {
+					p.cur.Ts = time.Unix(sec, 0)
+				}
+				return
+			}
+			if m := useLineRegexp.FindStringSubmatch(line); m != nil {
+				p.cur.Db = m[1]
+				return
+			}
+			if strings.TrimSpace(line) == "" {
+				return
+			}
+		}
+		p.query = append(p.query, line)
+	}
+}
+
+// 提交最后一条记录
+func (p *slowLogParser) close() {
+	p.flush()
+}
+
+// 解析慢查询日志，baseOffset 为 r 在文件中的起始位置，limit 大于 0 时只解析到该位置之前开始的记录。
+// reject 不为 nil 时检查每条记录是否完整，格式异常的记录交给 reject 处理
+func parseSlowLog(r io.Reader, baseOffset, limit int64, emit func(*slowEntry), reject func(*slowEntry) bool, progress func(int64)) error {
+	reader := bufio.NewReaderSize(r, 1<<20)
+	parser := newSlowLogParser(emit, reject)
+	parser.midFile = baseOffset > 0
+	offset := baseOffset
+	var buf bytes.Buffer
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		buf.Write(chunk)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if buf.Len() > 0 {
+			n := int64(buf.Len())
+			if limit > 0 && offset >= limit && isEntryStart(buf.Bytes()) {
+				break
+			}
+			parser.line(buf.String(), offset)
+			offset += n
+			if progress != nil {
+				progress(n)
+			}
+			buf.Reset()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	parser.close()
+	return nil
+}
+
+// 判断一行是否可以作为分片的起点
+func isEntryStart(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("# Time: "))
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"strings"
+)
+
+// 超过该长度的 SQL 只高亮不格式化，例如几万行的批量 INSERT
+const sqlFormatMaxLen = 64 << 10
+
+// sqlTokenKind SQL 词法单元的类型，决定高亮使用的样式
+type sqlTokenKind int
+
+const (
+	sqlTokenSpace sqlTokenKind = iota
+	sqlTokenWord
+	sqlTokenKeyword
+	sqlTokenFunction
+	sqlTokenIdent
+	sqlTokenString
+	sqlTokenNumber
+	sqlTokenParam
+	sqlTokenComment
+	sqlTokenLineComment
+	sqlTokenPunct
+)
+
+// 高亮使用的 CSS 类名，样式定义在报告模板中
+var sqlTokenClasses = map[sqlTokenKind]string{
+	sqlTokenKeyword:     "sql-kw",
+	sqlTokenFunction:    "sql-fn",
+	sqlTokenIdent:       "sql-id",
+	sqlTokenString:      "sql-str",
+	sqlTokenNumber:      "sql-num",
+	sqlTokenParam:       "sql-param",
+	sqlTokenComment:     "sql-cmt",
+	sqlTokenLineComment: "sql-cmt",
+}
+
+type sqlToken struct {
+	Kind sqlTokenKind
+	Text string
+	// 关键字的大写形式，用于判断子句
+	Upper string
+}
+
+// 高亮的关键字，函数名（后面紧跟括号的单词）单独处理
+var sqlKeywords = toSet(strings.Fields(`
+	ADD ALL ALTER AND ANY AS ASC BEGIN BETWEEN BY CALL CASE CAST COLLATE COLUMN COMMIT CREATE CROSS
+	CURRENT_DATE CURRENT_TIME CURRENT_TIMESTAMP DEFAULT DELETE DESC DISTINCT DIV DROP DUPLICATE ELSE END
+	ESCAPE EXCEPT EXISTS EXPLAIN FALSE FETCH FIRST FOR FORCE FROM FULL GROUP HAVING IF IGNORE ILIKE IN INDEX
+	INNER INSERT INTERSECT INTERVAL INTO IS JOIN KEY LATERAL LEFT LIKE LIMIT LOCK MOD NATURAL NOT NULL
+	NULLS OFFSET ON OR ORDER OUTER OVER PARTITION PRIMARY RECURSIVE REGEXP REPLACE RETURNING RIGHT RLIKE
+	ROLLBACK ROW ROWS SELECT SET SHARE SHOW SQL_CALC_FOUND_ROWS SQL_NO_CACHE STRAIGHT_JOIN TABLE THEN
+	TO TRUE TRUNCATE UNION UNIQUE UNKNOWN UPDATE USE USING VALUES VIEW WHEN WHERE WINDOW WITH XOR`))
+
+// 后面跟表名的关键字
+var sqlTableKeywords = toSet([]string{"INTO", "TABLE", "UPDATE", "JOIN", "FROM", "REFERENCES"})
+
+// 需要另起一行的子句，值表示子句的内容是否也另起一行并缩进
+var sqlClauses = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "GROUP BY": true, "ORDER BY": true, "HAVING": true,
+	"SET": true, "VALUES": true, "RETURNING": true, "WINDOW": true,
+	"UNION": true, "UNION ALL": true, "UNION DISTINCT": true, "INTERSECT": true, "EXCEPT": true,
+	"LIMIT": false, "OFFSET": false, "INSERT INTO": false, "REPLACE INTO": false, "INSERT IGNORE INTO": false,
+	"UPDATE": false, "DELETE": false, "WITH": false, "WITH RECURSIVE": false,
+	"ON DUPLICATE KEY UPDATE": false, "FOR UPDATE": false, "FOR SHARE": false, "LOCK IN SHARE MODE": false,
+	"ON CONFLICT": false,
+}
+
+// 与 FROM 中的表处于同一层级的连接
+var sqlJoins = []string{
+	"LEFT OUTER JOIN", "RIGHT OUTER JOIN", "FULL OUTER JOIN", "LEFT JOIN", "RIGHT JOIN", "FULL JOIN",
+	"INNER JOIN", "CROSS JOIN", "NATURAL JOIN", "STRAIGHT_JOIN", "JOIN",
+}
+
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// 将 SQL 切分为词法单元，引号、注释的规则与 normalizeQuery 一致
+func tokenizeSQL(q string, dialect sqlDialect) []sqlToken {
+	pg := dialect == dialectPostgres
+	var tokens []sqlToken
+	add := func(kind sqlTokenKind, text string) {
+		tokens = append(tokens, sqlToken{Kind: kind, Text: text})
+	}
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case isSpaceByte(c):
+			j := i + 1
+			for j < len(q) && isSpaceByte(q[j]) {
+				j++
+			}
+			add(sqlTokenSpace, q[i:j])
+			i = j
+		case c == '/' && i+1 < len(q) && q[i+1] == '*':
+			end := strings.Index(q[i+2:], "*/")
+			if end < 0 {
+				end = len(q)
+			} else {
+				end += i + 4
+			}
+			add(sqlTokenComment, q[i:end])
+			i = end
+		case c == '#' && !pg || c == '-' && i+1 < len(q) && q[i+1] == '-' && (i+2 == len(q) || isSpaceByte(q[i+2])):
+			end := strings.IndexByte(q[i:], '\n')
+			if end < 0 {
+				end = len(q)
+			} else {
+				end += i
+			}
+			add(sqlTokenLineComment, q[i:end])
+			i = end
+		case pg && c == '$' && skipPgDollar(q, i) > 0:
+			end := skipPgDollar(q, i)
+			if i+1 < len(q) && q[i+1] >= '0' && q[i+1] <= '9' {
+				add(sqlTokenParam, q[i:end])
+			} else {
+				add(sqlTokenString, q[i:end])
+			}
+			i = end
+		case c == '`' || pg && c == '"':
+			end := strings.IndexByte(q[i+1:], c)
+			if end < 0 {
+				end = len(q)
+			} else {
+				end += i + 2
+			}
+			add(sqlTokenIdent, q[i:end])
+			i = end
+		case c == '\'' || c == '"':
+			backslash := !pg || i > 0 && (q[i-1] == 'e' || q[i-1] == 'E')
+			j := i + 1
+			for j < len(q) {
+				if q[j] == '\\' && backslash {
+					j += 2
+					continue
+				}
+				if q[j] == c {
+					if j+1 < len(q) && q[j+1] == c {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			end := min(j+1, len(q))
+			add(sqlTokenString, q[i:end])
+			i = end
+		case c == '?':
+			add(sqlTokenParam, "?")
+			i++
+		case isWordByte(c):
+			j := i + 1
+			number := c >= '0' && c <= '9'
+			for j < len(q) && (isWordByte(q[j]) || number && q[j] == '.' ||
+				number && (q[j] == '+' || q[j] == '-') && (q[j-1] == 'e' || q[j-1] == 'E')) {
+				j++
+			}
+			if number {
+				add(sqlTokenNumber, q[i:j])
+			} else {
+				add(sqlTokenWord, q[i:j])
+			}
+			i = j
+		default:
+			add(sqlTokenPunct, q[i:i+1])
+			i++
+		}
+	}
+	// 上一个单词，INSERT INTO t(a, b) 中紧跟括号的表名不是函数
+	var prev string
+	for i := range tokens {
+		t := &tokens[i]
+		if t.Kind != sqlTokenWord {
+			continue
+		}
+		t.Upper = strings.ToUpper(t.Text)
+		call := i+1 < len(tokens) && tokens[i+1].Text == "(" && !sqlTableKeywords[prev]
+		prev = t.Upper
+		switch {
+		case call && !sqlKeywords[t.Upper]:
+			t.Kind = sqlTokenFunction
+		case sqlKeywords[t.Upper] || sqlClauses[t.Upper]:
+			t.Kind = sqlTokenKeyword
+		}
+	}
+	return tokens
+}
+
+// 从 tokens[i] 开始匹配由多个关键字组成的短语，例如 GROUP BY、LEFT OUTER JOIN，返回短语之后的位置
+func matchSQLPhrase(tokens []sqlToken, i int, phrase string) int {
+	for _, word := range strings.Fields(phrase) {
+		for i < len(tokens) && (tokens[i].Kind == sqlTokenSpace || tokens[i].Kind == sqlTokenComment) {
+			i++
+		}
+		if i >= len(tokens) || tokens[i].Upper != word {
+			return -1
+		}
+		i++
+	}
+	return i
+}
+
+// 找出 tokens[i] 开始的子句或连接，返回短语、短语之后的位置以及是否为连接
+func sqlClauseAt(tokens []sqlToken, i int) (string, int, bool) {
+	if tokens[i].Kind != sqlTokenKeyword && tokens[i].Kind != sqlTokenWord {
+		return "", -1, false
+	}
+	for _, join := range sqlJoins {
+		if end := matchSQLPhrase(tokens, i, join); end > 0 {
+			return join, end, true
+		}
+	}
+	var best string
+	bestEnd := -1
+	for clause := range sqlClauses {
+		if end := matchSQLPhrase(tokens, i, clause); end > bestEnd {
+			best, bestEnd = clause, end
+		}
+	}
+	return best, bestEnd, false
+}
+
+// sqlFormatter 按子句换行缩进 SQL，并输出带高亮的 HTML
+type sqlFormatter struct {
+	b bytes.Buffer
+	// 当前行在 b 中的起始位置
+	lineOffset int
+	// 当前行的缩进层级
+	indent int
+	// 是否需要在下一个词法单元之前输出空格
+	space bool
+	// 当前行是否还没有内容
+	lineStart bool
+	frames    []*sqlFrame
+}
+
+// sqlFrame 一个查询块（最外层查询或括号中的子查询）的状态
+type sqlFrame struct {
+	// 子句所在的缩进层级
+	level int
+	// 块内普通括号（函数调用、IN 列表等）的嵌套深度，括号内不换行
+	depth int
+	// 当前子句，决定逗号和 AND/OR 是否换行
+	clause string
+	// 子查询开始时所在行的缩进层级，右括号回到该层级
+	openIndent int
+}
+
+func (f *sqlFormatter) frame() *sqlFrame {
+	return f.frames[len(f.frames)-1]
+}
+
+func (f *sqlFormatter) newline(indent int) {
+	switch {
+	case f.lineStart:
+		// 当前行还没有内容时只调整缩进，不产生空行
+		f.b.Truncate(f.lineOffset)
+	case f.b.Len() > 0:
+		f.b.WriteByte('\n')
+		f.lineOffset = f.b.Len()
+	}
+	f.b.WriteString(strings.Repeat("  ", indent))
+	f.indent = indent
+	f.space = false
+	f.lineStart = true
+}
+
+func (f *sqlFormatter) write(t sqlToken) {
+	if f.space && !f.lineStart {
+		f.b.WriteByte(' ')
+	}
+	f.space = false
+	f.lineStart = false
+	f.b.WriteString(highlightToken(t))
+}
+
+// 下一个有意义的词法单元是否为子查询的开头
+func startsSubquery(tokens []sqlToken, i int) bool {
+	for ; i < len(tokens); i++ {
+		switch tokens[i].Kind {
+		case sqlTokenSpace, sqlTokenComment:
+			continue
+		}
+		return tokens[i].Upper == "SELECT" || tokens[i].Upper == "WITH"
+	}
+	return false
+}
+
+func (f *sqlFormatter) format(tokens []sqlToken) {
+	f.frames = []*sqlFrame{{}}
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		fr := f.frame()
+		switch {
+		case t.Kind == sqlTokenSpace:
+			f.space = true
+			continue
+		case t.Kind == sqlTokenLineComment:
+			f.write(t)
+			f.newline(f.indent)
+			continue
+		case t.Text == "(":
+			f.write(t)
+			if startsSubquery(tokens, i+1) {
+				f.frames = append(f.frames, &sqlFrame{level: f.indent + 1, openIndent: f.indent})
+			} else {
+				fr.depth++
+			}
+			continue
+		case t.Text == ")":
+			if fr.depth == 0 && len(f.frames) > 1 {
+				f.frames = f.frames[:len(f.frames)-1]
+				f.newline(fr.openIndent)
+			} else if fr.depth > 0 {
+				fr.depth--
+			}
+			f.write(t)
+			continue
+		case fr.depth > 0:
+			f.write(t)
+			continue
+		case t.Text == ",":
+			f.write(t)
+			if fr.clause != "" && fr.clause != "LIMIT" && fr.clause != "WITH" {
+				f.newline(fr.level + 1)
+			}
+			continue
+		case t.Text == ";":
+			f.write(t)
+			fr.clause = ""
+			continue
+		case (t.Upper == "AND" || t.Upper == "OR") && fr.clause != "" && fr.clause != "SELECT" && !betweenAnd(tokens, i):
+			f.newline(fr.level + 1)
+			f.write(t)
+			continue
+		}
+
+		phrase, end, join := sqlClauseAt(tokens, i)
+		if phrase == "VALUES" && fr.clause == "ON DUPLICATE KEY UPDATE" {
+			// ON DUPLICATE KEY UPDATE 中的 VALUES(col) 是函数
+			phrase = ""
+		}
+		switch {
+		case join && fr.clause == "FROM":
+			f.newline(fr.level + 1)
+		case phrase != "" && !join:
+			f.newline(fr.level)
+		default:
+			f.write(t)
+			continue
+		}
+		// 输出短语中的所有词法单元，短语内部的空白合并为一个空格
+		for ; i < end; i++ {
+			if tokens[i].Kind == sqlTokenSpace {
+				f.space = true
+				continue
+			}
+			f.write(tokens[i])
+		}
+		i--
+		if !join {
+			fr.clause = phrase
+			if sqlClauses[phrase] {
+				f.newline(fr.level + 1)
+			}
+		}
+	}
+}
+
+// 判断 AND 是否属于 BETWEEN ... AND ...
+func betweenAnd(tokens []sqlToken, i int) bool {
+	if tokens[i].Upper != "AND" {
+		return false
+	}
+	for j := i - 1; j >= 0 && j >= i-8; j-- {
+		switch tokens[j].Upper {
+		case "BETWEEN":
+			return true
+		case "AND", "OR", "WHERE", "ON", "HAVING", "WHEN":
+			return false
+		}
+	}
+	return false
+}
+
+// 格式化 SQL 并生成带语法高亮的 HTML。格式化只调整换行和缩进，不改变词法单元本身
+func prettySQL(q string, dialect sqlDialect) template.HTML {
+	tokens := tokenizeSQL(strings.TrimSpace(q), dialect)
+	f := &sqlFormatter{}
+	if len(q) > sqlFormatMaxLen {
+		for _, t := range tokens {
+			f.b.WriteString(highlightToken(t))
+		}
+		return template.HTML(f.b.String())
+	}
+	f.format(tokens)
+	return template.HTML(f.b.String())
+}
+
+func highlightToken(t sqlToken) string {
+	text := html.EscapeString(t.Text)
+	if class, ok := sqlTokenClasses[t.Kind]; ok {
+		return `<span class="` + class + `">` + text + `</span>`
+	}
+	return text
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 内存中保留的分析结果数，超过时删除最久未访问的结果，之后从 JSON 导出文件中读取。
+// 没有导出 JSON 的结果删除前先写入报告目录的 JSON 文件
+const analysisCacheSize = 20
+
+// storedAnalysis 一份保存在Web服务中的分析结果，按请求生成 HTML 报告、导出文件和接口数据
+type storedAnalysis struct {
+	Id string
+	// 写入报告目录的 HTML 报告和导出文件，只在内存中保留时为空
+	Report  string
+	Exports []string
+	Data    ReportData
+	Created time.Time
+	// 分析结果和生成报告时的参数，按请求脱敏时重新生成报告数据；从导出文件读取时为 nil
+	report   *Report
+	req      reportRequest
+	detected []detectedInput
+	// 全部语句的执行次数，用于计算各类查询的占比
+	queryCount int
+	// 从 JSON 导出文件中读取时为文件的修改时间，文件变化后重新读取
+	diskModTime time.Time
+}
+
+// analysisStore 保存本进程生成的分析结果，以及从报告目录的 JSON 导出文件中读取的结果
+type analysisStore struct {
+	mu      sync.Mutex
+	dir     string
+	entries map[string]*storedAnalysis
+	order   []string
+	// 按请求脱敏使用的脱敏器，包含 -redactRules 中的自定义规则
+	redactors map[string]*sqlRedactor
+}
+
+func newAnalysisStore(dir, redactRules string) (*analysisStore, error) {
+	s := &analysisStore{
+		dir:       dir,
+		entries:   make(map[string]*storedAnalysis),
+		redactors: make(map[string]*sqlRedactor),
+	}
+	for _, level := range []string{redactFingerprint, redactLiterals, redactPII} {
+		redactor, err := newSQLRedactor(level, redactRules)
+		if err != nil {
+			return nil, err
+		}
+		s.redactors[level] = redactor
+	}
+	return s, nil
+}
+
+// 分析结果的 ID，即报告文件名去掉前缀和扩展名，例如 2024-04-16-10-00
+func analysisId(fileName string) string {
+	name := filepath.Base(fileName)
+	return strings.TrimPrefix(strings.TrimSuffix(name, filepath.Ext(name)), reportFilePrefix)
+}
+
+// 保存生成的分析结果
+func (s *analysisStore) add(result *reportResult) {
+	entry := &storedAnalysis{
+		Id:         result.Id,
+		Data:       result.Data,
+		Created:    time.Now(),
+		report:     result.report,
+		req:        result.req,
+		detected:   result.detected,
+		queryCount: result.report.Global.QueryCount,
+	}
+	if result.FileName != "" {
+		entry.Report = filepath.Base(result.FileName)
+	}
+	for _, file := range result.ExportFiles {
+		entry.Exports = append(entry.Exports, filepath.Base(file))
+	}
+	s.put(entry)
+}
+
+func (s *analysisStore) put(entry *storedAnalysis) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[entry.Id]; ok {
+		s.touch(entry.Id)
+	} else {
+		s.order = append(s.order, entry.Id)
+	}
+	s.entries[entry.Id] = entry
+	for len(s.order) > analysisCacheSize {
+		s.evictOldest()
+	}
+}
+
+// 将分析结果移到访问顺序的末尾，调用时需持有锁
+func (s *analysisStore) touch(id string) {
+	for i, other := range s.order {
+		if other == id {
+			s.order = append(append(s.order[:i], s.order[i+1:]...), id)
+			return
+		}
+	}
+}
+
+// 从内存中删除最久未访问的分析结果，只在内存中的结果先写入 JSON 文件，之后与导出了 JSON 的结果一样按请求读取。
+// 写入失败时结果无法再访问，仍然删除，避免内存无限增长。调用时需持有锁
+func (s *analysisStore) evictOldest() {
+	id := s.order[0]
+	entry := s.entries[id]
+	delete(s.entries, id)
+	s.order = s.order[1:]
+	if entry.persisted() {
+		return
+	}
+	if err := exportJSON(entry.Data, filepath.Join(s.dir, reportFilePrefix+id+".json")); err != nil {
+		printColoredInfo("red", "分析结果 %s 写入 JSON 文件失败，已从内存中删除: %s", id, err.Error())
+	}
+}
+
+// 是否可以从报告目录的 JSON 导出文件重新读取
+func (e *storedAnalysis) persisted() bool {
+	return !e.diskModTime.IsZero() || hasDuplicate(e.Exports, reportFilePrefix+e.Id+".json")
+}
+
+// 删除分析结果，例如超过保留数的定时报告
+func (s *analysisStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[id]; !ok {
+		return
+	}
+	delete(s.entries, id)
+	for i, other := range s.order {
+		if other == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *analysisStore) cached(id string) *storedAnalysis {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := s.entries[id]
+	if entry != nil {
+		s.touch(id)
+	}
+	return entry
+}
+
+// 本进程生成、仍保留在内存中的分析结果，不包括从导出文件读取的结果
+func (s *analysisStore) live() []*storedAnalysis {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []*storedAnalysis
+	for _, id := range s.order {
+		if entry := s.entries[id]; entry.diskModTime.IsZero() {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// 查找分析结果，内存中没有时读取报告目录中的 JSON 导出文件，都没有时返回 nil
+func (s *analysisStore) get(id string) (*storedAnalysis, error) {
+	name := reportFilePrefix + id + ".json"
+	if !reportFilePattern.MatchString(name) {
+		return nil, nil
+	}
+	entry := s.cached(id)
+	if entry != nil && entry.diskModTime.IsZero() {
+		return entry, nil
+	}
+	path := filepath.Join(s.dir, name)
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, nil
+	}
+	if entry != nil && entry.diskModTime.Equal(info.ModTime()) {
+		return entry, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var data ReportData
+	if err := json.NewDecoder(f).Decode(&data); err != nil {
+		return nil, fmt.Errorf("读取导出文件 %s 失败: %w", name, err)
+	}
+	// 导出文件中没有格式化后的 SQL 和表格数据，按导出的查询重新生成
+	dialect := dialectMySQL
+	if strings.HasPrefix(data.Engine, dialectPostgres.engine()) {
+		dialect = dialectPostgres
+	}
+	for i := range data.SlowQueries {
+		highlightSlowSqlInfo(&data.SlowQueries[i], dialect)
+	}
+	entry = &storedAnalysis{
+		Id:          id,
+		Data:        data,
+		Created:     info.ModTime(),
+		queryCount:  totalQueryCount(data),
+		diskModTime: info.ModTime(),
+	}
+	entry.Data.TableRows = buildTableRows(data.SlowQueries, entry.queryCount)
+	if info, err := os.Lstat(filepath.Join(s.dir, reportFilePrefix+id+".html")); err == nil && info.Mode().IsRegular() {
+		entry.Report = reportFilePrefix + id + ".html"
+	}
+	s.put(entry)
+	return entry, nil
+}
+
+func totalQueryCount(data ReportData) int {
+	total := 0
+	for _, info := range data.SlowQueries {
+		total += info.QueryCount
+	}
+	return total
+}
+
+// 按请求的参数生成报告数据：redactor 在保存的结果上再次脱敏，sortKey 重新排序，limit 只保留排序后的前 N 类
+func (e *storedAnalysis) view(redactor *sqlRedactor, sortKey string, limit int) (ReportData, error) {
+	data := e.Data
+	if redactor != nil {
+		if e.report == nil {
+			return data, errors.New("从导出文件读取的分析结果不支持 redact 参数")
+		}
+		var err error
+		if data, err = buildReportData(redactor.redactedCopy(e.report), e.req, e.detected); err != nil {
+			return data, err
+		}
+		data.GenerateTime = e.Data.GenerateTime
+	}
+	infos := data.SlowQueries
+	if sortKey != "" {
+		infos = append([]SlowSqlInfo(nil), infos...)
+		if err := sortSlowSqlInfos(infos, sortKey); err != nil {
+			return data, err
+		}
+	}
+	if limit > 0 && limit < len(infos) {
+		data.Truncated = len(infos) - limit
+		infos = infos[:limit]
+	}
+	if sortKey != "" || data.Truncated > 0 {
+		data.SlowQueries = infos
+		data.TableRows = buildTableRows(infos, e.queryCount)
+	}
+	return data, nil
+}
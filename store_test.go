@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAnalysisStoreEviction(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newAnalysisStore(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < analysisCacheSize; i++ {
+		s.put(&storedAnalysis{Id: fmt.Sprintf("memory-%d", i), Data: ReportData{Engine: "MySQL"}})
+	}
+	// 访问过的结果移到末尾，不会最先被删除
+	if s.cached("memory-0") == nil {
+		t.Fatal("memory-0 is not cached")
+	}
+	for i := 0; i < 5; i++ {
+		s.put(&storedAnalysis{Id: fmt.Sprintf("new-%d", i)})
+	}
+	if len(s.entries) != analysisCacheSize || len(s.order) != analysisCacheSize {
+		t.Fatalf("entries/order = %d/%d, want %d", len(s.entries), len(s.order), analysisCacheSize)
+	}
+	if s.cached("memory-0") == nil {
+		t.Error("memory-0 was evicted although it was accessed recently")
+	}
+	for i := 1; i <= 5; i++ {
+		id := fmt.Sprintf("memory-%d", i)
+		if s.cached(id) != nil {
+			t.Errorf("%s is still cached", id)
+		}
+		// 只在内存中的结果删除前写入 JSON 文件，之后仍可读取
+		if _, err := os.Stat(filepath.Join(dir, reportFilePrefix+id+".json")); err != nil {
+			t.Errorf("%s was not written to a JSON file: %v", id, err)
+		}
+	}
+	entry, err := s.get("memory-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.Data.Engine != "MySQL" || !entry.persisted() {
+		t.Errorf("get(memory-1) = %+v, want the entry reloaded from its JSON file", entry)
+	}
+}
+
+func TestAnalysisStoreEvictionPersisted(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newAnalysisStore(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 已导出 JSON 的结果删除时不再写入文件
+	for i := 0; i <= analysisCacheSize; i++ {
+		id := fmt.Sprintf("json-%d", i)
+		s.put(&storedAnalysis{Id: id, Exports: []string{reportFilePrefix + id + ".json"}})
+	}
+	if s.cached("json-0") != nil {
+		t.Error("json-0 is still cached")
+	}
+	if _, err := os.Stat(filepath.Join(dir, reportFilePrefix+"json-0.json")); !os.IsNotExist(err) {
+		t.Errorf("json-0 was written to a JSON file: %v", err)
+	}
+}
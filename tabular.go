@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// 读取表格形式的导出文件，每一行返回一个 列名 -> 取值 的映射。
+// 支持 mysql -B 输出的 TSV、带表头的 CSV 以及 JSON（对象数组、逐个对象，或云厂商 API 返回的嵌套结构）。
+// JSON 中的 null 转换为 "NULL"，与 mysql -B 的输出保持一致
+func readRecordFile(path string) ([]map[string]string, error) {
+	rc, _, err := openInput(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil, fmt.Errorf("%s 是空文件", path)
+	}
+
+	if trimmed[0] == '[' || trimmed[0] == '{' {
+		return readJSONRecords(trimmed)
+	}
+	firstLine, _, _ := strings.Cut(string(trimmed), "\n")
+	if strings.Contains(firstLine, "\t") {
+		return readTSVRecords(trimmed)
+	}
+	return readCSVRecords(trimmed)
+}
+
+// 还原 mysql -B 输出中的转义字符
+func unescapeMysqlBatch(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 == len(value) {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case '0':
+			b.WriteByte(0)
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+func newRecord(header, values []string) map[string]string {
+	record := make(map[string]string, len(header))
+	for i, name := range header {
+		if i < len(values) {
+			record[name] = values[i]
+		}
+	}
+	return record
+}
+
+func trimHeader(header []string) []string {
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+	}
+	return header
+}
+
+func readTSVRecords(data []byte) ([]map[string]string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 1<<20), 64<<20)
+	var header []string
+	var records []map[string]string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		values := strings.Split(line, "\t")
+		if header == nil {
+			header = trimHeader(values)
+			continue
+		}
+		for i := range values {
+			values[i] = unescapeMysqlBatch(values[i])
+		}
+		records = append(records, newRecord(header, values))
+	}
+	return records, scanner.Err()
+}
+
+func readCSVRecords(data []byte) ([]map[string]string, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	header = trimHeader(header)
+	var records []map[string]string
+	for {
+		values, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, newRecord(header, values))
+	}
+	return records, nil
+}
+
+// 在 API 返回的嵌套结构中查找第一个对象数组，例如阿里云的 Items.SQLSlowRecord、
+// 腾讯云的 Response.Items 和 CloudWatch Logs 的 events
+func findRecordArray(value interface{}) ([]interface{}, bool) {
+	switch v := value.(type) {
+	case []interface{}:
+		if len(v) == 0 {
+			return v, true
+		}
+		if _, ok := v[0].(map[string]interface{}); ok {
+			return v, true
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if arr, ok := findRecordArray(v[k]); ok {
+				return arr, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func readJSONRecords(data []byte) ([]map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var objects []interface{}
+	for {
+		var value interface{}
+		if err := decoder.Decode(&value); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if arr, ok := findRecordArray(value); ok {
+			objects = append(objects, arr...)
+		} else {
+			objects = append(objects, value)
+		}
+	}
+
+	records := make([]map[string]string, 0, len(objects))
+	for _, value := range objects {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("JSON 中的记录不是对象: %v", value)
+		}
+		record := make(map[string]string, len(object))
+		for name, field := range object {
+			switch v := field.(type) {
+			case nil:
+				record[name] = "NULL"
+			case string:
+				record[name] = v
+			default:
+				record[name] = fmt.Sprint(v)
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -0,0 +1,684 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MySQL 客户端能力标志
+const (
+	clientConnectWithDb    = 0x00000008
+	clientCompress         = 0x00000020
+	clientProtocol41       = 0x00000200
+	clientSSL              = 0x00000800
+	clientSecureConnection = 0x00008000
+	clientPluginAuthLenenc = 0x00200000
+	clientDeprecateEOF     = 0x01000000
+	clientQueryAttributes  = 0x08000000
+)
+
+// MySQL 命令
+const (
+	comQuit        = 0x01
+	comInitDb      = 0x02
+	comQuery       = 0x03
+	comStmtPrepare = 0x16
+	comStmtExecute = 0x17
+	comStmtClose   = 0x19
+)
+
+// 服务端状态标志：后面还有结果集
+const serverMoreResultsExists = 0x0008
+
+// 乱序到达的报文段最多缓存的个数，超过后认为中间的数据包丢失
+const tcpMaxPendingSegments = 256
+
+// 解析服务端端口列表，例如 "3306,3307"
+func parseServerPorts(value string) (map[uint16]bool, error) {
+	ports := make(map[uint16]bool)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(item, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("无效的 MySQL 服务端端口: %s", item)
+		}
+		ports[uint16(port)] = true
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("没有指定 MySQL 服务端端口")
+	}
+	return ports, nil
+}
+
+// tcpStream TCP 连接一个方向上的字节流重组
+type tcpStream struct {
+	started bool
+	next    uint32
+	pending map[uint32][]byte
+	// 按顺序交付数据，gap 为 true 表示之前有数据丢失
+	deliver func(data []byte, ts time.Time, gap bool)
+}
+
+func (s *tcpStream) add(seg *tcpSegment) {
+	if seg.SYN {
+		s.started = true
+		s.next = seg.Seq + 1
+		s.pending = nil
+		return
+	}
+	if len(seg.Payload) == 0 {
+		return
+	}
+	if !s.started {
+		// 抓包开始时连接已经建立
+		s.started = true
+		s.next = seg.Seq
+	}
+	seq, payload := seg.Seq, seg.Payload
+	diff := int32(seq - s.next)
+	if diff < 0 {
+		// 重传或与已交付数据重叠的部分
+		if int(-diff) >= len(payload) {
+			return
+		}
+		payload = payload[-diff:]
+		diff = 0
+	}
+	if diff > 0 {
+		if s.pending == nil {
+			s.pending = make(map[uint32][]byte)
+		}
+		if _, ok := s.pending[seq]; !ok {
+			s.pending[seq] = append([]byte(nil), payload...)
+		}
+		if len(s.pending) <= tcpMaxPendingSegments {
+			return
+		}
+		// 缓存过多，跳过丢失的数据，从最早的缓存报文段继续
+		first := true
+		for pseq := range s.pending {
+			if first || int32(pseq-s.next) < int32(seq-s.next) {
+				seq, first = pseq, false
+			}
+		}
+		payload = s.pending[seq]
+		delete(s.pending, seq)
+		s.next = seq
+		s.deliver(payload, seg.Ts, true)
+		s.next += uint32(len(payload))
+		s.drain(seg.Ts)
+		return
+	}
+	s.deliver(payload, seg.Ts, false)
+	s.next += uint32(len(payload))
+	s.drain(seg.Ts)
+}
+
+// 交付已经可以接上的缓存报文段
+func (s *tcpStream) drain(ts time.Time) {
+	for len(s.pending) > 0 {
+		progressed := false
+		for seq, data := range s.pending {
+			diff := int32(seq - s.next)
+			if diff > 0 {
+				continue
+			}
+			delete(s.pending, seq)
+			if int(-diff) < len(data) {
+				data = data[-diff:]
+				s.deliver(data, ts, false)
+				s.next += uint32(len(data))
+			}
+			progressed = true
+		}
+		if !progressed {
+			return
+		}
+	}
+}
+
+// mysqlPacketReader 从字节流中拆分 MySQL 协议包，超过 16MB 的包会被合并
+type mysqlPacketReader struct {
+	buf   []byte
+	large []byte
+}
+
+func (p *mysqlPacketReader) reset() {
+	p.buf = p.buf[:0]
+	p.large = nil
+}
+
+func (p *mysqlPacketReader) feed(data []byte, fn func(seq byte, payload []byte)) {
+	p.buf = append(p.buf, data...)
+	for len(p.buf) >= 4 {
+		length := int(p.buf[0]) | int(p.buf[1])<<8 | int(p.buf[2])<<16
+		if len(p.buf) < 4+length {
+			return
+		}
+		seq := p.buf[3]
+		payload := p.buf[4 : 4+length]
+		if length == 0xFFFFFF {
+			p.large = append(p.large, payload...)
+		} else if p.large != nil {
+			fn(seq, append(p.large, payload...))
+			p.large = nil
+		} else {
+			fn(seq, payload)
+		}
+		p.buf = p.buf[4+length:]
+	}
+	if len(p.buf) == 0 {
+		// 避免底层数组无限增长
+		p.buf = nil
+	}
+}
+
+// 读取长度编码整数，返回值和占用的字节数
+func readLenencInt(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	switch b[0] {
+	case 0xFC:
+		if len(b) >= 3 {
+			return uint64(binary.LittleEndian.Uint16(b[1:])), 3
+		}
+	case 0xFD:
+		if len(b) >= 4 {
+			return uint64(b[1]) | uint64(b[2])<<8 | uint64(b[3])<<16, 4
+		}
+	case 0xFE:
+		if len(b) >= 9 {
+			return binary.LittleEndian.Uint64(b[1:]), 9
+		}
+	case 0xFB, 0xFF:
+	default:
+		return uint64(b[0]), 1
+	}
+	return 0, 0
+}
+
+// 解析 OK 包中的影响行数和状态标志
+func parseOKPacket(payload []byte) (affected uint64, status uint16) {
+	affected, n := readLenencInt(payload[1:])
+	pos := 1 + n
+	_, n = readLenencInt(payload[pos:])
+	pos += n
+	if n > 0 && pos+2 <= len(payload) {
+		status = binary.LittleEndian.Uint16(payload[pos:])
+	}
+	return affected, status
+}
+
+// 连接所处的阶段
+const (
+	connGreeting = iota
+	connHandshake
+	connAuth
+	connCommand
+	// SSL 加密或压缩协议的连接无法解析
+	connSkip
+)
+
+// 响应解析的状态
+const (
+	respFirst = iota
+	respColumns
+	respColumnsEOF
+	respRows
+)
+
+// mysqlRequest 一个等待响应的命令
+type mysqlRequest struct {
+	ts       time.Time
+	cmd      byte
+	query    string
+	db       string
+	state    int
+	columns  uint64
+	rows     int64
+	affected uint64
+	errno    uint16
+	last     time.Time
+	// 结果集以 0xFE 短包结束，无法确定是列定义后的 EOF 还是 CLIENT_DEPRECATE_EOF 的结束包
+	ambiguous bool
+}
+
+// mysqlConn 一个 MySQL 客户端连接
+type mysqlConn struct {
+	client     netip.AddrPort
+	phase      int
+	caps       uint32
+	eofKnown   bool
+	user       string
+	db         string
+	threadId   string
+	prepared   map[uint32]string
+	req        *mysqlRequest
+	toServer   tcpStream
+	toClient   tcpStream
+	clientPkts mysqlPacketReader
+	serverPkts mysqlPacketReader
+	// 连接中途开始抓包或丢包后，需要在报文段边界重新对齐协议包
+	clientSynced bool
+	serverSynced bool
+	emit         func(*slowEntry)
+}
+
+func newMysqlConn(client netip.AddrPort, fromStart bool, emit func(*slowEntry)) *mysqlConn {
+	c := &mysqlConn{
+		client:       client,
+		prepared:     make(map[uint32]string),
+		clientSynced: fromStart,
+		serverSynced: fromStart,
+		emit:         emit,
+	}
+	if !fromStart {
+		c.phase = connCommand
+		c.caps = clientProtocol41
+	}
+	c.toServer.deliver = c.fromClient
+	c.toClient.deliver = c.fromServer
+	return c
+}
+
+// 判断报文段开头是否像一个命令包，用于重新对齐客户端数据
+func looksLikeCommand(data []byte) bool {
+	if len(data) < 5 || data[3] != 0 {
+		return false
+	}
+	length := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+	switch data[4] {
+	case comQuery:
+		return length+4 >= len(data)
+	case comQuit, comInitDb, comStmtPrepare, comStmtExecute, comStmtClose, 0x0E, 0x11, 0x1A, 0x1F:
+		return length+4 == len(data)
+	}
+	return false
+}
+
+func (c *mysqlConn) fromClient(data []byte, ts time.Time, gap bool) {
+	if c.phase == connSkip {
+		return
+	}
+	if gap {
+		c.lostSync()
+	}
+	if !c.clientSynced {
+		if !looksLikeCommand(data) {
+			return
+		}
+		c.clientSynced = true
+		c.clientPkts.reset()
+	}
+	c.clientPkts.feed(data, func(seq byte, payload []byte) {
+		c.clientPacket(seq, payload, ts)
+	})
+}
+
+func (c *mysqlConn) fromServer(data []byte, ts time.Time, gap bool) {
+	if c.phase == connSkip {
+		return
+	}
+	if gap {
+		c.lostSync()
+	}
+	if !c.serverSynced {
+		// 只有在已对齐的请求之后，响应才从报文段开头开始
+		if c.req == nil {
+			return
+		}
+		c.serverSynced = true
+		c.serverPkts.reset()
+	}
+	c.serverPkts.feed(data, func(seq byte, payload []byte) {
+		c.serverPacket(seq, payload, ts)
+	})
+}
+
+// 丢包后丢弃进行中的请求，等待下一个命令重新对齐
+func (c *mysqlConn) lostSync() {
+	c.req = nil
+	c.clientSynced = false
+	c.serverSynced = false
+	c.clientPkts.reset()
+	c.serverPkts.reset()
+	if c.phase < connCommand {
+		c.phase = connCommand
+	}
+}
+
+func (c *mysqlConn) clientPacket(seq byte, payload []byte, ts time.Time) {
+	switch c.phase {
+	case connHandshake:
+		c.handshakeResponse(payload)
+		return
+	case connCommand:
+	default:
+		return
+	}
+	if seq != 0 || len(payload) == 0 {
+		// LOAD DATA LOCAL 发送的文件内容等
+		return
+	}
+	if c.req != nil && c.req.ambiguous {
+		// 上一个请求以 0xFE 短包结束，说明连接使用了 CLIENT_DEPRECATE_EOF
+		c.caps |= clientDeprecateEOF
+		c.eofKnown = true
+		c.finish(c.req.last)
+	}
+	c.req = nil
+
+	req := &mysqlRequest{ts: ts, cmd: payload[0], db: c.db, last: ts}
+	body := payload[1:]
+	switch payload[0] {
+	case comQuery:
+		if c.caps&clientQueryAttributes != 0 {
+			// MySQL 8.0.23 之后的查询属性，只支持没有属性的查询
+			count, n := readLenencInt(body)
+			if n == 0 || count != 0 {
+				return
+			}
+			_, m := readLenencInt(body[n:])
+			body = body[n+m:]
+		}
+		req.query = string(body)
+	case comInitDb:
+		req.query = string(body)
+	case comStmtPrepare:
+		req.query = string(body)
+	case comStmtExecute:
+		if len(body) < 4 {
+			return
+		}
+		req.query = c.prepared[binary.LittleEndian.Uint32(body)]
+	case comStmtClose:
+		if len(body) >= 4 {
+			delete(c.prepared, binary.LittleEndian.Uint32(body))
+		}
+		return
+	case comQuit:
+		return
+	}
+	c.req = req
+}
+
+// 解析客户端的握手响应，获取用户名、默认库和能力标志
+func (c *mysqlConn) handshakeResponse(payload []byte) {
+	if len(payload) < 4 {
+		c.phase = connSkip
+		return
+	}
+	caps := uint32(binary.LittleEndian.Uint16(payload))
+	if caps&clientProtocol41 == 0 {
+		// 4.1 之前的旧协议已经很少见，不再解析
+		c.phase = connSkip
+		return
+	}
+	caps = binary.LittleEndian.Uint32(payload)
+	c.caps = caps
+	c.eofKnown = true
+	if caps&clientSSL != 0 || caps&clientCompress != 0 || len(payload) < 32 {
+		c.phase = connSkip
+		return
+	}
+	rest := payload[32:]
+	end := bytes.IndexByte(rest, 0)
+	if end < 0 {
+		c.phase = connAuth
+		return
+	}
+	c.user = string(rest[:end])
+	rest = rest[end+1:]
+	switch {
+	case caps&clientPluginAuthLenenc != 0:
+		length, n := readLenencInt(rest)
+		if n == 0 || int(length)+n > len(rest) {
+			rest = nil
+		} else {
+			rest = rest[n+int(length):]
+		}
+	case caps&clientSecureConnection != 0:
+		if len(rest) == 0 || int(rest[0])+1 > len(rest) {
+			rest = nil
+		} else {
+			rest = rest[1+int(rest[0]):]
+		}
+	default:
+		if i := bytes.IndexByte(rest, 0); i >= 0 {
+			rest = rest[i+1:]
+		} else {
+			rest = nil
+		}
+	}
+	if caps&clientConnectWithDb != 0 && len(rest) > 0 {
+		if i := bytes.IndexByte(rest, 0); i >= 0 {
+			c.db = string(rest[:i])
+		} else {
+			c.db = string(rest)
+		}
+	}
+	c.phase = connAuth
+}
+
+func (c *mysqlConn) serverPacket(seq byte, payload []byte, ts time.Time) {
+	if len(payload) == 0 {
+		return
+	}
+	switch c.phase {
+	case connGreeting:
+		// 初始握手包：协议版本、服务端版本、连接 ID
+		if payload[0] != 10 {
+			c.phase = connSkip
+			return
+		}
+		end := bytes.IndexByte(payload[1:], 0)
+		if end < 0 || 1+end+5 > len(payload) {
+			c.phase = connSkip
+			return
+		}
+		c.threadId = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(payload[2+end:])), 10)
+		c.phase = connHandshake
+		return
+	case connAuth:
+		switch payload[0] {
+		case 0x00:
+			c.phase = connCommand
+		case 0xFF:
+			c.phase = connSkip
+		}
+		return
+	case connCommand:
+	default:
+		return
+	}
+
+	req := c.req
+	if req == nil {
+		return
+	}
+	req.last = ts
+	req.ambiguous = false
+	deprecateEOF := c.caps&clientDeprecateEOF != 0
+	switch req.state {
+	case respFirst:
+		switch payload[0] {
+		case 0x00:
+			if req.cmd == comStmtPrepare {
+				if len(payload) >= 5 {
+					c.prepared[binary.LittleEndian.Uint32(payload[1:])] = req.query
+				}
+				c.req = nil
+				return
+			}
+			affected, status := parseOKPacket(payload)
+			req.affected += affected
+			if status&serverMoreResultsExists == 0 {
+				c.finish(ts)
+			}
+		case 0xFF:
+			if len(payload) >= 3 {
+				req.errno = binary.LittleEndian.Uint16(payload[1:])
+			}
+			c.finish(ts)
+		case 0xFB:
+			// LOAD DATA LOCAL INFILE，客户端随后发送文件内容
+		default:
+			columns, n := readLenencInt(payload)
+			if n == 0 || columns == 0 {
+				c.finish(ts)
+				return
+			}
+			req.columns = columns
+			req.state = respColumns
+		}
+	case respColumns:
+		req.columns--
+		if req.columns == 0 {
+			if deprecateEOF {
+				req.state = respRows
+			} else {
+				req.state = respColumnsEOF
+			}
+		}
+	case respColumnsEOF:
+		req.state = respRows
+		if payload[0] == 0xFE && len(payload) < 9 {
+			if !c.eofKnown {
+				req.ambiguous = true
+			}
+			return
+		}
+		// 列定义之后直接是数据行，说明连接使用了 CLIENT_DEPRECATE_EOF
+		c.caps |= clientDeprecateEOF
+		c.eofKnown = true
+		req.rows++
+	case respRows:
+		switch {
+		case payload[0] == 0xFE && len(payload) < 0xFFFFFF && (deprecateEOF || len(payload) < 9):
+			var status uint16
+			if deprecateEOF {
+				_, status = parseOKPacket(payload)
+			} else if len(payload) >= 5 {
+				status = binary.LittleEndian.Uint16(payload[3:])
+			}
+			if status&serverMoreResultsExists != 0 {
+				req.state = respFirst
+				return
+			}
+			c.finish(ts)
+		case payload[0] == 0xFF:
+			if len(payload) >= 3 {
+				req.errno = binary.LittleEndian.Uint16(payload[1:])
+			}
+			c.finish(ts)
+		default:
+			req.rows++
+		}
+	}
+}
+
+// 请求的响应已完整，生成一条记录
+func (c *mysqlConn) finish(ts time.Time) {
+	req := c.req
+	c.req = nil
+	if req == nil {
+		return
+	}
+	if req.errno == 0 {
+		switch {
+		case req.cmd == comInitDb:
+			c.db = req.query
+			return
+		case req.cmd == comQuery:
+			q := strings.TrimSuffix(strings.TrimSpace(req.query), ";") + ";"
+			if m := useLineRegexp.FindStringSubmatch(q); m != nil {
+				c.db = m[1]
+			}
+		}
+	}
+	if req.query == "" || req.cmd != comQuery && req.cmd != comStmtExecute {
+		return
+	}
+	entry := &slowEntry{
+		Ts:        req.ts,
+		User:      c.user,
+		Host:      c.client.Addr().String(),
+		Db:        req.db,
+		ThreadId:  c.threadId,
+		QueryTime: ts.Sub(req.ts).Seconds(),
+		RowsSent:  float64(req.rows),
+		Query:     req.query,
+	}
+	if req.errno != 0 || req.affected > 0 {
+		entry.Attrs = make(map[string]string)
+		if req.errno != 0 {
+			entry.Attrs["Errno"] = strconv.Itoa(int(req.errno))
+		}
+		if req.affected > 0 {
+			entry.Attrs["Rows_affected"] = strconv.FormatUint(req.affected, 10)
+		}
+	}
+	c.emit(entry)
+}
+
+// 解析抓包文件中的 MySQL 流量，以请求到响应结束的时间作为执行时间
+func parseCapture(r io.Reader, serverPorts map[uint16]bool, emit func(*slowEntry), progress func(int64)) error {
+	reader, err := newCaptureReader(&countingReader{r: r, progress: progress})
+	if err != nil {
+		return err
+	}
+	type connKey struct{ client, server netip.AddrPort }
+	conns := make(map[connKey]*mysqlConn)
+	for {
+		pkt, err := reader.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		seg, ok := decodeTCPSegment(pkt)
+		if !ok {
+			continue
+		}
+		toServer := serverPorts[seg.Dst.Port()]
+		if !toServer && !serverPorts[seg.Src.Port()] {
+			continue
+		}
+		key := connKey{client: seg.Src, server: seg.Dst}
+		if !toServer {
+			key = connKey{client: seg.Dst, server: seg.Src}
+		}
+		conn := conns[key]
+		if toServer && seg.SYN && !seg.RST {
+			// 新连接（可能复用了旧连接的端口）
+			conn = newMysqlConn(key.client, true, emit)
+			conns[key] = conn
+		} else if conn == nil {
+			if seg.RST || seg.FIN && len(seg.Payload) == 0 {
+				continue
+			}
+			conn = newMysqlConn(key.client, seg.SYN, emit)
+			conns[key] = conn
+		}
+		if toServer {
+			conn.toServer.add(seg)
+		} else {
+			conn.toClient.add(seg)
+		}
+		if seg.RST || seg.FIN && !toServer {
+			// 连接关闭，未完成的请求丢弃
+			delete(conns, key)
+		}
+	}
+}
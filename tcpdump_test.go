@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCapture(t *testing.T) {
+	type entry struct {
+		query     string
+		queryTime float64
+		ts        time.Time
+		user      string
+		host      string
+		db        string
+		rowsSent  float64
+		attrs     map[string]string
+	}
+	at := func(sec, usec int) time.Time {
+		return time.Unix(int64(sec), int64(usec)*1000)
+	}
+	// 50002 端口的连接从响应中间开始抓包，没有握手信息；重传的响应包只统计一次，
+	// 预处理语句按 COM_STMT_PREPARE 中的 SQL 统计，跨越两个 TCP 包的请求重组为一条语句
+	want := []entry{
+		{query: "SELECT id, total FROM orders WHERE user_id = 1024", queryTime: 0.15, ts: at(1713225673, 0), user: "app", host: "10.0.0.5", db: "shop", rowsSent: 3},
+		{query: "SELECT id FROM orders WHERE id = 99", queryTime: 0.3, ts: at(1713225672, 600000), host: "10.0.0.6"},
+		{query: "SELECT id FROM orders WHERE id = 100", queryTime: 0.25, ts: at(1713225673, 500000), host: "10.0.0.6", rowsSent: 1},
+		{query: "SELECT id, total FROM orders WHERE user_id = 2048", queryTime: 0.35, ts: at(1713225674, 0), user: "app", host: "10.0.0.5", db: "shop", rowsSent: 3},
+		{query: "UPDATE orders SET status = 2 WHERE id = 7", queryTime: 0.8, ts: at(1713225675, 0), user: "app", host: "10.0.0.5", db: "shop", attrs: map[string]string{"Rows_affected": "1"}},
+		{query: "SELECT * FROM missing_table", queryTime: 0.01, ts: at(1713225676, 0), user: "app", host: "10.0.0.5", db: "shop", attrs: map[string]string{"Errno": "1146"}},
+		// COM_INIT_DB 切换了数据库
+		{query: "SELECT name FROM customers WHERE id = ?", queryTime: 0.2, ts: at(1713225679, 0), user: "app", host: "10.0.0.5", db: "crm", rowsSent: 1},
+		{query: "SELECT name FROM customers WHERE id = ?", queryTime: 0.4, ts: at(1713225680, 0), user: "app", host: "10.0.0.5", db: "crm", rowsSent: 1},
+		{query: "SELECT * FROM orders WHERE note IN (", queryTime: 0.04999, ts: at(1713225682, 10), user: "app", host: "10.0.0.5", db: "crm"},
+	}
+	for _, path := range []string{"testdata/mysql-traffic.pcap", "testdata/mysql-traffic.pcapng"} {
+		t.Run(path, func(t *testing.T) {
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var entries []*slowEntry
+			err = parseCapture(f, map[uint16]bool{3306: true}, func(e *slowEntry) { entries = append(entries, e) }, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(want) {
+				t.Fatalf("entries = %d, want %d", len(entries), len(want))
+			}
+			for i, w := range want {
+				e := entries[i]
+				if !strings.HasPrefix(e.Query, w.query) {
+					t.Errorf("#%d Query = %.60q, want prefix %q", i, e.Query, w.query)
+				}
+				// pcapng 的时间戳按接口的精度换算，允许微秒级的误差
+				if math.Abs(e.QueryTime-w.queryTime) > 1e-6 {
+					t.Errorf("#%d QueryTime = %v, want %v", i, e.QueryTime, w.queryTime)
+				}
+				if d := e.Ts.Sub(w.ts); d < -2*time.Microsecond || d > 2*time.Microsecond {
+					t.Errorf("#%d Ts = %v, want %v", i, e.Ts, w.ts)
+				}
+				if e.User != w.user || e.Host != w.host || e.Db != w.db {
+					t.Errorf("#%d User/Host/Db = %q/%q/%q, want %q/%q/%q", i, e.User, e.Host, e.Db, w.user, w.host, w.db)
+				}
+				if e.RowsSent != w.rowsSent {
+					t.Errorf("#%d RowsSent = %v, want %v", i, e.RowsSent, w.rowsSent)
+				}
+				for k, v := range w.attrs {
+					if e.Attrs[k] != v {
+						t.Errorf("#%d Attrs[%s] = %q, want %q", i, k, e.Attrs[k], v)
+					}
+				}
+			}
+			// 重组后的语句包含两个 TCP 包中的全部内容
+			if last := entries[len(entries)-1].Query; len(last) != 2326 || !strings.HasSuffix(last, ",'399')") {
+				t.Errorf("reassembled query = %d bytes ending with %q, want 2326 bytes ending with %q", len(last), last[max(len(last)-10, 0):], ",'399')")
+			}
+		})
+	}
+}